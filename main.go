@@ -13,6 +13,7 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"time"
 
 	"github.com/ehazlett/simplelog"
 	"github.com/rancher/wrangler/pkg/kubeconfig"
@@ -26,8 +27,10 @@ import (
 	"github.com/longhorn/node-disk-manager/pkg/block"
 	blockdevicev1 "github.com/longhorn/node-disk-manager/pkg/controller/blockdevice"
 	nodev1 "github.com/longhorn/node-disk-manager/pkg/controller/node"
+	"github.com/longhorn/node-disk-manager/pkg/filter"
 	longhornvctl1 "github.com/longhorn/node-disk-manager/pkg/generated/controllers/longhorn.io"
 	"github.com/longhorn/node-disk-manager/pkg/option"
+	"github.com/longhorn/node-disk-manager/pkg/persistence"
 	"github.com/longhorn/node-disk-manager/pkg/udev"
 	"github.com/longhorn/node-disk-manager/pkg/version"
 )
@@ -87,6 +90,57 @@ func main() {
 			Usage:       "Specify the node name",
 			Destination: &opt.NodeName,
 		},
+		&cli.BoolFlag{
+			Name:        "skip-leader-election",
+			EnvVars:     []string{"NDM_SKIP_LEADER_ELECTION"},
+			Usage:       "Skip the per-node leader election and start the controllers directly",
+			Destination: &opt.SkipLeaderElection,
+		},
+		&cli.StringFlag{
+			Name:        "device-filter-file",
+			EnvVars:     []string{"NDM_DEVICE_FILTER_FILE"},
+			Usage:       "Path of the device filter file, which decides the disks to be managed as block devices",
+			Destination: &opt.DeviceFilterFile,
+		},
+		&cli.StringFlag{
+			Name:        "device-filter-configmap",
+			EnvVars:     []string{"NDM_DEVICE_FILTER_CONFIGMAP"},
+			Usage:       "Name of the ConfigMap in the namespace that contains the device filter",
+			Destination: &opt.DeviceFilterConfigMap,
+		},
+		&cli.StringFlag{
+			Name:        "udev-rules-file",
+			EnvVars:     []string{"NDM_UDEV_RULES_FILE"},
+			Usage:       "Path of the JSON file contains the rules to match the udev events, the file is reloaded on change",
+			Destination: &opt.UdevRulesFile,
+		},
+		&cli.DurationFlag{
+			Name:        "rescan-interval",
+			EnvVars:     []string{"NDM_RESCAN_INTERVAL"},
+			Value:       5 * time.Minute,
+			Usage:       "Interval of the full rescan that reconciles the block devices with the node inventory, 0 to disable",
+			Destination: &opt.RescanInterval,
+		},
+		&cli.StringFlag{
+			Name:        "vanished-device-policy",
+			EnvVars:     []string{"NDM_VANISHED_DEVICE_POLICY"},
+			Value:       blockdevicev1.VanishedDevicePolicyInactive,
+			Usage:       "What to do with the block device that vanished from the node on rescan, options are \"inactive\" or \"delete\"",
+			Destination: &opt.VanishedDevicePolicy,
+		},
+		&cli.StringFlag{
+			Name:        "mount-persistence",
+			EnvVars:     []string{"NDM_MOUNT_PERSISTENCE"},
+			Value:       persistence.ModeNone,
+			Usage:       "How the mounts are persisted on the host across reboots, options are \"none\", \"fstab\" or \"systemd\"",
+			Destination: &opt.MountPersistence,
+		},
+		&cli.StringFlag{
+			Name:        "mount-persistence-path",
+			EnvVars:     []string{"NDM_MOUNT_PERSISTENCE_PATH"},
+			Usage:       "Path of the host fstab file, or the host directory of the systemd mount units, default to /etc/fstab or /etc/systemd/system",
+			Destination: &opt.MountPersistencePath,
+		},
 	}
 
 	app.Action = func(c *cli.Context) error {
@@ -137,8 +191,9 @@ func run(opt *option.Option) error {
 
 	ctx := signals.SetupSignalHandler(context.Background())
 
-	// register block device detector
-	block, err := block.New()
+	// register block device detector, the devices and mounts of the node are operated through the host
+	host := block.NewLinuxHost()
+	block, err := block.NewWithHost(host)
 	if err != nil {
 		return err
 	}
@@ -155,13 +210,23 @@ func run(opt *option.Option) error {
 
 	client := kubernetes.NewForConfigOrDie(kubeConfig)
 
-	leader.RunOrDie(ctx, "", "node-disk-manager", client, func(ctx context.Context) {
-		err = blockdevicev1.Register(ctx, lhs.Longhorn().V1beta1().BlockDevice(), block, opt)
+	filter, err := loadDeviceFilter(client, opt)
+	if err != nil {
+		return fmt.Errorf("failed to load device filter: %v", err)
+	}
+
+	udevMonitor, err := udev.NewUdev(host, block, lhs.Longhorn().V1beta1().BlockDevice(), filter, opt)
+	if err != nil {
+		return err
+	}
+
+	callback := func(ctx context.Context) {
+		err = blockdevicev1.Register(ctx, lhs.Longhorn().V1beta1().BlockDevice(), host, block, filter, opt)
 		if err != nil {
 			logrus.Fatalf("failed to register block device controller, %s", err.Error())
 		}
 
-		err = nodev1.Register(ctx, lhs.Longhorn().V1beta1().Node(), lhs.Longhorn().V1beta1().BlockDevice(), block, opt)
+		err = nodev1.Register(ctx, lhs.Longhorn().V1beta1().Node(), lhs.Longhorn().V1beta1().BlockDevice(), host, block, filter, opt)
 		if err != nil {
 			logrus.Fatalf("failed to register ndm node controller, %s", err.Error())
 		}
@@ -171,12 +236,33 @@ func run(opt *option.Option) error {
 		}
 
 		// register to monitor the UDEV events, similar to run `udevadm monitor -u`
-		go udev.NewUdev(block, lhs.Longhorn().V1beta1().BlockDevice(), opt).Monitor(ctx)
+		go udevMonitor.Monitor(ctx)
+	}
 
-		// TODO
-		// 1. add node actions, i.e. block device rescan
-	})
+	if opt.SkipLeaderElection {
+		go callback(ctx)
+	} else {
+		// the agent manages the disks of its own node, hence the lock is scoped by node
+		leader.RunOrDie(ctx, opt.Namespace, getLeaderLockName(opt.NodeName), client, callback)
+	}
 
 	<-ctx.Done()
 	return nil
 }
+
+func loadDeviceFilter(client kubernetes.Interface, opt *option.Option) (*filter.DeviceFilter, error) {
+	switch {
+	case opt.DeviceFilterFile != "" && opt.DeviceFilterConfigMap != "":
+		return nil, errors.New("only one of device filter file and configmap can be specified")
+	case opt.DeviceFilterFile != "":
+		return filter.LoadFromFile(opt.DeviceFilterFile)
+	case opt.DeviceFilterConfigMap != "":
+		return filter.LoadFromConfigMap(client, opt.Namespace, opt.DeviceFilterConfigMap)
+	default:
+		return filter.NewDefaultDeviceFilter(), nil
+	}
+}
+
+func getLeaderLockName(nodeName string) string {
+	return fmt.Sprintf("node-disk-manager-%s", nodeName)
+}
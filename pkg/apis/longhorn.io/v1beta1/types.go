@@ -4,17 +4,23 @@ import (
 	"github.com/longhorn/longhorn-manager/types"
 	"github.com/rancher/wrangler/pkg/condition"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 var (
-	DeviceMounted condition.Cond = "Mounted"
+	DeviceMounted       condition.Cond = "Mounted"
+	DeviceFormatted     condition.Cond = "Formatted"
+	LonghornDiskRemoved condition.Cond = "LonghornDiskRemoved"
+	DevicePartitioned   condition.Cond = "Partitioned"
 )
 
 // +genclient
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 // +kubebuilder:resource:shortName=bd,scope=Namespaced
+// +kubebuilder:subresource:status
 // +kubebuilder:printcolumn:name="NodeName",type="string",JSONPath=`.spec.nodeName`
+// +kubebuilder:printcolumn:name="DevPath",type="string",JSONPath=`.spec.devPath`
 // +kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.state`
 // +kubebuilder:printcolumn:name="Age",type="date",JSONPath=`.metadata.creationTimestamp`
 
@@ -22,7 +28,7 @@ type BlockDevice struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata"`
 	Spec              BlockDeviceSpec   `json:"spec"`
-	Status            BlockDeviceStatus `json:"status"`
+	Status            BlockDeviceStatus `json:"status,omitempty"`
 }
 
 type BlockDeviceSpec struct {
@@ -33,6 +39,15 @@ type BlockDeviceSpec struct {
 	DevPath string `json:"devPath"`
 
 	FileSystem FilesystemInfo `json:"fileSystem"`
+
+	// a object describe the Longhorn disk the device is registered as once it is mounted
+	// +optional
+	LonghornDisk LonghornDiskSpec `json:"longhornDisk,omitempty"`
+
+	// a object describe the GPT partition table to be created on the disk, only applicable to the disk type,
+	// the existing partitions are overwritten only if the device is force formatted
+	// +optional
+	PartitionTable *PartitionTableSpec `json:"partitionTable,omitempty"`
 }
 
 type BlockDeviceStatus struct {
@@ -53,6 +68,55 @@ type FilesystemInfo struct {
 
 	// a bool indicating the device is force formatted to overwrite the existing one
 	ForceFormatted bool `json:"forceFormatted,omitempty"`
+
+	// a string with the filesystem type the device is formatted and mounted with, options are "ext4", "xfs" or
+	// "btrfs". The detected filesystem is mounted if it is not specified, and ext4 is created on force formatting.
+	// +optional
+	// +kubebuilder:validation:Enum:=ext4;xfs;btrfs
+	Type string `json:"type,omitempty"`
+
+	// a list of the options the device is mounted with, e.g. "noatime", "discard", "nodev", "nosuid" or "prjquota",
+	// the device is remounted once the options are changed
+	// +optional
+	MountOptions []string `json:"mountOptions,omitempty"`
+
+	// a bool indicating the device is mounted read-only
+	// +optional
+	ReadOnly bool `json:"readOnly,omitempty"`
+}
+
+type LonghornDiskSpec struct {
+	// a bool indicating the replicas can be scheduled to the disk, default to true
+	// +optional
+	AllowScheduling *bool `json:"allowScheduling,omitempty"`
+
+	// the amount of storage in bytes reserved for other applications and not used by Longhorn
+	// +optional
+	StorageReserved int64 `json:"storageReserved,omitempty"`
+
+	// a list of tags used to select the disk for the replicas
+	// +optional
+	Tags []string `json:"tags,omitempty"`
+}
+
+type PartitionTableSpec struct {
+	// a list of the partitions created in order, a single partition spanning the whole disk is created if it's empty
+	// +optional
+	Partitions []PartitionSpec `json:"partitions,omitempty"`
+}
+
+type PartitionSpec struct {
+	// a string with the name of the partition stored in the partition table, up to 36 characters
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// the size of the partition, the last partition takes the rest of the disk if it's not specified
+	// +optional
+	Size *resource.Quantity `json:"size,omitempty"`
+
+	// a string with the partition type GUID, default to the Linux filesystem data "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+	// +optional
+	TypeGUID string `json:"typeGUID,omitempty"`
 }
 
 type DeviceStatus struct {
@@ -70,6 +134,47 @@ type DeviceStatus struct {
 	Details DeviceDetails `json:"details"`
 
 	FileSystem FilesystemStatus `json:"fileSystem"`
+
+	// a object describe the relationships between the device and the virtual devices, e.g. device-mapper, LVM,
+	// MD RAID and multipath devices
+	// +optional
+	Topology DeviceTopology `json:"topology,omitempty"`
+}
+
+type DeviceTopology struct {
+	// a list of the devices built on top of the device, e.g. the LVM logical volumes of a physical volume
+	// +optional
+	Holders []DeviceHolder `json:"holders,omitempty"`
+
+	// a list of the kernel names of the devices the virtual device is built on, e.g. the members of a RAID array
+	// +optional
+	Slaves []string `json:"slaves,omitempty"`
+
+	// a string represents the kind of the virtual device, options are "lvm", "crypt", "mpath", "dm",
+	// or the RAID level of a MD device, e.g. "raid1"
+	// +optional
+	VirtualKind string `json:"virtualKind,omitempty"`
+
+	// a string with the device-mapper name of the virtual device, e.g. "vg0-lv0"
+	// +optional
+	DMName string `json:"dmName,omitempty"`
+
+	// a string with the device-mapper UUID of the virtual device
+	// +optional
+	DMUUID string `json:"dmUUID,omitempty"`
+}
+
+type DeviceHolder struct {
+	// a string with the kernel name of the holder device, e.g. "dm-0"
+	Name string `json:"name"`
+
+	// a string with the device-mapper name of the holder device, e.g. "vg0-lv0"
+	// +optional
+	DMName string `json:"dmName,omitempty"`
+
+	// a string represents the kind of the holder device, the same options as the virtualKind
+	// +optional
+	Kind string `json:"kind,omitempty"`
 }
 
 type DeviceCapcity struct {
@@ -122,6 +227,18 @@ type DeviceDetails struct {
 	// the numeric index of the NUMA node this disk is local to, or -1
 	NUMANodeID int `json:"numaNodeID"`
 
+	// a string with the address of the PCI device the disk is attached to, e.g. "0000:3d:00.0"
+	// +optional
+	PCIAddress string `json:"pciAddress,omitempty"`
+
+	// the number of the lanes of the current PCIe link of the PCI device, or 0 if it's not a PCIe device
+	// +optional
+	PCIeLinkWidth int `json:"pcieLinkWidth,omitempty"`
+
+	// a string with the speed of the current PCIe link of the PCI device, e.g. "8.0 GT/s PCIe"
+	// +optional
+	PCIeLinkSpeed string `json:"pcieLinkSpeed,omitempty"`
+
 	// a string with the disk's World Wide Name(WWN)
 	WWN string `json:"wwn"`
 
@@ -139,6 +256,13 @@ type FilesystemStatus struct {
 	// a string with the partition's mount point, or "" if no mount point was discovered
 	MountPoint string `json:"mountPoint"`
 
+	// a list of the options the partition is currently mounted with
+	MountOptions []string `json:"mountOptions,omitempty"`
+
+	// the mount point the partition is mounted to as specified, only the applied mount point is released once the
+	// specified one is changed, the partition mounted outside of the CRD controller is left alone
+	AppliedMountPoint string `json:"appliedMountPoint,omitempty"`
+
 	// the last force formatted timestamp, only exist when user operate device formatting through the CRD controller
 	LastFormattedAt *metav1.Time `json:"LastFormattedAt,omitempty"`
 }
@@ -29,7 +29,7 @@ func (in *BlockDevice) DeepCopyInto(out *BlockDevice) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
+	in.Spec.DeepCopyInto(&out.Spec)
 	in.Status.DeepCopyInto(&out.Status)
 	return
 }
@@ -88,7 +88,13 @@ func (in *BlockDeviceList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *BlockDeviceSpec) DeepCopyInto(out *BlockDeviceSpec) {
 	*out = *in
-	out.FileSystem = in.FileSystem
+	in.FileSystem.DeepCopyInto(&out.FileSystem)
+	in.LonghornDisk.DeepCopyInto(&out.LonghornDisk)
+	if in.PartitionTable != nil {
+		in, out := &in.PartitionTable, &out.PartitionTable
+		*out = new(PartitionTableSpec)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -172,12 +178,29 @@ func (in *DeviceDetails) DeepCopy() *DeviceDetails {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeviceHolder) DeepCopyInto(out *DeviceHolder) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeviceHolder.
+func (in *DeviceHolder) DeepCopy() *DeviceHolder {
+	if in == nil {
+		return nil
+	}
+	out := new(DeviceHolder)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DeviceStatus) DeepCopyInto(out *DeviceStatus) {
 	*out = *in
 	out.Capacity = in.Capacity
 	out.Details = in.Details
 	in.FileSystem.DeepCopyInto(&out.FileSystem)
+	in.Topology.DeepCopyInto(&out.Topology)
 	return
 }
 
@@ -191,9 +214,40 @@ func (in *DeviceStatus) DeepCopy() *DeviceStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeviceTopology) DeepCopyInto(out *DeviceTopology) {
+	*out = *in
+	if in.Holders != nil {
+		in, out := &in.Holders, &out.Holders
+		*out = make([]DeviceHolder, len(*in))
+		copy(*out, *in)
+	}
+	if in.Slaves != nil {
+		in, out := &in.Slaves, &out.Slaves
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeviceTopology.
+func (in *DeviceTopology) DeepCopy() *DeviceTopology {
+	if in == nil {
+		return nil
+	}
+	out := new(DeviceTopology)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *FilesystemInfo) DeepCopyInto(out *FilesystemInfo) {
 	*out = *in
+	if in.MountOptions != nil {
+		in, out := &in.MountOptions, &out.MountOptions
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	return
 }
 
@@ -210,6 +264,11 @@ func (in *FilesystemInfo) DeepCopy() *FilesystemInfo {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *FilesystemStatus) DeepCopyInto(out *FilesystemStatus) {
 	*out = *in
+	if in.MountOptions != nil {
+		in, out := &in.MountOptions, &out.MountOptions
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 	if in.LastFormattedAt != nil {
 		in, out := &in.LastFormattedAt, &out.LastFormattedAt
 		*out = (*in).DeepCopy()
@@ -227,6 +286,32 @@ func (in *FilesystemStatus) DeepCopy() *FilesystemStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LonghornDiskSpec) DeepCopyInto(out *LonghornDiskSpec) {
+	*out = *in
+	if in.AllowScheduling != nil {
+		in, out := &in.AllowScheduling, &out.AllowScheduling
+		*out = new(bool)
+		**out = **in
+	}
+	if in.Tags != nil {
+		in, out := &in.Tags, &out.Tags
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LonghornDiskSpec.
+func (in *LonghornDiskSpec) DeepCopy() *LonghornDiskSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(LonghornDiskSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Node) DeepCopyInto(out *Node) {
 	*out = *in
@@ -287,3 +372,47 @@ func (in *NodeList) DeepCopyObject() runtime.Object {
 	}
 	return nil
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PartitionSpec) DeepCopyInto(out *PartitionSpec) {
+	*out = *in
+	if in.Size != nil {
+		in, out := &in.Size, &out.Size
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PartitionSpec.
+func (in *PartitionSpec) DeepCopy() *PartitionSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PartitionSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PartitionTableSpec) DeepCopyInto(out *PartitionTableSpec) {
+	*out = *in
+	if in.Partitions != nil {
+		in, out := &in.Partitions, &out.Partitions
+		*out = make([]PartitionSpec, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PartitionTableSpec.
+func (in *PartitionTableSpec) DeepCopy() *PartitionTableSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PartitionTableSpec)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -17,13 +17,18 @@ type Disk struct {
 	StorageController      block.StorageController `json:"storage_controller"`
 	UUID                   string                  `json:"uuid"`    // This would be volume UUID on macOS, UUID on linux, empty on Windows
 	PtUUID                 string                  `json:"pt_uuid"` // This would be volume PtUUID on macOS, PartUUID on linux, empty on Windows
+	Label                  string                  `json:"label"`
 	BusPath                string                  `json:"bus_path"`
 	FileSystemInfo         FileSystemInfo          `json:"file_system_info"`
 	NUMANodeID             int                     `json:"numa_node_id"`
+	PCIAddress             string                  `json:"pci_address"`
+	PCIeLinkWidth          int                     `json:"pcie_link_width"`
+	PCIeLinkSpeed          string                  `json:"pcie_link_speed"`
 	Vendor                 string                  `json:"vendor"`
 	Model                  string                  `json:"model"`
 	SerialNumber           string                  `json:"serial_number"`
 	WWN                    string                  `json:"wwn"`
+	Topology               Topology                `json:"topology"`
 	Partitions             []*Partition            `json:"partitions"`
 }
 
@@ -34,11 +39,14 @@ type Partition struct {
 	Label          string         `json:"label"`
 	SizeBytes      uint64         `json:"size_bytes"`
 	UUID           string         `json:"uuid"` // This would be volume UUID on macOS, PartUUID on linux, empty on Windows
+	FsUUID         string         `json:"fs_uuid"`
 	FileSystemInfo FileSystemInfo `json:"file_system_info"`
+	Topology       Topology       `json:"topology"`
 }
 
 type FileSystemInfo struct {
-	FsType     string `json:"fs_type"`
-	IsReadOnly bool   `json:"read_only"`
-	MountPoint string `json:"mount_point"`
+	FsType       string   `json:"fs_type"`
+	IsReadOnly   bool     `json:"read_only"`
+	MountPoint   string   `json:"mount_point"`
+	MountOptions []string `json:"mount_options"`
 }
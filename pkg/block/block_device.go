@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -16,22 +17,18 @@ import (
 	"github.com/jaypipes/ghw/pkg/util"
 )
 
-// borrowed from https://github.com/jaypipes/ghw/blob/master/pkg/block/block_linux.go
+// borrowed from https://github.com/jaypipes/ghw/blob/master/pkg/block/block_linux.go, the domain has more than 4
+// digits behind an Intel VMD controller, e.g. 10000:e1:00.0
+var pciAddressRegexp = regexp.MustCompile(`^[0-9a-f]{4,}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-7]$`)
+
 const (
 	sectorSize = 512
-
-	FsType = "TYPE"
-
-	PartUUID UUIDType = "PARTUUID"
-	PTUUID   UUIDType = "PTUUID"
-	UUID     UUIDType = "UUID"
 )
 
-type UUIDType string
-
 // Info describes all disk drives and partitions in the host system.
 type Info struct {
 	ctx        *context.Context
+	host       Host
 	Disks      []*Disk      `json:"disks"`
 	Partitions []*Partition `json:"-"`
 }
@@ -39,27 +36,64 @@ type Info struct {
 // New returns a pointer to an Info struct that describes the block storage
 // resources of the host system.
 func New(opts ...*option.Option) (*Info, error) {
+	return NewWithHost(NewLinuxHost(), opts...)
+}
+
+// NewWithHost returns the Info that describes the block storage resources, the signatures of the devices are
+// probed through the host
+func NewWithHost(host Host, opts ...*option.Option) (*Info, error) {
 	ctx := context.New(opts...)
-	info := &Info{ctx: ctx}
+	info := &Info{ctx: ctx, host: host}
 	if err := ctx.Do(info.load); err != nil {
 		return nil, err
 	}
 	return info, nil
 }
 
+// Rescan returns a new Info struct that describes the current block storage resources of the host system,
+// it uses the same options as the receiver
+func (i *Info) Rescan() (*Info, error) {
+	info := &Info{ctx: i.ctx, host: i.host}
+	if err := i.ctx.Do(info.load); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
 func (i *Info) load() error {
 	paths := linuxpath.New(i.ctx)
-	i.Disks = disks(i.ctx, paths)
+	i.Disks = disks(i.ctx, i.host, paths)
 	return nil
 }
 
 func (i *Info) GetDiskByName(name string) *Disk {
 	name = strings.TrimPrefix(name, "/dev/")
 	paths := linuxpath.New(i.ctx)
-	disk := getDisk(i.ctx, paths, name)
+	disk := getDisk(i.ctx, i.host, paths, name)
 	return disk
 }
 
+// GetParentDiskName returns the name of the disk that the partition belongs to, or "" if the device is not a partition
+func (i *Info) GetParentDiskName(part string) string {
+	part = strings.TrimPrefix(part, "/dev/")
+	paths := linuxpath.New(i.ctx)
+	matches, err := filepath.Glob(filepath.Join(paths.SysBlock, "*", part))
+	if err != nil || len(matches) == 0 {
+		return ""
+	}
+	return filepath.Base(filepath.Dir(matches[0]))
+}
+
+// IsDevicePresent returns true if the disk or partition is attached to the node
+func (i *Info) IsDevicePresent(name string) bool {
+	name = strings.TrimPrefix(name, "/dev/")
+	paths := linuxpath.New(i.ctx)
+	if _, err := os.Stat(filepath.Join(paths.SysBlock, name)); err == nil {
+		return true
+	}
+	return i.GetParentDiskName(name) != ""
+}
+
 func diskPhysicalBlockSizeBytes(paths *linuxpath.Paths, disk string) uint64 {
 	// We can find the sector size in Linux by looking at the
 	// /sys/block/$DEVICE/queue/physical_block_size file in sysfs
@@ -90,19 +124,52 @@ func diskSizeBytes(paths *linuxpath.Paths, disk string) uint64 {
 	return size * sectorSize
 }
 
+// diskNUMANodeID returns the NUMA node the disk is local to, which is the numa_node of the nearest ancestor device in
+// sysfs that reports it, usually the PCI device of the storage controller, or -1 if it's unknown
 func diskNUMANodeID(paths *linuxpath.Paths, disk string) int {
+	for _, dir := range diskDeviceAncestors(paths, disk) {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, "numa_node"))
+		if err != nil {
+			continue
+		}
+		if nodeInt, err := strconv.Atoi(strings.TrimSpace(string(contents))); err == nil && nodeInt >= 0 {
+			return nodeInt
+		}
+	}
+	return -1
+}
+
+// diskPCIDevice returns the PCI address and the current PCIe link width and speed of the PCI device the disk is
+// attached to, the link is only reported by the PCIe devices
+func diskPCIDevice(paths *linuxpath.Paths, disk string) (string, int, string) {
+	for _, dir := range diskDeviceAncestors(paths, disk) {
+		address := filepath.Base(dir)
+		if !pciAddressRegexp.MatchString(address) {
+			continue
+		}
+		width, _ := strconv.Atoi(readSysAttr(filepath.Join(dir, "current_link_width")))
+		return address, width, readSysAttr(filepath.Join(dir, "current_link_speed"))
+	}
+	return "", 0, ""
+}
+
+// diskDeviceAncestors returns the sysfs directories of the disk device and its ancestors from the nearest one, e.g.
+// /sys/block/nvme0n1 links to ../devices/pci0000:00/0000:00:1d.0/0000:3d:00.0/nvme/nvme0/nvme0n1
+func diskDeviceAncestors(paths *linuxpath.Paths, disk string) []string {
 	link, err := os.Readlink(filepath.Join(paths.SysBlock, disk))
 	if err != nil {
-		return -1
+		return nil
 	}
-	for partial := link; strings.HasPrefix(partial, "../devices/"); partial = filepath.Base(partial) {
-		if nodeContents, err := ioutil.ReadFile(filepath.Join(paths.SysBlock, partial, "numa_node")); err != nil {
-			if nodeInt, err := strconv.Atoi(string(nodeContents)); err != nil {
-				return nodeInt
-			}
-		}
+	if !filepath.IsAbs(link) {
+		link = filepath.Join(paths.SysBlock, link)
 	}
-	return -1
+	devicesRoot := filepath.Join(filepath.Dir(paths.SysBlock), "devices")
+
+	dirs := make([]string, 0)
+	for dir := filepath.Clean(link); strings.HasPrefix(dir, devicesRoot+"/"); dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	return dirs
 }
 
 func diskVendor(paths *linuxpath.Paths, disk string) string {
@@ -205,7 +272,7 @@ func diskWWN(paths *linuxpath.Paths, disk string) string {
 // but just the name. In other words, "sda", not "/dev/sda" and "nvme0n1" not
 // "/dev/nvme0n1") and returns a slice of pointers to Partition structs
 // representing the partitions in that disk
-func diskPartitions(ctx *context.Context, paths *linuxpath.Paths, disk string) []*Partition {
+func diskPartitions(ctx *context.Context, host Host, paths *linuxpath.Paths, disk string, table *ProbeResult) []*Partition {
 	out := make([]*Partition, 0)
 	path := filepath.Join(paths.SysBlock, disk)
 	files, err := ioutil.ReadDir(path)
@@ -219,23 +286,38 @@ func diskPartitions(ctx *context.Context, paths *linuxpath.Paths, disk string) [
 			continue
 		}
 		size := partitionSizeBytes(paths, disk, fname)
-		mp, pt, ro := partitionInfo(paths, fname)
-		du := GetDiskUUID(fname, string(PartUUID))
+		fs := partitionInfo(paths, fname)
+		probe := probeDevice(ctx, host, fname)
+		if fs.FsType == "" {
+			fs.FsType = probe.Type
+		}
+		number, _ := strconv.Atoi(readSysAttr(filepath.Join(path, fname, "partition")))
 		p := &Partition{
-			Name:      fname,
-			SizeBytes: size,
-			FileSystemInfo: FileSystemInfo{
-				MountPoint: mp,
-				FsType:     pt,
-				IsReadOnly: ro,
-			},
-			UUID: du,
+			Name:           fname,
+			Label:          probe.Label,
+			SizeBytes:      size,
+			FileSystemInfo: fs,
+			UUID:           table.PartUUID(number),
+			FsUUID:         probe.UUID,
+			Topology:       deviceTopology(paths, filepath.Join(path, fname)),
 		}
 		out = append(out, p)
 	}
 	return out
 }
 
+// probeDevice reads the filesystem and partition table signatures of the disk or partition, the signatures are
+// considered missing if the device can't be read. The device node is looked up under the chroot as well, so the
+// recorded trees can carry the images of the devices.
+func probeDevice(ctx *context.Context, host Host, name string) *ProbeResult {
+	result, err := host.Probe(filepath.Join("/", ctx.Chroot, "dev", name))
+	if err != nil {
+		ctx.Warn("failed to probe the signatures of %s: %s\n", name, err)
+		return &ProbeResult{}
+	}
+	return result
+}
+
 func diskIsRemovable(paths *linuxpath.Paths, disk string) bool {
 	path := filepath.Join(paths.SysBlock, disk, "removable")
 	contents, err := ioutil.ReadFile(path)
@@ -249,7 +331,7 @@ func diskIsRemovable(paths *linuxpath.Paths, disk string) bool {
 	return false
 }
 
-func getDisk(ctx *context.Context, paths *linuxpath.Paths, dname string) *Disk {
+func getDisk(ctx *context.Context, host Host, paths *linuxpath.Paths, dname string) *Disk {
 	driveType, storageController := diskTypes(dname)
 	// TODO(jaypipes): Move this into diskTypes() once abstracting
 	// diskIsRotational for ease of unit testing
@@ -260,22 +342,17 @@ func getDisk(ctx *context.Context, paths *linuxpath.Paths, dname string) *Disk {
 	pbs := diskPhysicalBlockSizeBytes(paths, dname)
 	busPath := diskBusPath(paths, dname)
 	node := diskNUMANodeID(paths, dname)
+	pciAddress, linkWidth, linkSpeed := diskPCIDevice(paths, dname)
 	vendor := diskVendor(paths, dname)
 	model := diskModel(paths, dname)
 	serialNo := diskSerialNumber(paths, dname)
 	wwn := diskWWN(paths, dname)
 	removable := diskIsRemovable(paths, dname)
-	uuid := GetDiskUUID(dname, string(UUID))
-	ptuuid := GetDiskUUID(dname, string(PTUUID))
-	mp, pt, ro := partitionInfo(paths, dname)
-	fs := FileSystemInfo{
-		MountPoint: mp,
-		FsType:     pt,
-		IsReadOnly: ro,
-	}
+	probe := probeDevice(ctx, host, dname)
+	fs := partitionInfo(paths, dname)
 
 	if fs.FsType == "" {
-		fs.FsType = GetFileSystemType(dname)
+		fs.FsType = probe.Type
 	}
 
 	d := &Disk{
@@ -285,18 +362,23 @@ func getDisk(ctx *context.Context, paths *linuxpath.Paths, dname string) *Disk {
 		DriveType:              driveType,
 		IsRemovable:            removable,
 		StorageController:      storageController,
-		UUID:                   uuid,
-		PtUUID:                 ptuuid,
+		UUID:                   probe.UUID,
+		PtUUID:                 probe.PTUUID,
+		Label:                  probe.Label,
 		BusPath:                busPath,
 		NUMANodeID:             node,
+		PCIAddress:             pciAddress,
+		PCIeLinkWidth:          linkWidth,
+		PCIeLinkSpeed:          linkSpeed,
 		Vendor:                 vendor,
 		Model:                  model,
 		SerialNumber:           serialNo,
 		WWN:                    wwn,
 		FileSystemInfo:         fs,
+		Topology:               deviceTopology(paths, filepath.Join(paths.SysBlock, dname)),
 	}
 
-	parts := diskPartitions(ctx, paths, dname)
+	parts := diskPartitions(ctx, host, paths, dname, probe)
 	// Map this Disk object into the Partition...
 	for _, part := range parts {
 		part.Disk = d
@@ -306,7 +388,7 @@ func getDisk(ctx *context.Context, paths *linuxpath.Paths, dname string) *Disk {
 	return d
 }
 
-func disks(ctx *context.Context, paths *linuxpath.Paths) []*Disk {
+func disks(ctx *context.Context, host Host, paths *linuxpath.Paths) []*Disk {
 	// In Linux, we could use the fdisk, lshw or blockdev commands to list disk
 	// information, however all of these utilities require root privileges to
 	// run. We can get all of this information by examining the /sys/block
@@ -322,7 +404,7 @@ func disks(ctx *context.Context, paths *linuxpath.Paths) []*Disk {
 			continue
 		}
 
-		d := getDisk(ctx, paths, dname)
+		d := getDisk(ctx, host, paths, dname)
 		disks = append(disks, d)
 	}
 
@@ -388,8 +470,8 @@ func partitionSizeBytes(paths *linuxpath.Paths, disk string, part string) uint64
 }
 
 // Given a full or short partition name, returns the mount point, the type of
-// the partition and whether it's readonly
-func partitionInfo(paths *linuxpath.Paths, part string) (string, string, bool) {
+// the partition, whether it's readonly and the options it's mounted with
+func partitionInfo(paths *linuxpath.Paths, part string) FileSystemInfo {
 	// Allow calling PartitionInfo with either the full partition name
 	// "/dev/sda1" or just "sda1"
 	if !strings.HasPrefix(part, "/dev") {
@@ -401,7 +483,7 @@ func partitionInfo(paths *linuxpath.Paths, part string) (string, string, bool) {
 	var r io.ReadCloser
 	r, err := os.Open(paths.ProcMounts)
 	if err != nil {
-		return "", "", true
+		return FileSystemInfo{IsReadOnly: true}
 	}
 	defer util.SafeClose(r)
 
@@ -420,9 +502,14 @@ func partitionInfo(paths *linuxpath.Paths, part string) (string, string, bool) {
 			}
 		}
 
-		return entry.Mountpoint, entry.FilesystemType, ro
+		return FileSystemInfo{
+			MountPoint:   entry.Mountpoint,
+			FsType:       entry.FilesystemType,
+			IsReadOnly:   ro,
+			MountOptions: entry.Options,
+		}
 	}
-	return "", "", true
+	return FileSystemInfo{IsReadOnly: true}
 }
 
 type mountEntry struct {
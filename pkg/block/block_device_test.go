@@ -0,0 +1,368 @@
+package block
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jaypipes/ghw/pkg/block"
+	"github.com/jaypipes/ghw/pkg/option"
+	"github.com/jaypipes/ghw/pkg/util"
+)
+
+// newFixtureInfo discovers the block devices of the recorded sysfs, udev and procfs tree in the ghw snapshot of
+// testdata, the snapshot is unpacked once into a temporary directory which lives as long as the test
+func newFixtureInfo(t *testing.T, snapshot string) *Info {
+	t.Helper()
+	root := t.TempDir()
+	info, err := New(option.WithSnapshot(option.SnapshotOptions{
+		Path:      filepath.Join("testdata", snapshot),
+		Root:      &root,
+		Exclusive: true,
+	}), option.WithNullAlerter())
+	if err != nil {
+		t.Fatalf("failed to load the snapshot %s, error: %s", snapshot, err.Error())
+	}
+	return info
+}
+
+func dump(disk *Disk) string {
+	out, _ := json.Marshal(disk)
+	return string(out)
+}
+
+// noTopology is the topology of a device without holders or slaves
+func noTopology() Topology {
+	return Topology{Holders: []Holder{}, Slaves: []string{}}
+}
+
+// notMounted is the filesystem info of a device that isn't listed in the mounts
+func notMounted(fsType string) FileSystemInfo {
+	return FileSystemInfo{FsType: fsType, IsReadOnly: true}
+}
+
+func TestDisks(t *testing.T) {
+	tests := []struct {
+		snapshot string
+		expected []*Disk
+	}{
+		{
+			snapshot: "nvme.tar.gz",
+			expected: []*Disk{
+				{
+					Name:                   "nvme0n1",
+					SizeBytes:              2000398934016,
+					PhysicalBlockSizeBytes: 512,
+					DriveType:              block.DRIVE_TYPE_SSD,
+					StorageController:      block.STORAGE_CONTROLLER_NVME,
+					PtUUID:                 "6a3a2a1e-4f3b-4c1d-9e2f-0a1b2c3d4e5f",
+					BusPath:                "pci-0000:3b:00.0-nvme-1",
+					FileSystemInfo:         notMounted(""),
+					NUMANodeID:             1,
+					PCIAddress:             "0000:3b:00.0",
+					PCIeLinkWidth:          4,
+					PCIeLinkSpeed:          "8.0 GT/s PCIe",
+					Vendor:                 util.UNKNOWN,
+					Model:                  "Samsung SSD 970 EVO Plus 2TB",
+					SerialNumber:           "S4J4NX0N123456",
+					WWN:                    "eui.0025385b71b12345",
+					Topology:               noTopology(),
+					Partitions: []*Partition{
+						{
+							Name:      "nvme0n1p1",
+							SizeBytes: 1073741824,
+							UUID:      "8e9d7c6b-5a4f-4e3d-8c2b-1a0f9e8d7c6b",
+							FileSystemInfo: FileSystemInfo{
+								FsType:       "ext4",
+								MountPoint:   "/var/lib/longhorn",
+								MountOptions: []string{"rw", "noatime"},
+							},
+							Topology: noTopology(),
+						},
+						{
+							Name:           "nvme0n1p2",
+							Label:          "data",
+							SizeBytes:      1999324053504,
+							UUID:           "f1e2d3c4-b5a6-4978-8a9b-0c1d2e3f4a5b",
+							FsUUID:         "0c6d0f2a-7d2c-4f5e-9a1b-3c4d5e6f7a8b",
+							FileSystemInfo: notMounted("ext4"),
+							Topology:       noTopology(),
+						},
+					},
+				},
+			},
+		},
+		{
+			snapshot: "virtio.tar.gz",
+			expected: []*Disk{
+				{
+					Name:                   "vda",
+					SizeBytes:              21474836480,
+					PhysicalBlockSizeBytes: 512,
+					DriveType:              block.DRIVE_TYPE_HDD,
+					StorageController:      block.STORAGE_CONTROLLER_VIRTIO,
+					BusPath:                "pci-0000:00:04.0",
+					FileSystemInfo:         notMounted(""),
+					NUMANodeID:             -1,
+					PCIAddress:             "0000:00:04.0",
+					Vendor:                 "0x1af4",
+					Model:                  util.UNKNOWN,
+					SerialNumber:           "root-disk",
+					WWN:                    util.UNKNOWN,
+					Topology:               noTopology(),
+					Partitions: []*Partition{
+						{
+							Name:      "vda1",
+							SizeBytes: 21473787904,
+							FileSystemInfo: FileSystemInfo{
+								FsType:       "ext4",
+								MountPoint:   "/",
+								MountOptions: []string{"rw", "relatime", "errors=remount-ro"},
+							},
+							Topology: noTopology(),
+						},
+					},
+				},
+				{
+					Name:                   "vdb",
+					SizeBytes:              107374182400,
+					PhysicalBlockSizeBytes: 512,
+					DriveType:              block.DRIVE_TYPE_HDD,
+					StorageController:      block.STORAGE_CONTROLLER_VIRTIO,
+					UUID:                   "5b7e3c1d-2a4f-4b6e-8d9c-1e2f3a4b5c6d",
+					Label:                  "longhorn",
+					BusPath:                "pci-0000:00:05.0",
+					FileSystemInfo:         notMounted("xfs"),
+					NUMANodeID:             -1,
+					PCIAddress:             "0000:00:05.0",
+					Vendor:                 "0x1af4",
+					Model:                  util.UNKNOWN,
+					SerialNumber:           "data-disk",
+					WWN:                    util.UNKNOWN,
+					Topology:               noTopology(),
+					Partitions:             []*Partition{},
+				},
+			},
+		},
+		{
+			snapshot: "sata.tar.gz",
+			expected: []*Disk{
+				{
+					Name:                   "sda",
+					SizeBytes:              2000398934016,
+					PhysicalBlockSizeBytes: 4096,
+					DriveType:              block.DRIVE_TYPE_HDD,
+					StorageController:      block.STORAGE_CONTROLLER_SCSI,
+					PtUUID:                 "8f3c2a51",
+					BusPath:                "pci-0000:00:17.0-ata-1",
+					FileSystemInfo:         notMounted(""),
+					NUMANodeID:             0,
+					PCIAddress:             "0000:00:17.0",
+					Vendor:                 "ATA",
+					Model:                  "WDC_WD20EFRX-68EUZN0",
+					SerialNumber:           "WD-WCC7K1234567",
+					WWN:                    "0x50014ee2b1234567",
+					Topology:               noTopology(),
+					Partitions: []*Partition{
+						{
+							Name:           "sda1",
+							Label:          "swap",
+							SizeBytes:      8589934592,
+							UUID:           "8f3c2a51-01",
+							FsUUID:         "3f1e2d4c-5b6a-4789-9a0b-1c2d3e4f5a6b",
+							FileSystemInfo: notMounted("swap"),
+							Topology:       noTopology(),
+						},
+						{
+							Name:      "sda2",
+							SizeBytes: 1991807950848,
+							UUID:      "8f3c2a51-02",
+							FileSystemInfo: FileSystemInfo{
+								FsType:       "ext4",
+								IsReadOnly:   true,
+								MountPoint:   "/mnt/archive",
+								MountOptions: []string{"ro", "relatime"},
+							},
+							Topology: noTopology(),
+						},
+					},
+				},
+			},
+		},
+		{
+			// the NVMe SSD behind an Intel VMD controller is on the 5-digit PCI domain of the VMD
+			snapshot: "vmd.tar.gz",
+			expected: []*Disk{
+				{
+					Name:                   "nvme0n1",
+					SizeBytes:              3840755982336,
+					PhysicalBlockSizeBytes: 512,
+					DriveType:              block.DRIVE_TYPE_SSD,
+					StorageController:      block.STORAGE_CONTROLLER_NVME,
+					BusPath:                "pci-10000:e1:00.0-nvme-1",
+					FileSystemInfo:         notMounted(""),
+					NUMANodeID:             0,
+					PCIAddress:             "10000:e1:00.0",
+					PCIeLinkWidth:          4,
+					PCIeLinkSpeed:          "16.0 GT/s PCIe",
+					Vendor:                 util.UNKNOWN,
+					Model:                  "INTEL SSDPF2KX038TZ",
+					SerialNumber:           "PHAC1234005D3P8AGN",
+					WWN:                    "eui.01000000000000005cd2e4a1b2c3d4e5",
+					Topology:               noTopology(),
+					Partitions:             []*Partition{},
+				},
+			},
+		},
+		{
+			snapshot: "multipath.tar.gz",
+			expected: []*Disk{
+				{
+					Name:                   "dm-0",
+					SizeBytes:              1099511627776,
+					PhysicalBlockSizeBytes: 512,
+					DriveType:              block.DRIVE_TYPE_SSD,
+					StorageController:      block.STORAGE_CONTROLLER_UNKNOWN,
+					BusPath:                util.UNKNOWN,
+					FileSystemInfo:         notMounted(""),
+					NUMANodeID:             -1,
+					Vendor:                 util.UNKNOWN,
+					Model:                  util.UNKNOWN,
+					SerialNumber:           util.UNKNOWN,
+					WWN:                    util.UNKNOWN,
+					Topology: Topology{
+						Holders: []Holder{},
+						Slaves:  []string{"sdb", "sdc"},
+						Kind:    VirtualKindMpath,
+						DMName:  "mpatha",
+						DMUUID:  "mpath-3600a098038303053453f463045727a6b",
+					},
+					Partitions: []*Partition{},
+				},
+				multipathPath("sdb", "pci-0000:81:00.0-fc-0x20000025b5aa0000-lun-1"),
+				multipathPath("sdc", "pci-0000:81:00.0-fc-0x20000025b5aa0001-lun-1"),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.snapshot, func(t *testing.T) {
+			info := newFixtureInfo(t, test.snapshot)
+			if len(info.Disks) != len(test.expected) {
+				t.Fatalf("expected %d disks, got %d", len(test.expected), len(info.Disks))
+			}
+			for i, disk := range info.Disks {
+				for _, part := range disk.Partitions {
+					if part.Disk != disk {
+						t.Errorf("partition %s doesn't refer to the disk %s", part.Name, disk.Name)
+					}
+					part.Disk = nil
+				}
+				if !reflect.DeepEqual(disk, test.expected[i]) {
+					t.Errorf("unexpected disk %s\nexpected: %s\ngot:      %s", disk.Name, dump(test.expected[i]),
+						dump(disk))
+				}
+			}
+		})
+	}
+}
+
+// multipathPath is a path of the multipath LUN in the multipath snapshot
+func multipathPath(name, busPath string) *Disk {
+	return &Disk{
+		Name:                   name,
+		SizeBytes:              1099511627776,
+		PhysicalBlockSizeBytes: 512,
+		DriveType:              block.DRIVE_TYPE_SSD,
+		StorageController:      block.STORAGE_CONTROLLER_SCSI,
+		BusPath:                busPath,
+		FileSystemInfo:         notMounted(""),
+		NUMANodeID:             1,
+		PCIAddress:             "0000:81:00.0",
+		PCIeLinkWidth:          8,
+		PCIeLinkSpeed:          "8.0 GT/s PCIe",
+		Vendor:                 "NETAPP",
+		Model:                  "LUN_C-Mode",
+		SerialNumber:           "3600a098038303053453f463045727a6b",
+		WWN:                    "0x600a098038303053453f463045727a6b",
+		Topology: Topology{
+			Holders: []Holder{{Name: "dm-0", DMName: "mpatha", Kind: VirtualKindMpath}},
+			Slaves:  []string{},
+		},
+		Partitions: []*Partition{},
+	}
+}
+
+func TestGetDiskByName(t *testing.T) {
+	tests := []struct {
+		snapshot string
+		name     string
+		fsType   string
+		uuid     string
+		mount    string
+	}{
+		{snapshot: "nvme.tar.gz", name: "/dev/nvme0n1p1", fsType: "ext4", mount: "/var/lib/longhorn"},
+		{snapshot: "nvme.tar.gz", name: "/dev/nvme0n1p2", fsType: "ext4", uuid: "0c6d0f2a-7d2c-4f5e-9a1b-3c4d5e6f7a8b"},
+		{snapshot: "virtio.tar.gz", name: "vdb", fsType: "xfs", uuid: "5b7e3c1d-2a4f-4b6e-8d9c-1e2f3a4b5c6d"},
+		{snapshot: "sata.tar.gz", name: "/dev/sda1", fsType: "swap", uuid: "3f1e2d4c-5b6a-4789-9a0b-1c2d3e4f5a6b"},
+		{snapshot: "multipath.tar.gz", name: "/dev/dm-0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.snapshot+"/"+filepath.Base(test.name), func(t *testing.T) {
+			disk := newFixtureInfo(t, test.snapshot).GetDiskByName(test.name)
+			if disk.FileSystemInfo.FsType != test.fsType {
+				t.Errorf("expected filesystem %q, got %q", test.fsType, disk.FileSystemInfo.FsType)
+			}
+			if disk.UUID != test.uuid {
+				t.Errorf("expected UUID %q, got %q", test.uuid, disk.UUID)
+			}
+			if disk.FileSystemInfo.MountPoint != test.mount {
+				t.Errorf("expected mount point %q, got %q", test.mount, disk.FileSystemInfo.MountPoint)
+			}
+		})
+	}
+}
+
+func TestGetParentDiskName(t *testing.T) {
+	info := newFixtureInfo(t, "nvme.tar.gz")
+	tests := map[string]string{
+		"/dev/nvme0n1p1": "nvme0n1",
+		"nvme0n1p2":      "nvme0n1",
+		"/dev/nvme0n1":   "",
+		"/dev/nvme0n1p3": "",
+	}
+	for name, expected := range tests {
+		if parent := info.GetParentDiskName(name); parent != expected {
+			t.Errorf("expected the parent disk of %s to be %q, got %q", name, expected, parent)
+		}
+	}
+}
+
+func TestIsDevicePresent(t *testing.T) {
+	info := newFixtureInfo(t, "sata.tar.gz")
+	tests := map[string]bool{
+		"/dev/sda":  true,
+		"/dev/sda2": true,
+		"sda1":      true,
+		"/dev/sda3": false,
+		"/dev/sdb":  false,
+	}
+	for name, expected := range tests {
+		if present := info.IsDevicePresent(name); present != expected {
+			t.Errorf("expected the presence of %s to be %t, got %t", name, expected, present)
+		}
+	}
+}
+
+func TestRescan(t *testing.T) {
+	info := newFixtureInfo(t, "virtio.tar.gz")
+	rescanned, err := info.Rescan()
+	if err != nil {
+		t.Fatalf("failed to rescan, error: %s", err.Error())
+	}
+	if len(rescanned.Disks) != len(info.Disks) {
+		t.Errorf("expected %d disks after rescanning, got %d", len(info.Disks), len(rescanned.Disks))
+	}
+}
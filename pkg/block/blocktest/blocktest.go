@@ -0,0 +1,105 @@
+// Package blocktest loads the recorded snapshots of pkg/block/testdata for the tests of the packages using block.Info,
+// and fakes the block.Host of the snapshots
+package blocktest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jaypipes/ghw/pkg/option"
+
+	"github.com/longhorn/node-disk-manager/pkg/block"
+)
+
+// Host is the node of a recorded snapshot, the snapshot is unpacked into a temporary directory which is modified by
+// the tests to simulate the changes of the devices, e.g. a disk is unplugged or a partition is deleted.
+//
+// Host is an in-memory block.Host of the snapshot as well. The mounts are written to the mount tables of the
+// snapshot, so they are discovered by the Info as the mounts of the kernel, the filesystems created or wiped are
+// reported by Probe, and the mount points are created in the snapshot. The calls are recorded, and they can be made
+// to fail to simulate the failures of the node.
+type Host struct {
+	Root string
+	Info *block.Info
+
+	lock            sync.Mutex
+	calls           []string
+	failures        map[string]error
+	uuids           int
+	filesystems     map[string]*block.ProbeResult
+	partitionTables map[string][]block.GPTPartition
+}
+
+// NewHost unpacks the snapshot of pkg/block/testdata, e.g. "nvme.tar.gz", into a temporary directory which lives as
+// long as the test, and discovers its block devices through the host
+func NewHost(t *testing.T, snapshot string) *Host {
+	t.Helper()
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Fatalf("failed to locate the testdata of snapshot %s", snapshot)
+	}
+
+	h := &Host{
+		Root:            t.TempDir(),
+		failures:        make(map[string]error),
+		filesystems:     make(map[string]*block.ProbeResult),
+		partitionTables: make(map[string][]block.GPTPartition),
+	}
+	info, err := block.NewWithHost(h, option.WithSnapshot(option.SnapshotOptions{
+		Path:      filepath.Join(filepath.Dir(file), "..", "testdata", snapshot),
+		Root:      &h.Root,
+		Exclusive: true,
+	}), option.WithNullAlerter())
+	if err != nil {
+		t.Fatalf("failed to load the snapshot %s, error: %s", snapshot, err.Error())
+	}
+	h.Info = info
+
+	// the filesystems of the mounted devices without images are known from the mounts, so they are still probed
+	// after unmounting
+	mounts, err := h.readMounts()
+	if err != nil {
+		t.Fatalf("failed to read the mounts of snapshot %s, error: %s", snapshot, err.Error())
+	}
+	for _, mount := range mounts {
+		if !strings.HasPrefix(mount.source, "/dev/") {
+			continue
+		}
+		name := filepath.Base(mount.source)
+		if _, err := os.Stat(h.path(filepath.Join("dev", name))); os.IsNotExist(err) {
+			h.filesystems[name] = &block.ProbeResult{Type: mount.fsType}
+		}
+	}
+	return h
+}
+
+// RemoveDevice removes the disk or partition from the sysfs tree, as the disk is unplugged or the partition is
+// deleted from the partition table
+func (h *Host) RemoveDevice(t *testing.T, name string) {
+	t.Helper()
+	sysBlock := filepath.Join(h.Root, "sys", "block")
+	path := filepath.Join(sysBlock, name)
+	if _, err := os.Lstat(path); err != nil {
+		parent := h.Info.GetParentDiskName(name)
+		if parent == "" {
+			t.Fatalf("device %s is not found in the snapshot", name)
+		}
+		path = filepath.Join(sysBlock, parent, name)
+	}
+	if err := os.RemoveAll(path); err != nil {
+		t.Fatalf("failed to remove device %s, error: %s", name, err.Error())
+	}
+}
+
+// WriteFile replaces the file of the snapshot, the path is relative to the root, e.g. "proc/self/mounts"
+func (h *Host) WriteFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(h.Root, path), []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write %s, error: %s", path, err.Error())
+	}
+}
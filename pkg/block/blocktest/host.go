@@ -0,0 +1,460 @@
+package blocktest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/longhorn/node-disk-manager/pkg/block"
+)
+
+var _ block.Host = &Host{}
+
+// mountEntry is a mount of the mount tables of the snapshot
+type mountEntry struct {
+	number     string
+	source     string
+	mountPoint string
+	fsType     string
+	options    string
+}
+
+// Fail makes the calls of the method of block.Host, e.g. "Unmount", fail with the error, nil stops failing
+func (h *Host) Fail(method string, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err == nil {
+		delete(h.failures, method)
+		return
+	}
+	h.failures[method] = err
+}
+
+// Calls returns the calls of the methods of block.Host in order, e.g. "Mount /dev/sdb /var/lib/longhorn xfs"
+func (h *Host) Calls() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]string(nil), h.calls...)
+}
+
+// call records the call and returns the failure of the method, the caller must hold the lock
+func (h *Host) call(method string, args ...string) error {
+	h.calls = append(h.calls, strings.TrimSpace(method+" "+strings.Join(args, " ")))
+	return h.failures[method]
+}
+
+func (h *Host) Mount(device, path, fsType string, options []string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err := h.call("Mount", device, path, fsType); err != nil {
+		return err
+	}
+
+	number, err := h.deviceNumber(device)
+	if err != nil {
+		return os.NewSyscallError("mount", syscall.ENOENT)
+	}
+	if _, err := os.Stat(h.path(path)); err != nil {
+		return os.NewSyscallError("mount", syscall.ENOENT)
+	}
+	if probe := h.probe(device); probe.Type != fsType || !block.IsSupportedFileSystem(fsType) {
+		return os.NewSyscallError("mount", syscall.EINVAL)
+	}
+
+	mounts, err := h.readMounts()
+	if err != nil {
+		return err
+	}
+	for _, mount := range mounts {
+		if mount.mountPoint == path {
+			return os.NewSyscallError("mount", syscall.EBUSY)
+		}
+	}
+	mounts = append(mounts, mountEntry{
+		number:     number,
+		source:     device,
+		mountPoint: path,
+		fsType:     fsType,
+		options:    kernelMountOptions(options),
+	})
+	return h.writeMounts(mounts)
+}
+
+func (h *Host) Remount(device, path, fsType string, options []string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err := h.call("Remount", device, path, fsType); err != nil {
+		return err
+	}
+
+	return h.updateMount("mount", path, func(mount *mountEntry) error {
+		mount.options = kernelMountOptions(options)
+		return nil
+	})
+}
+
+func (h *Host) Unmount(path string, opts block.UnmountOptions) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err := h.call("Unmount", path); err != nil {
+		return err
+	}
+
+	mounts, err := h.readMounts()
+	if err != nil {
+		return err
+	}
+	for i, mount := range mounts {
+		if mount.mountPoint == path {
+			return h.writeMounts(append(mounts[:i], mounts[i+1:]...))
+		}
+	}
+	return os.NewSyscallError("umount", syscall.EINVAL)
+}
+
+func (h *Host) MoveMount(source, target string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err := h.call("MoveMount", source, target); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(h.path(target)); err != nil {
+		return os.NewSyscallError("mount", syscall.ENOENT)
+	}
+	return h.updateMount("mount", source, func(mount *mountEntry) error {
+		mount.mountPoint = target
+		return nil
+	})
+}
+
+// MakeFilesystem records the filesystem of the device, which is reported by Probe
+func (h *Host) MakeFilesystem(device, fsType string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err := h.call("MakeFilesystem", device, fsType); err != nil {
+		return err
+	}
+
+	if !block.IsSupportedFileSystem(fsType) {
+		return fmt.Errorf("unsupported filesystem type %s", fsType)
+	}
+	if err := h.checkNotMounted(device); err != nil {
+		return err
+	}
+	h.uuids++
+	h.filesystems[filepath.Base(device)] = &block.ProbeResult{
+		Type: fsType,
+		UUID: fmt.Sprintf("00000000-0000-4000-8000-%012x", h.uuids),
+	}
+	return nil
+}
+
+// WipeFilesystem records that the device has no signatures
+func (h *Host) WipeFilesystem(device string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err := h.call("WipeFilesystem", device); err != nil {
+		return err
+	}
+
+	if err := h.checkNotMounted(device); err != nil {
+		return err
+	}
+	h.filesystems[filepath.Base(device)] = &block.ProbeResult{}
+	delete(h.partitionTables, filepath.Base(device))
+	return nil
+}
+
+// Probe reports the filesystem created by MakeFilesystem, or probes the image of the device in the snapshot
+func (h *Host) Probe(device string) (*block.ProbeResult, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.probe(device), nil
+}
+
+// WritePartitionTable writes the GPT partition table to the image of the disk, which is extended to the size of the
+// disk, and replaces the partitions of the disk in the sysfs tree as the kernel re-reads the partition table
+func (h *Host) WritePartitionTable(device, diskGUID string, partitions []block.GPTPartition) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err := h.call("WritePartitionTable", device); err != nil {
+		return err
+	}
+
+	number, err := h.deviceNumber(device)
+	if err != nil {
+		return err
+	}
+	// the disk is opened exclusively, which fails if the disk or any of its partitions is mounted
+	mounts, err := h.readMounts()
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(device)
+	for _, mount := range mounts {
+		if mount.source == device || h.parentDiskName(filepath.Base(mount.source)) == name {
+			return &os.PathError{Op: "open", Path: device, Err: syscall.EBUSY}
+		}
+	}
+	if len(partitions) == 0 {
+		partitions = []block.GPTPartition{{}}
+	}
+
+	sysPath := h.path(filepath.Join("sys", "block", name))
+	sectors, err := strconv.ParseUint(readFile(filepath.Join(sysPath, "size")), 10, 64)
+	if err != nil {
+		return err
+	}
+	image := h.path(filepath.Join("dev", name))
+	if err := os.Truncate(image, int64(sectors*512)); os.IsNotExist(err) {
+		err = ioutil.WriteFile(image, nil, 0644)
+		if err == nil {
+			err = os.Truncate(image, int64(sectors*512))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := block.WritePartitionTable(image, diskGUID, partitions); err != nil {
+		return err
+	}
+	delete(h.filesystems, name)
+	h.partitionTables[name] = append([]block.GPTPartition(nil), partitions...)
+	return h.writePartitions(sysPath, number, sectors, partitions)
+}
+
+// writePartitions replaces the partitions of the disk in the sysfs tree, the partitions are aligned to 1MiB
+func (h *Host) writePartitions(sysPath, number string, sectors uint64, partitions []block.GPTPartition) error {
+	name := filepath.Base(sysPath)
+	existing, err := filepath.Glob(filepath.Join(sysPath, name+"*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range existing {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	prefix := name
+	if last := name[len(name)-1]; last >= '0' && last <= '9' {
+		prefix += "p"
+	}
+	major := strings.SplitN(number, ":", 2)[0]
+	minor, _ := strconv.Atoi(strings.SplitN(number, ":", 2)[1])
+	start := uint64(2048)
+	for i, part := range partitions {
+		size := (part.SizeBytes + 511) / 512
+		if size == 0 {
+			// the last partition takes the rest of the disk before the backup partition table
+			size = sectors - 34 - start
+		}
+		path := filepath.Join(sysPath, fmt.Sprintf("%s%d", prefix, i+1))
+		for _, dir := range []string{"holders", "slaves"} {
+			if err := os.MkdirAll(filepath.Join(path, dir), 0755); err != nil {
+				return err
+			}
+		}
+		attrs := map[string]string{
+			"partition": strconv.Itoa(i + 1),
+			"dev":       fmt.Sprintf("%s:%d", major, minor+i+1),
+			"start":     strconv.FormatUint(start, 10),
+			"size":      strconv.FormatUint(size, 10),
+		}
+		for attr, value := range attrs {
+			if err := ioutil.WriteFile(filepath.Join(path, attr), []byte(value+"\n"), 0644); err != nil {
+				return err
+			}
+		}
+		start = (start + size + 2047) / 2048 * 2048
+	}
+	return nil
+}
+
+func readFile(path string) string {
+	content, _ := ioutil.ReadFile(path)
+	return strings.TrimSpace(string(content))
+}
+
+// IsPartitionTableApplied compares the partitions with the ones written by WritePartitionTable
+func (h *Host) IsPartitionTableApplied(device string, partitions []block.GPTPartition) (bool, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if _, err := h.deviceNumber(device); err != nil {
+		return false, err
+	}
+	if len(partitions) == 0 {
+		partitions = []block.GPTPartition{{}}
+	}
+	current, ok := h.partitionTables[filepath.Base(device)]
+	return ok && reflect.DeepEqual(current, partitions), nil
+}
+
+// Stat returns the file info of the path in the snapshot
+func (h *Host) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(h.path(path))
+}
+
+// Mkdir creates the directory of the path in the snapshot, the parents are created as well since the snapshot
+// only has the trees of the devices, the rest of the root filesystem of the node is considered existing
+func (h *Host) Mkdir(path string, perm os.FileMode) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err := h.call("Mkdir", path); err != nil {
+		return err
+	}
+	if _, err := os.Stat(h.path(path)); err == nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: syscall.EEXIST}
+	}
+	return os.MkdirAll(h.path(path), perm|0700)
+}
+
+// path returns the path of the node in the snapshot
+func (h *Host) path(path string) string {
+	return filepath.Join(h.Root, path)
+}
+
+// probe returns the recorded filesystem of the device or probes its image, the caller must hold the lock
+func (h *Host) probe(device string) *block.ProbeResult {
+	name := filepath.Base(device)
+	if result, ok := h.filesystems[name]; ok {
+		copied := *result
+		return &copied
+	}
+	result, err := block.Probe(h.path(filepath.Join("dev", name)))
+	if err != nil {
+		return &block.ProbeResult{}
+	}
+	return result
+}
+
+// deviceNumber returns the major:minor of the disk or partition in the sysfs tree
+func (h *Host) deviceNumber(device string) (string, error) {
+	name := filepath.Base(device)
+	path := h.path(filepath.Join("sys", "block", name, "dev"))
+	if parent := h.parentDiskName(name); parent != "" {
+		path = h.path(filepath.Join("sys", "block", parent, name, "dev"))
+	}
+	number, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("device %s is not found", device)
+	}
+	return strings.TrimSpace(string(number)), nil
+}
+
+// parentDiskName returns the disk of the partition, or "" if the device is not a partition
+func (h *Host) parentDiskName(name string) string {
+	matches, _ := filepath.Glob(h.path(filepath.Join("sys", "block", "*", name)))
+	if len(matches) == 0 {
+		return ""
+	}
+	return filepath.Base(filepath.Dir(matches[0]))
+}
+
+func (h *Host) checkNotMounted(device string) error {
+	if _, err := h.deviceNumber(device); err != nil {
+		return err
+	}
+	mounts, err := h.readMounts()
+	if err != nil {
+		return err
+	}
+	for _, mount := range mounts {
+		if mount.source == device {
+			return fmt.Errorf("%s is mounted to %s", device, mount.mountPoint)
+		}
+	}
+	return nil
+}
+
+// updateMount changes the mount of the mount point, the syscall fails with EINVAL if nothing is mounted there
+func (h *Host) updateMount(syscallName, mountPoint string, update func(mount *mountEntry) error) error {
+	mounts, err := h.readMounts()
+	if err != nil {
+		return err
+	}
+	for i := range mounts {
+		if mounts[i].mountPoint == mountPoint {
+			if err := update(&mounts[i]); err != nil {
+				return err
+			}
+			return h.writeMounts(mounts)
+		}
+	}
+	return os.NewSyscallError(syscallName, syscall.EINVAL)
+}
+
+// readMounts parses the mountinfo of the snapshot, which lists the device numbers unlike the mounts
+func (h *Host) readMounts() ([]mountEntry, error) {
+	content, err := ioutil.ReadFile(h.path("proc/self/mountinfo"))
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := make([]mountEntry, 0)
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		parts := strings.SplitN(line, " - ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		fields, superFields := strings.Fields(parts[0]), strings.Fields(parts[1])
+		if len(fields) < 6 || len(superFields) < 2 {
+			continue
+		}
+		mounts = append(mounts, mountEntry{
+			number:     fields[2],
+			mountPoint: fields[4],
+			options:    fields[5],
+			fsType:     superFields[0],
+			source:     superFields[1],
+		})
+	}
+	return mounts, nil
+}
+
+// writeMounts replaces the mounts and mountinfo of the snapshot
+func (h *Host) writeMounts(mounts []mountEntry) error {
+	var mountsContent, mountInfoContent strings.Builder
+	for i, mount := range mounts {
+		fmt.Fprintf(&mountsContent, "%s %s %s %s 0 0\n", mount.source, mount.mountPoint, mount.fsType, mount.options)
+		fmt.Fprintf(&mountInfoContent, "%d 1 %s / %s %s - %s %s %s\n", 22+i, mount.number, mount.mountPoint,
+			mount.options, mount.fsType, mount.source, mount.options)
+	}
+	if err := ioutil.WriteFile(h.path("proc/self/mounts"), []byte(mountsContent.String()), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(h.path("proc/self/mountinfo"), []byte(mountInfoContent.String()), 0644)
+}
+
+// kernelMountOptions returns the options as the kernel lists them in the mounts, the access mode comes first and
+// the filesystem is mounted with relatime unless another atime option is specified
+func kernelMountOptions(options []string) string {
+	mode, atime := "rw", "relatime"
+	others := make([]string, 0, len(options))
+	for _, option := range options {
+		switch option {
+		case "ro", "rw":
+			mode = option
+		case "noatime", "relatime":
+			atime = option
+		case "strictatime":
+			atime = ""
+		case "defaults", "":
+		default:
+			others = append(others, option)
+		}
+	}
+
+	listed := []string{mode}
+	if atime != "" {
+		listed = append(listed, atime)
+	}
+	return strings.Join(append(listed, others...), ",")
+}
@@ -0,0 +1,52 @@
+package block
+
+import (
+	"strings"
+)
+
+const (
+	FileSystemExt4  = "ext4"
+	FileSystemXFS   = "xfs"
+	FileSystemBtrfs = "btrfs"
+
+	// DefaultFileSystem is the filesystem type created when the type is not specified
+	DefaultFileSystem = FileSystemExt4
+)
+
+// fileSystemProfile describes how the filesystem of a type is created and mounted
+type fileSystemProfile struct {
+	// the mkfs command and its arguments, the existing filesystem is overwritten
+	mkfsCommand string
+	mkfsArgs    []string
+
+	// the filesystem specific mount options
+	mountOptions string
+}
+
+var fileSystemProfiles = map[string]fileSystemProfile{
+	FileSystemExt4: {
+		mkfsCommand: "mkfs.ext4",
+		mkfsArgs:    []string{"-F"},
+		mountOptions: strings.Join([]string{
+			"journal_checksum",
+			"journal_ioprio=0",
+			"barrier=1",
+			"errors=remount-ro",
+		}, ","),
+	},
+	FileSystemXFS: {
+		mkfsCommand:  "mkfs.xfs",
+		mkfsArgs:     []string{"-f"},
+		mountOptions: "inode64",
+	},
+	FileSystemBtrfs: {
+		mkfsCommand: "mkfs.btrfs",
+		mkfsArgs:    []string{"-f"},
+	},
+}
+
+// IsSupportedFileSystem returns true if the filesystem type can be created and mounted
+func IsSupportedFileSystem(fsType string) bool {
+	_, ok := fileSystemProfiles[fsType]
+	return ok
+}
@@ -0,0 +1,413 @@
+package block
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf16"
+	"unsafe"
+)
+
+const (
+	// LinuxFilesystemTypeGUID is the partition type GUID of the Linux filesystem data
+	LinuxFilesystemTypeGUID = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+
+	gptSignature    = "EFI PART"
+	gptRevision     = 0x00010000
+	gptHeaderSize   = 92
+	gptEntryCount   = 128
+	gptEntrySize    = 128
+	gptMaxNameChars = 36
+
+	// the partitions are aligned to 1MiB, which is a multiple of the common physical block and erase block sizes
+	gptAlignmentBytes = 1 << 20
+
+	blkRRPart = 0x125f
+	blkSSZGet = 0x1268
+
+	rereadRetries  = 5
+	rereadInterval = time.Second
+)
+
+// GPTPartition describes a partition of the GPT partition table
+type GPTPartition struct {
+	// the name of the partition stored in the partition entry, up to 36 characters
+	Name string
+
+	// the partition type GUID, default to the Linux filesystem data
+	TypeGUID string
+
+	// the size of the partition in bytes, 0 means the partition takes the rest of the disk, which is only
+	// allowed for the last partition
+	SizeBytes uint64
+}
+
+type gptEntry struct {
+	// the partition number, which is the index of the entry in the partition entries from 1
+	number     int
+	typeGUID   [16]byte
+	uniqueGUID [16]byte
+	firstLBA   uint64
+	lastLBA    uint64
+	attributes uint64
+	name       string
+}
+
+// gptLayout is the on-disk layout of the partition table, the primary header is at LBA 1 followed by the partition
+// entries, and the backup entries are followed by the backup header at the last LBA of the disk
+type gptLayout struct {
+	sectorSize   uint64
+	lastLBA      uint64
+	entrySectors uint64
+	firstUsable  uint64
+	lastUsable   uint64
+	entries      []gptEntry
+}
+
+// WritePartitionTable overwrites the partition table of the disk with a new GPT partition table of the partitions,
+// and asks the kernel to re-read the partition table. A single partition spanning the whole disk is created if no
+// partition is specified. The disk GUID, i.e. the PTUUID, is kept if the one of the existing GPT partition table is
+// given, so the disk keeps its identity; a new one is generated if it's empty or not a GUID, e.g. the disk signature
+// of a MBR partition table. The disk is opened exclusively, so it fails if the disk or any of its partitions is in use.
+func WritePartitionTable(device, diskGUID string, partitions []GPTPartition) error {
+	if len(partitions) == 0 {
+		partitions = []GPTPartition{{}}
+	}
+
+	f, err := os.OpenFile(device, os.O_RDWR|syscall.O_EXCL, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	layout, err := planDeviceGPTLayout(f, partitions)
+	if err != nil {
+		return err
+	}
+
+	guid, err := parseGUID(diskGUID)
+	if err != nil {
+		if guid, err = newGUID(); err != nil {
+			return err
+		}
+	}
+	for i := range layout.entries {
+		if layout.entries[i].uniqueGUID, err = newGUID(); err != nil {
+			return err
+		}
+	}
+
+	if err := layout.write(f, guid); err != nil {
+		return fmt.Errorf("failed to write the partition table of %s, error: %w", device, err)
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if !isBlockDevice(f) {
+		// the disk image has no partitions to re-read
+		return nil
+	}
+	return rereadPartitionTable(f)
+}
+
+// write writes the protective MBR, the primary and the backup partition tables of the layout
+func (l *gptLayout) write(w io.WriterAt, diskGUID [16]byte) error {
+	entries := l.encodeEntries()
+	primary := l.encodeHeader(diskGUID, 1, l.lastLBA, 2, entries)
+	backup := l.encodeHeader(diskGUID, l.lastLBA, 1, l.lastLBA-l.entrySectors, entries)
+
+	writes := []struct {
+		lba  uint64
+		data []byte
+	}{
+		{0, l.encodeProtectiveMBR()},
+		{1, primary},
+		{2, entries},
+		{l.lastLBA - l.entrySectors, entries},
+		{l.lastLBA, backup},
+	}
+	for _, write := range writes {
+		if _, err := w.WriteAt(write.data, int64(write.lba*l.sectorSize)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsPartitionTableApplied returns true if the disk has the GPT partition table of the partitions, it compares the
+// type, position and name of the partitions rather than the GUIDs, which are generated on writing
+func IsPartitionTableApplied(device string, partitions []GPTPartition) (bool, error) {
+	if len(partitions) == 0 {
+		partitions = []GPTPartition{{}}
+	}
+
+	f, err := os.Open(device)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	layout, err := planDeviceGPTLayout(f, partitions)
+	if err != nil {
+		return false, err
+	}
+	current, err := readGPTEntries(f, layout.sectorSize)
+	if err != nil || len(current) != len(layout.entries) {
+		return false, nil
+	}
+	for i, entry := range layout.entries {
+		if current[i].typeGUID != entry.typeGUID || current[i].firstLBA != entry.firstLBA ||
+			current[i].lastLBA != entry.lastLBA || current[i].name != entry.name {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func planDeviceGPTLayout(f *os.File, partitions []GPTPartition) (*gptLayout, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	// the disk image is partitioned with the 512-byte sectors of the loop devices
+	sectorSize := uint64(512)
+	if isBlockDevice(f) {
+		if sectorSize, err = getLogicalSectorSize(f); err != nil {
+			return nil, err
+		}
+	}
+	return planGPTLayout(uint64(size), sectorSize, partitions)
+}
+
+// planGPTLayout allocates the partitions in order from the first aligned usable LBA
+func planGPTLayout(sizeBytes, sectorSize uint64, partitions []GPTPartition) (*gptLayout, error) {
+	if len(partitions) > gptEntryCount {
+		return nil, fmt.Errorf("too many partitions %d, at most %d partitions are supported", len(partitions), gptEntryCount)
+	}
+
+	layout := &gptLayout{
+		sectorSize:   sectorSize,
+		lastLBA:      sizeBytes/sectorSize - 1,
+		entrySectors: (gptEntryCount*gptEntrySize + sectorSize - 1) / sectorSize,
+	}
+	layout.firstUsable = 2 + layout.entrySectors
+	if layout.lastLBA < 2*layout.entrySectors+2 {
+		return nil, fmt.Errorf("disk of %d bytes is too small for the partition table", sizeBytes)
+	}
+	layout.lastUsable = layout.lastLBA - layout.entrySectors - 1
+
+	alignment := uint64(gptAlignmentBytes) / sectorSize
+	next := layout.firstUsable
+	for i, part := range partitions {
+		if len(utf16.Encode([]rune(part.Name))) > gptMaxNameChars {
+			return nil, fmt.Errorf("name of partition %d is longer than %d characters", i+1, gptMaxNameChars)
+		}
+		typeGUIDStr := part.TypeGUID
+		if typeGUIDStr == "" {
+			typeGUIDStr = LinuxFilesystemTypeGUID
+		}
+		typeGUID, err := parseGUID(typeGUIDStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid type GUID of partition %d, error: %w", i+1, err)
+		}
+
+		first := (next + alignment - 1) / alignment * alignment
+		last := layout.lastUsable
+		if part.SizeBytes == 0 {
+			if i != len(partitions)-1 {
+				return nil, fmt.Errorf("size of partition %d is required, only the last partition can take the rest of the disk", i+1)
+			}
+		} else {
+			last = first + (part.SizeBytes+sectorSize-1)/sectorSize - 1
+		}
+		if first > layout.lastUsable || last > layout.lastUsable {
+			return nil, fmt.Errorf("partition %d exceeds the disk of %d bytes", i+1, sizeBytes)
+		}
+
+		layout.entries = append(layout.entries, gptEntry{
+			typeGUID: typeGUID,
+			firstLBA: first,
+			lastLBA:  last,
+			name:     part.Name,
+		})
+		next = last + 1
+	}
+	return layout, nil
+}
+
+func (l *gptLayout) encodeProtectiveMBR() []byte {
+	mbr := make([]byte, l.sectorSize)
+	sectors := l.lastLBA
+	if sectors > 0xffffffff {
+		sectors = 0xffffffff
+	}
+	entry := mbr[446:462]
+	copy(entry[1:4], []byte{0x00, 0x02, 0x00})
+	entry[4] = 0xee
+	copy(entry[5:8], []byte{0xff, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(entry[8:12], 1)
+	binary.LittleEndian.PutUint32(entry[12:16], uint32(sectors))
+	mbr[510], mbr[511] = 0x55, 0xaa
+	return mbr
+}
+
+func (l *gptLayout) encodeEntries() []byte {
+	buf := make([]byte, l.entrySectors*l.sectorSize)
+	for i, entry := range l.entries {
+		b := buf[i*gptEntrySize : (i+1)*gptEntrySize]
+		copy(b[0:16], entry.typeGUID[:])
+		copy(b[16:32], entry.uniqueGUID[:])
+		binary.LittleEndian.PutUint64(b[32:40], entry.firstLBA)
+		binary.LittleEndian.PutUint64(b[40:48], entry.lastLBA)
+		binary.LittleEndian.PutUint64(b[48:56], entry.attributes)
+		for j, c := range utf16.Encode([]rune(entry.name)) {
+			binary.LittleEndian.PutUint16(b[56+2*j:], c)
+		}
+	}
+	return buf
+}
+
+func (l *gptLayout) encodeHeader(diskGUID [16]byte, myLBA, alternateLBA, entriesLBA uint64, entries []byte) []byte {
+	header := make([]byte, l.sectorSize)
+	copy(header[0:8], gptSignature)
+	binary.LittleEndian.PutUint32(header[8:12], gptRevision)
+	binary.LittleEndian.PutUint32(header[12:16], gptHeaderSize)
+	binary.LittleEndian.PutUint64(header[24:32], myLBA)
+	binary.LittleEndian.PutUint64(header[32:40], alternateLBA)
+	binary.LittleEndian.PutUint64(header[40:48], l.firstUsable)
+	binary.LittleEndian.PutUint64(header[48:56], l.lastUsable)
+	copy(header[56:72], diskGUID[:])
+	binary.LittleEndian.PutUint64(header[72:80], entriesLBA)
+	binary.LittleEndian.PutUint32(header[80:84], gptEntryCount)
+	binary.LittleEndian.PutUint32(header[84:88], gptEntrySize)
+	binary.LittleEndian.PutUint32(header[88:92], crc32.ChecksumIEEE(entries[:gptEntryCount*gptEntrySize]))
+	binary.LittleEndian.PutUint32(header[16:20], crc32.ChecksumIEEE(header[:gptHeaderSize]))
+	return header
+}
+
+// readGPTEntries returns the used partition entries of the primary partition table, the checksums are verified
+func readGPTEntries(r io.ReaderAt, sectorSize uint64) ([]gptEntry, error) {
+	header := make([]byte, gptHeaderSize)
+	if _, err := r.ReadAt(header, int64(sectorSize)); err != nil {
+		return nil, err
+	}
+	if string(header[0:8]) != gptSignature {
+		return nil, fmt.Errorf("no GPT partition table found")
+	}
+	checksum := binary.LittleEndian.Uint32(header[16:20])
+	binary.LittleEndian.PutUint32(header[16:20], 0)
+	if crc32.ChecksumIEEE(header) != checksum {
+		return nil, fmt.Errorf("invalid checksum of the GPT header")
+	}
+
+	entriesLBA := binary.LittleEndian.Uint64(header[72:80])
+	count := binary.LittleEndian.Uint32(header[80:84])
+	size := binary.LittleEndian.Uint32(header[84:88])
+	if size < gptEntrySize || count > 1024 {
+		return nil, fmt.Errorf("unsupported GPT partition entries of %d entries of %d bytes", count, size)
+	}
+	buf := make([]byte, count*size)
+	if _, err := r.ReadAt(buf, int64(entriesLBA*sectorSize)); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(buf) != binary.LittleEndian.Uint32(header[88:92]) {
+		return nil, fmt.Errorf("invalid checksum of the GPT partition entries")
+	}
+
+	entries := make([]gptEntry, 0)
+	for i := uint32(0); i < count; i++ {
+		b := buf[i*size : (i+1)*size]
+		entry := gptEntry{
+			number:     int(i) + 1,
+			firstLBA:   binary.LittleEndian.Uint64(b[32:40]),
+			lastLBA:    binary.LittleEndian.Uint64(b[40:48]),
+			attributes: binary.LittleEndian.Uint64(b[48:56]),
+		}
+		copy(entry.typeGUID[:], b[0:16])
+		copy(entry.uniqueGUID[:], b[16:32])
+		if entry.typeGUID == [16]byte{} {
+			continue
+		}
+		name := make([]uint16, 0, gptMaxNameChars)
+		for j := 56; j+1 < gptEntrySize; j += 2 {
+			c := binary.LittleEndian.Uint16(b[j:])
+			if c == 0 {
+				break
+			}
+			name = append(name, c)
+		}
+		entry.name = string(utf16.Decode(name))
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func isBlockDevice(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0
+}
+
+func getLogicalSectorSize(f *os.File) (uint64, error) {
+	var size int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), blkSSZGet, uintptr(unsafe.Pointer(&size))); errno != 0 {
+		return 0, os.NewSyscallError("ioctl BLKSSZGET", errno)
+	}
+	if size <= 0 {
+		return 0, fmt.Errorf("invalid logical sector size %d", size)
+	}
+	return uint64(size), nil
+}
+
+// rereadPartitionTable asks the kernel to re-read the partition table, it's retried since the udev rules triggered by
+// the writes may probe the disk meanwhile
+func rereadPartitionTable(f *os.File) error {
+	var errno syscall.Errno
+	for i := 0; i < rereadRetries; i++ {
+		if _, _, errno = syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), blkRRPart, 0); errno != syscall.EBUSY {
+			break
+		}
+		time.Sleep(rereadInterval)
+	}
+	if errno != 0 {
+		return os.NewSyscallError("ioctl BLKRRPART", errno)
+	}
+	return nil
+}
+
+// parseGUID parses the GUID string into the mixed-endian format of GPT, the first three fields are little-endian
+func parseGUID(s string) ([16]byte, error) {
+	var guid [16]byte
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 || strings.Count(s, "-") != 4 {
+		return guid, fmt.Errorf("invalid GUID %q", s)
+	}
+	copy(guid[:], b)
+	reverse(guid[0:4])
+	reverse(guid[4:6])
+	reverse(guid[6:8])
+	return guid, nil
+}
+
+// newGUID returns a random version 4 GUID, the byte order doesn't matter since it's random
+func newGUID() ([16]byte, error) {
+	var guid [16]byte
+	if _, err := rand.Read(guid[:]); err != nil {
+		return guid, err
+	}
+	guid[7] = guid[7]&0x0f | 0x40
+	guid[8] = guid[8]&0x3f | 0x80
+	return guid, nil
+}
+
+func reverse(b []byte) {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+}
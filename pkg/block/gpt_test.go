@@ -0,0 +1,307 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testDiskSize = 64 << 20
+
+// newDiskImage creates a sparse disk image of the size in the temporary directory of the test
+func newDiskImage(t *testing.T, size int64) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPlanGPTLayout(t *testing.T) {
+	type lbaRange struct{ first, last uint64 }
+	tests := []struct {
+		name       string
+		sizeBytes  uint64
+		sectorSize uint64
+		partitions []GPTPartition
+		expected   []lbaRange
+		lastUsable uint64
+		invalid    bool
+	}{
+		{
+			name:       "whole disk of 512-byte sectors",
+			sizeBytes:  1 << 30,
+			sectorSize: 512,
+			partitions: []GPTPartition{{}},
+			expected:   []lbaRange{{2048, 2097118}},
+			lastUsable: 2097118,
+		},
+		{
+			name:       "whole disk of 4096-byte sectors",
+			sizeBytes:  1 << 30,
+			sectorSize: 4096,
+			partitions: []GPTPartition{{}},
+			expected:   []lbaRange{{256, 262138}},
+			lastUsable: 262138,
+		},
+		{
+			name:       "partitions are aligned to 1MiB",
+			sizeBytes:  1 << 30,
+			sectorSize: 512,
+			partitions: []GPTPartition{{SizeBytes: 1000000}, {SizeBytes: 100 << 20}, {}},
+			expected:   []lbaRange{{2048, 4001}, {4096, 208895}, {208896, 2097118}},
+			lastUsable: 2097118,
+		},
+		{
+			name:       "partitions of 4096-byte sectors are aligned to 1MiB",
+			sizeBytes:  1 << 30,
+			sectorSize: 4096,
+			partitions: []GPTPartition{{SizeBytes: 4097}, {}},
+			expected:   []lbaRange{{256, 257}, {512, 262138}},
+			lastUsable: 262138,
+		},
+		{
+			name:       "partition doesn't fit",
+			sizeBytes:  1 << 30,
+			sectorSize: 512,
+			partitions: []GPTPartition{{SizeBytes: 1 << 30}},
+			invalid:    true,
+		},
+		{
+			name:       "partition after the last usable LBA",
+			sizeBytes:  4 << 20,
+			sectorSize: 512,
+			partitions: []GPTPartition{{SizeBytes: 3 << 20}, {}},
+			invalid:    true,
+		},
+		{
+			name:       "size of the partition before the last one is required",
+			sizeBytes:  1 << 30,
+			sectorSize: 512,
+			partitions: []GPTPartition{{}, {SizeBytes: 1 << 20}},
+			invalid:    true,
+		},
+		{
+			name:       "disk too small for the partition table",
+			sizeBytes:  16 << 10,
+			sectorSize: 512,
+			partitions: []GPTPartition{{}},
+			invalid:    true,
+		},
+		{
+			name:       "invalid type GUID",
+			sizeBytes:  1 << 30,
+			sectorSize: 512,
+			partitions: []GPTPartition{{TypeGUID: "0FC63DAF-8483"}},
+			invalid:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			layout, err := planGPTLayout(test.sizeBytes, test.sectorSize, test.partitions)
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("expected error, got layout %+v", layout)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err.Error())
+			}
+			if layout.lastUsable != test.lastUsable || layout.lastLBA != test.sizeBytes/test.sectorSize-1 {
+				t.Errorf("expected last usable LBA %d, got %d of last LBA %d", test.lastUsable, layout.lastUsable, layout.lastLBA)
+			}
+			if len(layout.entries) != len(test.expected) {
+				t.Fatalf("expected %d entries, got %d", len(test.expected), len(layout.entries))
+			}
+			alignment := uint64(gptAlignmentBytes) / test.sectorSize
+			for i, entry := range layout.entries {
+				if got := (lbaRange{entry.firstLBA, entry.lastLBA}); got != test.expected[i] {
+					t.Errorf("expected partition %d at %v, got %v", i+1, test.expected[i], got)
+				}
+				if entry.firstLBA%alignment != 0 {
+					t.Errorf("expected partition %d to be aligned to %d sectors, got first LBA %d", i+1, alignment, entry.firstLBA)
+				}
+			}
+		})
+	}
+}
+
+func TestWritePartitionTable(t *testing.T) {
+	path := newDiskImage(t, testDiskSize)
+	partitions := []GPTPartition{
+		{Name: "longhorn-data", SizeBytes: 16 << 20},
+		{Name: "longhorn-ünicode", TypeGUID: "E6D6D379-F507-44C2-A23C-238F2A3DF928"},
+	}
+
+	if applied, err := IsPartitionTableApplied(path, partitions); err != nil || applied {
+		t.Fatalf("expected no partition table on the empty image, got applied %v, error: %v", applied, err)
+	}
+	if err := WritePartitionTable(path, "", partitions); err != nil {
+		t.Fatalf("failed to write the partition table, error: %s", err.Error())
+	}
+	if applied, err := IsPartitionTableApplied(path, partitions); err != nil || !applied {
+		t.Errorf("expected partition table to be applied, got applied %v, error: %v", applied, err)
+	}
+	changed := []GPTPartition{{Name: "longhorn-data", SizeBytes: 32 << 20}, {}}
+	if applied, err := IsPartitionTableApplied(path, changed); err != nil || applied {
+		t.Errorf("expected changed partition table not to be applied, got applied %v, error: %v", applied, err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := readGPTEntries(f, 512)
+	if err != nil {
+		t.Fatalf("failed to read the partition entries, error: %s", err.Error())
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 partition entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.number != i+1 || entry.name != partitions[i].Name {
+			t.Errorf("expected partition %d named %q, got partition %d named %q", i+1, partitions[i].Name, entry.number, entry.name)
+		}
+		if entry.uniqueGUID == [16]byte{} {
+			t.Errorf("expected unique GUID of partition %d to be generated", i+1)
+		}
+	}
+	if entries[0].uniqueGUID == entries[1].uniqueGUID {
+		t.Errorf("expected unique GUIDs of the partitions to differ")
+	}
+	if got := formatGUID(entries[1].typeGUID); got != "e6d6d379-f507-44c2-a23c-238f2a3df928" {
+		t.Errorf("expected type GUID of partition 2 to be kept, got %s", got)
+	}
+
+	mbr := make([]byte, 512)
+	if _, err := f.ReadAt(mbr, 0); err != nil {
+		t.Fatal(err)
+	}
+	if mbr[450] != 0xee || mbr[510] != 0x55 || mbr[511] != 0xaa {
+		t.Errorf("expected protective MBR, got type %#x and signature %#x%x", mbr[450], mbr[510], mbr[511])
+	}
+	verifyGPTHeaders(t, f, 512, testDiskSize/512-1)
+}
+
+func TestWritePartitionTableKeepsDiskGUID(t *testing.T) {
+	path := newDiskImage(t, testDiskSize)
+	probePTUUID := func() string {
+		t.Helper()
+		result, err := Probe(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.PTUUID
+	}
+
+	if err := WritePartitionTable(path, "", nil); err != nil {
+		t.Fatalf("failed to write the partition table, error: %s", err.Error())
+	}
+	ptUUID := probePTUUID()
+	if ptUUID == "" {
+		t.Fatalf("expected disk GUID to be generated")
+	}
+
+	// the disk is partitioned again with its PTUUID, e.g. after wiping it
+	if err := WritePartitionTable(path, ptUUID, []GPTPartition{{SizeBytes: 8 << 20}, {}}); err != nil {
+		t.Fatalf("failed to write the partition table, error: %s", err.Error())
+	}
+	if got := probePTUUID(); got != ptUUID {
+		t.Errorf("expected disk GUID %s to be kept, got %s", ptUUID, got)
+	}
+
+	// the disk signature of a MBR partition table is not a GUID
+	if err := WritePartitionTable(path, "1a2b3c4d", nil); err != nil {
+		t.Fatalf("failed to write the partition table, error: %s", err.Error())
+	}
+	if got := probePTUUID(); got == ptUUID || got == "" {
+		t.Errorf("expected a new disk GUID, got %q", got)
+	}
+}
+
+func TestWriteGPTLayoutOf4KSectors(t *testing.T) {
+	path := newDiskImage(t, testDiskSize)
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	layout, err := planGPTLayout(testDiskSize, 4096, []GPTPartition{{Name: "longhorn"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := layout.write(f, [16]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := readGPTEntries(f, 4096)
+	if err != nil {
+		t.Fatalf("failed to read the partition entries, error: %s", err.Error())
+	}
+	if len(entries) != 1 || entries[0].firstLBA != 256 || entries[0].lastLBA != layout.lastUsable || entries[0].name != "longhorn" {
+		t.Errorf("expected partition longhorn from LBA 256 to %d, got %+v", layout.lastUsable, entries)
+	}
+	verifyGPTHeaders(t, f, 4096, testDiskSize/4096-1)
+}
+
+// verifyGPTHeaders checks the checksums of the primary and the backup headers, and the backup header at the last LBA
+// points back to the primary one and to the backup entries right before it
+func verifyGPTHeaders(t *testing.T, f *os.File, sectorSize, lastLBA uint64) {
+	t.Helper()
+	entrySectors := uint64(gptEntryCount*gptEntrySize) / sectorSize
+	read := func(lba, size uint64) []byte {
+		b := make([]byte, size)
+		if _, err := f.ReadAt(b, int64(lba*sectorSize)); err != nil {
+			t.Fatalf("failed to read LBA %d, error: %s", lba, err.Error())
+		}
+		return b
+	}
+
+	headers := map[string]struct {
+		lba, alternateLBA, entriesLBA uint64
+	}{
+		"primary": {1, lastLBA, 2},
+		"backup":  {lastLBA, 1, lastLBA - entrySectors},
+	}
+	var entries [][]byte
+	for name, expected := range headers {
+		header := read(expected.lba, gptHeaderSize)
+		if string(header[0:8]) != gptSignature {
+			t.Fatalf("expected %s header at LBA %d, got signature %q", name, expected.lba, header[0:8])
+		}
+		checksum := binary.LittleEndian.Uint32(header[16:20])
+		binary.LittleEndian.PutUint32(header[16:20], 0)
+		if crc32.ChecksumIEEE(header) != checksum {
+			t.Errorf("invalid checksum %#x of the %s header", checksum, name)
+		}
+		myLBA := binary.LittleEndian.Uint64(header[24:32])
+		alternateLBA := binary.LittleEndian.Uint64(header[32:40])
+		entriesLBA := binary.LittleEndian.Uint64(header[72:80])
+		if myLBA != expected.lba || alternateLBA != expected.alternateLBA || entriesLBA != expected.entriesLBA {
+			t.Errorf("expected %s header at LBA %d with alternate LBA %d and entries LBA %d, got %d, %d and %d", name,
+				expected.lba, expected.alternateLBA, expected.entriesLBA, myLBA, alternateLBA, entriesLBA)
+		}
+
+		buf := read(entriesLBA, gptEntryCount*gptEntrySize)
+		if crc32.ChecksumIEEE(buf) != binary.LittleEndian.Uint32(header[88:92]) {
+			t.Errorf("invalid checksum of the %s partition entries", name)
+		}
+		entries = append(entries, buf)
+	}
+	if !bytes.Equal(entries[0], entries[1]) {
+		t.Errorf("expected the backup partition entries to be the same as the primary ones")
+	}
+}
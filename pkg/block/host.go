@@ -0,0 +1,87 @@
+package block
+
+import (
+	"os"
+)
+
+// Host performs the I/O on the devices and mounts of the node. The controllers take it by injection, so their
+// mount, format and partition state machines can run against a fake host with simulated failures.
+type Host interface {
+	// Mount mounts the device with the filesystem of the type to the path, see Mount
+	Mount(device, path, fsType string, options []string) error
+	// Remount changes the options of the filesystem mounted at the path, see Remount
+	Remount(device, path, fsType string, options []string) error
+	// Unmount unmounts the filesystem mounted at the path, see Unmount
+	Unmount(path string, opts UnmountOptions) error
+	// MoveMount moves the mount at the source path to the target path, see MoveMount
+	MoveMount(source, target string) error
+
+	// MakeFilesystem creates a new filesystem of the type on the device, see MakeFilesystem
+	MakeFilesystem(device, fsType string) error
+	// WipeFilesystem erases the signatures of the device, see WipeFilesystem
+	WipeFilesystem(device string) error
+	// Probe reads the filesystem and partition table signatures of the device, see Probe
+	Probe(device string) (*ProbeResult, error)
+
+	// WritePartitionTable overwrites the partition table of the disk, see WritePartitionTable
+	WritePartitionTable(device, diskGUID string, partitions []GPTPartition) error
+	// IsPartitionTableApplied checks the partition table of the disk, see IsPartitionTableApplied
+	IsPartitionTableApplied(device string, partitions []GPTPartition) (bool, error)
+
+	// Stat returns the file info of the path, the error satisfies os.IsNotExist if it doesn't exist
+	Stat(path string) (os.FileInfo, error)
+	// Mkdir creates the directory of the path
+	Mkdir(path string, perm os.FileMode) error
+}
+
+// linuxHost performs the I/O with the syscalls and commands of the node the agent is running on
+type linuxHost struct{}
+
+// NewLinuxHost returns the Host of the node the agent is running on
+func NewLinuxHost() Host {
+	return linuxHost{}
+}
+
+func (linuxHost) Mount(device, path, fsType string, options []string) error {
+	return Mount(device, path, fsType, options)
+}
+
+func (linuxHost) Remount(device, path, fsType string, options []string) error {
+	return Remount(device, path, fsType, options)
+}
+
+func (linuxHost) Unmount(path string, opts UnmountOptions) error {
+	return Unmount(path, opts)
+}
+
+func (linuxHost) MoveMount(source, target string) error {
+	return MoveMount(source, target)
+}
+
+func (linuxHost) MakeFilesystem(device, fsType string) error {
+	return MakeFilesystem(device, fsType)
+}
+
+func (linuxHost) WipeFilesystem(device string) error {
+	return WipeFilesystem(device)
+}
+
+func (linuxHost) Probe(device string) (*ProbeResult, error) {
+	return Probe(device)
+}
+
+func (linuxHost) WritePartitionTable(device, diskGUID string, partitions []GPTPartition) error {
+	return WritePartitionTable(device, diskGUID, partitions)
+}
+
+func (linuxHost) IsPartitionTableApplied(device string, partitions []GPTPartition) (bool, error) {
+	return IsPartitionTableApplied(device, partitions)
+}
+
+func (linuxHost) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (linuxHost) Mkdir(path string, perm os.FileMode) error {
+	return os.Mkdir(path, perm)
+}
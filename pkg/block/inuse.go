@@ -0,0 +1,177 @@
+package block
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/jaypipes/ghw/pkg/linuxpath"
+)
+
+// ErrDeviceInUse is wrapped by the errors of CheckDeviceNotInUse
+var ErrDeviceInUse = errors.New("device is in use")
+
+// CheckDeviceNotInUse returns an error wrapping ErrDeviceInUse if the device or any of its partitions is in use, so
+// it must not be formatted, partitioned or wiped. A device is in use if it backs the root filesystem, is mounted
+// anywhere including the bind mounts, is used as swap, is held by another device, e.g. LVM, dm-crypt or md, or is
+// opened exclusively by another process.
+func (i *Info) CheckDeviceNotInUse(devPath string) error {
+	name := strings.TrimPrefix(devPath, "/dev/")
+	sysPath := i.getDeviceSysPath(name)
+	if sysPath == "" {
+		return fmt.Errorf("device %s is not found", devPath)
+	}
+
+	devices := map[string]string{name: sysPath}
+	for _, part := range getChildPartitions(sysPath) {
+		devices[part] = filepath.Join(sysPath, part)
+	}
+
+	numbers := make(map[string]string, len(devices))
+	for dev, path := range devices {
+		number, err := ioutil.ReadFile(filepath.Join(path, "dev"))
+		if err != nil {
+			return fmt.Errorf("failed to read the device number of %s, error: %w", dev, err)
+		}
+		numbers[strings.TrimSpace(string(number))] = dev
+	}
+
+	roots := linuxpath.PathRootsFromContext(i.ctx)
+	procPath := filepath.Join(i.ctx.Chroot, roots.Proc)
+	mounts, err := readMountInfo(filepath.Join(procPath, "self", "mountinfo"))
+	if err != nil {
+		return err
+	}
+	for _, mount := range mounts {
+		dev, ok := numbers[mount.number]
+		if !ok {
+			continue
+		}
+		if mount.mountPoint == "/" {
+			return fmt.Errorf("%w: %s backs the root filesystem", ErrDeviceInUse, dev)
+		}
+		return fmt.Errorf("%w: %s is mounted to %s", ErrDeviceInUse, dev, mount.mountPoint)
+	}
+
+	swaps, err := readSwaps(filepath.Join(procPath, "swaps"))
+	if err != nil {
+		return err
+	}
+	for _, swap := range swaps {
+		if _, ok := devices[strings.TrimPrefix(swap, "/dev/")]; ok {
+			return fmt.Errorf("%w: %s is used as swap", ErrDeviceInUse, swap)
+		}
+	}
+
+	for dev, path := range devices {
+		holders, _ := ioutil.ReadDir(filepath.Join(path, "holders"))
+		if len(holders) > 0 {
+			return fmt.Errorf("%w: %s is held by %s", ErrDeviceInUse, dev, holders[0].Name())
+		}
+	}
+
+	// the device node is only available on the host rather than a chroot of the sysfs and procfs
+	if i.ctx.Chroot == "" || i.ctx.Chroot == "/" {
+		f, err := os.OpenFile(getFullDevPath(name), os.O_RDONLY|syscall.O_EXCL, 0)
+		if errors.Is(err, syscall.EBUSY) {
+			return fmt.Errorf("%w: %s is opened exclusively by another process", ErrDeviceInUse, devPath)
+		}
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// getDeviceSysPath returns the sysfs directory of the disk or partition, or "" if the device is not found
+func (i *Info) getDeviceSysPath(name string) string {
+	paths := linuxpath.New(i.ctx)
+	path := filepath.Join(paths.SysBlock, name)
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	if disk := i.GetParentDiskName(name); disk != "" {
+		return filepath.Join(paths.SysBlock, disk, name)
+	}
+	return ""
+}
+
+// getChildPartitions returns the names of the partitions of the disk in the sysfs directory
+func getChildPartitions(sysPath string) []string {
+	parts := make([]string, 0)
+	files, err := ioutil.ReadDir(sysPath)
+	if err != nil {
+		return parts
+	}
+	for _, file := range files {
+		if _, err := os.Stat(filepath.Join(sysPath, file.Name(), "partition")); err == nil {
+			parts = append(parts, file.Name())
+		}
+	}
+	return parts
+}
+
+func getFullDevPath(name string) string {
+	return filepath.Join("/dev", name)
+}
+
+type mountInfo struct {
+	number     string
+	mountPoint string
+}
+
+// readMountInfo parses the mountinfo file, unlike /proc/mounts it lists the device number of each mount, so the bind
+// mounts and the mounts by the other paths of the device, e.g. /dev/disk/by-uuid, are recognized as well
+func readMountInfo(path string) ([]mountInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mounts := make([]mountInfo, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mounts = append(mounts, mountInfo{
+			number:     fields[2],
+			mountPoint: unescapeMountPath(fields[4]),
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+// readSwaps returns the swap devices and files listed in the swaps file
+func readSwaps(path string) ([]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	swaps := make([]string, 0)
+	// the first line is the header: Filename Type Size Used Priority
+	for _, line := range strings.Split(string(content), "\n")[1:] {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			swaps = append(swaps, unescapeMountPath(fields[0]))
+		}
+	}
+	return swaps, nil
+}
+
+// unescapeMountPath decodes the octal sequences of the space, tab, newline and backslash characters
+func unescapeMountPath(path string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(path)
+}
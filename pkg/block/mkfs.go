@@ -0,0 +1,30 @@
+package block
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// WipeFilesystem erases all the filesystem, raid and partition-table signatures of the device
+func WipeFilesystem(device string) error {
+	return runCommand("wipefs", "--all", device)
+}
+
+// MakeFilesystem creates a new filesystem of the type on the device, the existing one will be overwritten
+func MakeFilesystem(device, fsType string) error {
+	profile, ok := fileSystemProfiles[fsType]
+	if !ok {
+		return fmt.Errorf("unsupported filesystem type %s", fsType)
+	}
+	return runCommand(profile.mkfsCommand, append(profile.mkfsArgs, device)...)
+}
+
+func runCommand(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to execute %s %s, error: %s, output: %s", name, strings.Join(args, " "),
+			err.Error(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -1,25 +1,67 @@
 package block
 
 import (
+	"errors"
+	"fmt"
 	"os"
-	"strings"
 	"syscall"
 )
 
-var ext4MountOptions = strings.Join([]string{
-	"journal_checksum",
-	"journal_ioprio=0",
-	"barrier=1",
-	"errors=remount-ro",
-}, ",")
-
-// MountExt4 mounts the specified ext4 volume device to the specified path
-func MountExt4(device, path string, readonly bool) error {
-	var flags uintptr
-	flags = syscall.MS_RELATIME
-	if readonly {
-		flags |= syscall.MS_RDONLY
+// Mount mounts the device with the filesystem of the type to the specified path, the options are parsed by
+// ParseMountOptions and the filesystem is mounted with relatime unless another atime option is specified
+func Mount(device, path, fsType string, options []string) error {
+	profile, ok := fileSystemProfiles[fsType]
+	if !ok {
+		return fmt.Errorf("unsupported filesystem type %s", fsType)
 	}
-	err := syscall.Mount(device, path, "ext4", flags, ext4MountOptions)
+
+	flags, data := getMountFlags(options)
+	err := syscall.Mount(device, path, fsType, flags, getMountData(profile, data))
+	return os.NewSyscallError("mount", err)
+}
+
+// Remount changes the options of the filesystem mounted at the specified path without unmounting it, note that
+// some data options, e.g. the quota options of xfs, can't be changed by remounting
+func Remount(device, path, fsType string, options []string) error {
+	profile, ok := fileSystemProfiles[fsType]
+	if !ok {
+		return fmt.Errorf("unsupported filesystem type %s", fsType)
+	}
+
+	flags, data := getMountFlags(options)
+	err := syscall.Mount(device, path, fsType, flags|syscall.MS_REMOUNT, getMountData(profile, data))
+	return os.NewSyscallError("mount", err)
+}
+
+// UnmountOptions describes how the filesystem is unmounted
+type UnmountOptions struct {
+	// detach the filesystem from the file hierarchy now, and clean up the references once it is not busy anymore
+	Lazy bool
+
+	// force the unmount even if the filesystem is busy, only supported by the network filesystems
+	Force bool
+}
+
+// Unmount unmounts the filesystem mounted at the specified path, use IsBusy to check if the filesystem is in use
+func Unmount(path string, opts UnmountOptions) error {
+	var flags int
+	if opts.Lazy {
+		flags |= syscall.MNT_DETACH
+	}
+	if opts.Force {
+		flags |= syscall.MNT_FORCE
+	}
+	err := syscall.Unmount(path, flags)
+	return os.NewSyscallError("umount", err)
+}
+
+// MoveMount moves the mount at the source path to the target path without unmounting the filesystem
+func MoveMount(source, target string) error {
+	err := syscall.Mount(source, target, "", syscall.MS_MOVE, "")
 	return os.NewSyscallError("mount", err)
 }
+
+// IsBusy returns true if the mount operation failed because the filesystem is in use
+func IsBusy(err error) bool {
+	return errors.Is(err, syscall.EBUSY)
+}
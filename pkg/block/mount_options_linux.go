@@ -0,0 +1,125 @@
+package block
+
+import (
+	"strings"
+	"syscall"
+)
+
+// mountFlag is a mount option that is passed as a flag of the mount syscall rather than a data option, the clear
+// options, e.g. "rw", unset the flag
+type mountFlag struct {
+	flag  uintptr
+	clear bool
+}
+
+var mountFlags = map[string]mountFlag{
+	"ro":          {flag: syscall.MS_RDONLY},
+	"rw":          {flag: syscall.MS_RDONLY, clear: true},
+	"noatime":     {flag: syscall.MS_NOATIME},
+	"atime":       {flag: syscall.MS_NOATIME, clear: true},
+	"relatime":    {flag: syscall.MS_RELATIME},
+	"nodiratime":  {flag: syscall.MS_NODIRATIME},
+	"diratime":    {flag: syscall.MS_NODIRATIME, clear: true},
+	"nodev":       {flag: syscall.MS_NODEV},
+	"dev":         {flag: syscall.MS_NODEV, clear: true},
+	"nosuid":      {flag: syscall.MS_NOSUID},
+	"suid":        {flag: syscall.MS_NOSUID, clear: true},
+	"noexec":      {flag: syscall.MS_NOEXEC},
+	"exec":        {flag: syscall.MS_NOEXEC, clear: true},
+	"sync":        {flag: syscall.MS_SYNCHRONOUS},
+	"async":       {flag: syscall.MS_SYNCHRONOUS, clear: true},
+	"dirsync":     {flag: syscall.MS_DIRSYNC},
+	"strictatime": {flag: syscall.MS_STRICTATIME},
+	// defaults is the default of all the flags, it sets none of them
+	"defaults": {},
+}
+
+// ParseMountOptions splits the mount options into the flags of the mount syscall, e.g. "noatime", "nodev" or
+// "nosuid", and the filesystem specific data options, e.g. "discard" or "prjquota". The later option wins.
+func ParseMountOptions(options []string) (uintptr, []string) {
+	var flags uintptr
+	data := make([]string, 0, len(options))
+	for _, option := range options {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		if f, ok := mountFlags[option]; ok {
+			if f.clear {
+				flags &^= f.flag
+			} else {
+				flags |= f.flag
+			}
+			continue
+		}
+		data = append(data, option)
+	}
+	return flags, data
+}
+
+// IsMountOptionsApplied returns true if the filesystem is mounted with the requested options according to the
+// options listed in /proc/mounts. The mount flags have to match exactly, while the data options are only compared
+// with the ones the kernel lists, since the kernel doesn't list the data options that are the defaults of the
+// filesystem, e.g. "user_xattr" of ext4. A data option is not applied if the kernel lists its negation, e.g.
+// "nouser_xattr", or another value of it, e.g. "commit=30" for "commit=5".
+func IsMountOptionsApplied(requested, current []string) bool {
+	requestedFlags, requestedData := getMountFlags(requested)
+	currentFlags, currentData := ParseMountOptions(current)
+	// strictatime isn't listed, it is in effect if the other atime options are not listed
+	if requestedFlags&^syscall.MS_STRICTATIME != currentFlags {
+		return false
+	}
+
+	listed := make(map[string]string, len(currentData))
+	for _, option := range currentData {
+		key, value := splitDataOption(option)
+		listed[key] = value
+	}
+	for _, option := range requestedData {
+		key, value := splitDataOption(option)
+		if current, ok := listed[key]; ok && current != value {
+			return false
+		}
+		if _, ok := listed[negateDataOption(key)]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// splitDataOption splits the data option into its key and value, the value is "" if the option is a boolean one
+func splitDataOption(option string) (string, string) {
+	if i := strings.Index(option, "="); i >= 0 {
+		return option[:i], option[i+1:]
+	}
+	return option, ""
+}
+
+// negateDataOption returns the negation of the boolean data option, e.g. "noacl" of "acl" and vice versa
+func negateDataOption(key string) string {
+	if strings.HasPrefix(key, "no") {
+		return strings.TrimPrefix(key, "no")
+	}
+	return "no" + key
+}
+
+// getMountFlags parses the mount options, the filesystem is mounted with relatime unless another atime option
+// is specified, which is the default of the kernel as well
+func getMountFlags(options []string) (uintptr, []string) {
+	flags, data := ParseMountOptions(options)
+	if flags&syscall.MS_NOATIME != 0 || flags&syscall.MS_STRICTATIME != 0 {
+		flags &^= syscall.MS_RELATIME
+	} else {
+		flags |= syscall.MS_RELATIME
+	}
+	return flags, data
+}
+
+// getMountData returns the data options of the mount syscall, the options of the filesystem profile come first
+// so they can be overridden by the user options
+func getMountData(profile fileSystemProfile, data []string) string {
+	if profile.mountOptions != "" {
+		data = append([]string{profile.mountOptions}, data...)
+	}
+	return strings.Join(data, ",")
+}
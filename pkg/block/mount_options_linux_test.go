@@ -0,0 +1,90 @@
+package block
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestParseMountOptions(t *testing.T) {
+	flags, data := ParseMountOptions([]string{"defaults", "noatime", "nodev", "dev", " discard ", "", "commit=30"})
+	if expected := uintptr(syscall.MS_NOATIME); flags != expected {
+		t.Errorf("expected flags %#x, got %#x", expected, flags)
+	}
+	if expected := []string{"discard", "commit=30"}; !reflect.DeepEqual(data, expected) {
+		t.Errorf("expected data options %v, got %v", expected, data)
+	}
+}
+
+func TestIsMountOptionsApplied(t *testing.T) {
+	// the options of an ext4 filesystem mounted without options as listed in /proc/mounts
+	ext4Defaults := []string{"rw", "relatime"}
+	tests := []struct {
+		name      string
+		requested []string
+		current   []string
+		expected  bool
+	}{
+		{
+			name:     "no options",
+			current:  ext4Defaults,
+			expected: true,
+		},
+		{
+			name:      "defaults",
+			requested: []string{"defaults"},
+			current:   ext4Defaults,
+			expected:  true,
+		},
+		{
+			name:      "default data option not listed by the kernel",
+			requested: []string{"user_xattr"},
+			current:   ext4Defaults,
+			expected:  true,
+		},
+		{
+			name:      "negated data option listed by the kernel",
+			requested: []string{"user_xattr"},
+			current:   []string{"rw", "relatime", "nouser_xattr"},
+			expected:  false,
+		},
+		{
+			name:      "listed data option",
+			requested: []string{"noatime", "discard"},
+			current:   []string{"rw", "noatime", "discard"},
+			expected:  true,
+		},
+		{
+			name:      "changed data option value",
+			requested: []string{"commit=5"},
+			current:   []string{"rw", "relatime", "commit=30"},
+			expected:  false,
+		},
+		{
+			name:      "added flag",
+			requested: []string{"nodev"},
+			current:   ext4Defaults,
+			expected:  false,
+		},
+		{
+			name:      "removed flag",
+			requested: []string{"defaults"},
+			current:   []string{"rw", "nodev", "relatime"},
+			expected:  false,
+		},
+		{
+			name:      "strictatime",
+			requested: []string{"strictatime"},
+			current:   []string{"rw"},
+			expected:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if applied := IsMountOptionsApplied(test.requested, test.current); applied != test.expected {
+				t.Errorf("expected applied %v of %v on %v, got %v", test.expected, test.requested, test.current, applied)
+			}
+		})
+	}
+}
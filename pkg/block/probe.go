@@ -0,0 +1,398 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	SignatureSwap    = "swap"
+	SignatureLUKS    = "crypto_LUKS"
+	SignatureLVM2    = "LVM2_member"
+	SignatureZFS     = "zfs_member"
+	SignatureJournal = "jbd"
+
+	PartitionTableGPT = "gpt"
+	PartitionTableDOS = "dos"
+
+	zfsUberblockMagic  = 0x00bab10c
+	zfsLabelSize       = 256 << 10
+	zfsNVListOffset    = 16 << 10
+	zfsNVListSize      = 112 << 10
+	zfsUberblockOffset = 128 << 10
+	zfsUberblockSize   = 1 << 10
+	zfsTypeUint64      = 8
+	zfsTypeString      = 9
+)
+
+// ProbeResult describes the signatures found on a device, the values are formatted the same as the tags reported by
+// blkid, so they keep matching the identifiers of the existing block devices
+type ProbeResult struct {
+	// the type of the filesystem or the other signature on the device, e.g. "ext4", "xfs", "btrfs", "swap",
+	// "crypto_LUKS", "LVM2_member" or "zfs_member", or "" if no signature is found
+	Type  string
+	UUID  string
+	Label string
+
+	// the type of the partition table on the device, "gpt" or "dos", and the UUID of the partition table
+	PTType string
+	PTUUID string
+
+	// the unique GUIDs of the GPT partitions by the partition number
+	gptPartUUIDs map[int]string
+}
+
+// PartUUID returns the PARTUUID of the partition of the number in the partition table, or "" if it's not found
+func (r *ProbeResult) PartUUID(number int) string {
+	switch r.PTType {
+	case PartitionTableGPT:
+		return r.gptPartUUIDs[number]
+	case PartitionTableDOS:
+		// the PARTUUID of a MBR partition is the disk signature followed by the partition number
+		return fmt.Sprintf("%s-%02x", r.PTUUID, number)
+	}
+	return ""
+}
+
+type superblockProber func(r io.ReaderAt) (*ProbeResult, error)
+
+var superblockProbers = []superblockProber{
+	probeLUKS,
+	probeLVM2,
+	probeXFS,
+	probeExt,
+	probeBtrfs,
+	probeSwap,
+	probeZFS,
+}
+
+// Probe reads the filesystem and partition table signatures of the device in one pass, it replaces calling blkid
+// for each tag of each device
+func Probe(devPath string) (*ProbeResult, error) {
+	f, err := os.Open(devPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ProbeReader(f)
+}
+
+// ProbeReader reads the filesystem and partition table signatures from the content of a device, e.g. an image file
+func ProbeReader(r io.ReaderAt) (*ProbeResult, error) {
+	result := &ProbeResult{}
+	for _, probe := range superblockProbers {
+		found, err := probe(r)
+		if err != nil {
+			return nil, err
+		}
+		if found != nil {
+			result = found
+			break
+		}
+	}
+	if err := probePartitionTable(r, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// readAt reads n bytes at the offset, it returns nil rather than an error if the device is too small, since the
+// signature can't be there
+func readAt(r io.ReaderAt, offset int64, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+func probeExt(r io.ReaderAt) (*ProbeResult, error) {
+	const (
+		compatHasJournal   = 0x0004
+		incompatJournalDev = 0x0008
+		// the features supported by the ext2 and ext3 drivers, the others are only supported by ext4
+		ext2IncompatSupported = 0x0002 | 0x0010
+		ext3IncompatSupported = ext2IncompatSupported | 0x0004
+		roCompatSupported     = 0x0001 | 0x0002 | 0x0004
+	)
+
+	sb, err := readAt(r, 1024, 1024)
+	if err != nil || sb == nil || binary.LittleEndian.Uint16(sb[56:58]) != 0xef53 {
+		return nil, err
+	}
+	compat := binary.LittleEndian.Uint32(sb[92:96])
+	incompat := binary.LittleEndian.Uint32(sb[96:100])
+	roCompat := binary.LittleEndian.Uint32(sb[100:104])
+
+	var fsType string
+	switch {
+	case incompat&incompatJournalDev != 0:
+		fsType = SignatureJournal
+	case incompat&^ext3IncompatSupported != 0 || roCompat&^roCompatSupported != 0:
+		fsType = FileSystemExt4
+	case compat&compatHasJournal != 0:
+		fsType = "ext3"
+	case incompat&^ext2IncompatSupported == 0:
+		fsType = "ext2"
+	default:
+		fsType = FileSystemExt4
+	}
+	return &ProbeResult{
+		Type:  fsType,
+		UUID:  formatUUID(sb[104:120]),
+		Label: cString(sb[120:136]),
+	}, nil
+}
+
+func probeXFS(r io.ReaderAt) (*ProbeResult, error) {
+	sb, err := readAt(r, 0, 120)
+	if err != nil || sb == nil || string(sb[0:4]) != "XFSB" {
+		return nil, err
+	}
+	return &ProbeResult{
+		Type:  FileSystemXFS,
+		UUID:  formatUUID(sb[32:48]),
+		Label: cString(sb[108:120]),
+	}, nil
+}
+
+func probeBtrfs(r io.ReaderAt) (*ProbeResult, error) {
+	sb, err := readAt(r, 64<<10, 0x12b+256)
+	if err != nil || sb == nil || string(sb[0x40:0x48]) != "_BHRfS_M" {
+		return nil, err
+	}
+	return &ProbeResult{
+		Type:  FileSystemBtrfs,
+		UUID:  formatUUID(sb[0x20:0x30]),
+		Label: cString(sb[0x12b : 0x12b+256]),
+	}, nil
+}
+
+// probeSwap looks for the signature at the end of the first page, the page size of the host the swap was created on
+// is unknown so all the common page sizes are tried
+func probeSwap(r io.ReaderAt) (*ProbeResult, error) {
+	for _, pageSize := range []int64{4 << 10, 8 << 10, 16 << 10, 64 << 10} {
+		signature, err := readAt(r, pageSize-10, 10)
+		if err != nil || signature == nil {
+			return nil, err
+		}
+		switch string(signature) {
+		case "SWAP-SPACE":
+			return &ProbeResult{Type: SignatureSwap}, nil
+		case "SWAPSPACE2":
+			header, err := readAt(r, 1024, 44)
+			if err != nil || header == nil {
+				return nil, err
+			}
+			return &ProbeResult{
+				Type:  SignatureSwap,
+				UUID:  formatUUID(header[12:28]),
+				Label: cString(header[28:44]),
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+func probeLUKS(r io.ReaderAt) (*ProbeResult, error) {
+	header, err := readAt(r, 0, 208)
+	if err != nil || header == nil || !bytes.Equal(header[0:6], []byte("LUKS\xba\xbe")) {
+		return nil, err
+	}
+	result := &ProbeResult{
+		Type: SignatureLUKS,
+		UUID: cString(header[168:208]),
+	}
+	// only the LUKS2 header has a label
+	if binary.BigEndian.Uint16(header[6:8]) == 2 {
+		result.Label = cString(header[24:72])
+	}
+	return result, nil
+}
+
+// probeLVM2 looks for the LVM2 label in the first four sectors, the PV UUID is formatted the same as by the LVM tools
+func probeLVM2(r io.ReaderAt) (*ProbeResult, error) {
+	for sector := int64(0); sector < 4; sector++ {
+		label, err := readAt(r, sector*512, 32)
+		if err != nil || label == nil {
+			return nil, err
+		}
+		if string(label[0:8]) != "LABELONE" || string(label[24:32]) != "LVM2 001" {
+			continue
+		}
+		offset := int64(binary.LittleEndian.Uint32(label[20:24]))
+		id, err := readAt(r, sector*512+offset, 32)
+		if err != nil || id == nil {
+			return nil, err
+		}
+		uuid := string(id)
+		return &ProbeResult{
+			Type: SignatureLVM2,
+			UUID: strings.Join([]string{uuid[0:6], uuid[6:10], uuid[10:14], uuid[14:18], uuid[18:22], uuid[22:26],
+				uuid[26:32]}, "-"),
+		}, nil
+	}
+	return nil, nil
+}
+
+// probeZFS looks for the uberblocks in the first two vdev labels, the pool name and GUID are read from the nvlist of
+// the label, which reports the GUID in decimal as blkid does
+func probeZFS(r io.ReaderAt) (*ProbeResult, error) {
+	for _, labelOffset := range []int64{0, zfsLabelSize} {
+		uberblocks, err := readAt(r, labelOffset+zfsUberblockOffset, zfsLabelSize-zfsUberblockOffset)
+		if err != nil || uberblocks == nil {
+			return nil, err
+		}
+		found := false
+		for i := 0; i+8 <= len(uberblocks); i += zfsUberblockSize {
+			if binary.LittleEndian.Uint64(uberblocks[i:]) == zfsUberblockMagic ||
+				binary.BigEndian.Uint64(uberblocks[i:]) == zfsUberblockMagic {
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+
+		result := &ProbeResult{Type: SignatureZFS}
+		nvlist, err := readAt(r, labelOffset+zfsNVListOffset, zfsNVListSize)
+		if err != nil {
+			return nil, err
+		}
+		pairs := parseXDRNVList(nvlist)
+		if name, ok := pairs["name"].(string); ok {
+			result.Label = name
+		}
+		if guid, ok := pairs["pool_guid"].(uint64); ok {
+			result.UUID = fmt.Sprintf("%d", guid)
+		}
+		return result, nil
+	}
+	return nil, nil
+}
+
+// parseXDRNVList returns the string and uint64 pairs at the top level of the XDR encoded nvlist, the parsing stops at
+// the first malformed pair
+func parseXDRNVList(buf []byte) map[string]interface{} {
+	pairs := make(map[string]interface{})
+	// the encoding and endian bytes, then the version and flags of the nvlist
+	if len(buf) < 12 || buf[0] != 1 {
+		return pairs
+	}
+	readString := func(b []byte) (string, bool) {
+		if len(b) < 4 {
+			return "", false
+		}
+		n := int(binary.BigEndian.Uint32(b))
+		if n > len(b)-4 {
+			return "", false
+		}
+		return string(b[4 : 4+n]), true
+	}
+
+	for pos := 12; pos+8 <= len(buf); {
+		size := int(binary.BigEndian.Uint32(buf[pos:]))
+		if size <= 0 || pos+size > len(buf) {
+			break
+		}
+		pair := buf[pos+8 : pos+size]
+		pos += size
+
+		name, ok := readString(pair)
+		if !ok {
+			break
+		}
+		valuePos := 4 + (len(name)+3)&^3
+		if valuePos+8 > len(pair) {
+			break
+		}
+		dataType := binary.BigEndian.Uint32(pair[valuePos:])
+		value := pair[valuePos+8:]
+		switch dataType {
+		case zfsTypeUint64:
+			if len(value) >= 8 {
+				pairs[name] = binary.BigEndian.Uint64(value)
+			}
+		case zfsTypeString:
+			if s, ok := readString(value); ok {
+				pairs[name] = s
+			}
+		}
+	}
+	return pairs
+}
+
+// probePartitionTable reads the GPT partition table, or the MBR partition table if the device has no filesystem,
+// since the boot sector of some filesystems has the MBR signature as well
+func probePartitionTable(r io.ReaderAt, result *ProbeResult) error {
+	for _, sectorSize := range []uint64{512, 4096} {
+		entries, err := readGPTEntries(r, sectorSize)
+		if err != nil {
+			continue
+		}
+		header, err := readAt(r, int64(sectorSize), gptHeaderSize)
+		if err != nil || header == nil {
+			return err
+		}
+		var diskGUID [16]byte
+		copy(diskGUID[:], header[56:72])
+		result.PTType = PartitionTableGPT
+		result.PTUUID = formatGUID(diskGUID)
+		result.gptPartUUIDs = make(map[int]string, len(entries))
+		for _, entry := range entries {
+			result.gptPartUUIDs[entry.number] = formatGUID(entry.uniqueGUID)
+		}
+		return nil
+	}
+
+	if result.Type != "" {
+		return nil
+	}
+	mbr, err := readAt(r, 0, 512)
+	if err != nil || mbr == nil || mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return err
+	}
+	for i := 0; i < 4; i++ {
+		entry := mbr[446+i*16 : 446+(i+1)*16]
+		// the boot indicator is invalid in the boot sector of a filesystem, and the protective MBR of a GPT partition
+		// table without a valid GPT header is ignored as blkid does
+		if (entry[0] != 0 && entry[0] != 0x80) || entry[4] == 0xee {
+			return nil
+		}
+	}
+	result.PTType = PartitionTableDOS
+	result.PTUUID = fmt.Sprintf("%08x", binary.LittleEndian.Uint32(mbr[440:444]))
+	return nil
+}
+
+// formatUUID formats the UUID stored in byte order, e.g. by the filesystems, or returns "" if it's all zeros
+func formatUUID(b []byte) string {
+	if bytes.Equal(b, make([]byte, len(b))) {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// formatGUID formats the GUID stored in the mixed-endian format of GPT, it's the reverse of parseGUID
+func formatGUID(guid [16]byte) string {
+	reverse(guid[0:4])
+	reverse(guid[4:6])
+	reverse(guid[6:8])
+	return formatUUID(guid[:])
+}
+
+// cString returns the string before the first null byte
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimSpace(string(b))
+}
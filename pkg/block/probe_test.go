@@ -0,0 +1,275 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// image is an in-memory device of the size, the signatures are written at the offsets
+type image []byte
+
+func newImage(size int) image {
+	return make(image, size)
+}
+
+func (img image) put(offset int, data []byte) image {
+	copy(img[offset:], data)
+	return img
+}
+
+func (img image) putUint32(offset int, order binary.ByteOrder, v uint32) image {
+	order.PutUint32(img[offset:], v)
+	return img
+}
+
+var testUUID = []byte{0x5b, 0x7e, 0x3c, 0x1d, 0x2a, 0x4f, 0x4b, 0x6e, 0x8d, 0x9c, 0x1e, 0x2f, 0x3a, 0x4b, 0x5c, 0x6d}
+
+const testUUIDString = "5b7e3c1d-2a4f-4b6e-8d9c-1e2f3a4b5c6d"
+
+// xdrPair encodes a pair of the XDR nvlist of the ZFS label
+func xdrPair(name string, dataType uint32, value []byte) []byte {
+	var pair bytes.Buffer
+	pair.Write(xdrString(name))
+	binary.Write(&pair, binary.BigEndian, dataType)
+	binary.Write(&pair, binary.BigEndian, uint32(1))
+	pair.Write(value)
+
+	var encoded bytes.Buffer
+	binary.Write(&encoded, binary.BigEndian, uint32(pair.Len()+8))
+	binary.Write(&encoded, binary.BigEndian, uint32(0))
+	encoded.Write(pair.Bytes())
+	return encoded.Bytes()
+}
+
+func xdrString(s string) []byte {
+	b := make([]byte, 4+(len(s)+3)&^3)
+	binary.BigEndian.PutUint32(b, uint32(len(s)))
+	copy(b[4:], s)
+	return b
+}
+
+func zfsImage() image {
+	guid := make([]byte, 8)
+	binary.BigEndian.PutUint64(guid, 1234567890123456789)
+	var nvlist bytes.Buffer
+	nvlist.Write([]byte{1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1})
+	nvlist.Write(xdrPair("version", zfsTypeUint64, make([]byte, 8)))
+	nvlist.Write(xdrPair("name", zfsTypeString, xdrString("tank")))
+	nvlist.Write(xdrPair("pool_guid", zfsTypeUint64, guid))
+	nvlist.Write(make([]byte, 8))
+
+	img := newImage(2 * zfsLabelSize)
+	img.put(zfsNVListOffset, nvlist.Bytes())
+	binary.LittleEndian.PutUint64(img[zfsUberblockOffset+3*zfsUberblockSize:], zfsUberblockMagic)
+	return img
+}
+
+// extImage returns an image of the ext superblock of the feature flags
+func extImage(compat, incompat, roCompat uint32) image {
+	img := newImage(1<<20).put(1024+56, []byte{0x53, 0xef}).put(1024+104, testUUID).put(1024+120, []byte("longhorn"))
+	return img.putUint32(1024+92, binary.LittleEndian, compat).putUint32(1024+96, binary.LittleEndian, incompat).
+		putUint32(1024+100, binary.LittleEndian, roCompat)
+}
+
+// swapImage returns an image of the swap of the version signature created on a host of the page size
+func swapImage(pageSize int, signature string) image {
+	return newImage(128<<10).put(1024+12, testUUID).put(1024+28, []byte("longhorn")).put(pageSize-10, []byte(signature))
+}
+
+// gptImage returns an image of the GPT partition table of the sector size with the disk GUID and the unique GUIDs
+// of the partitions
+func gptImage(t *testing.T, sectorSize uint64, diskGUID string, partUUIDs ...string) image {
+	t.Helper()
+	partitions := make([]GPTPartition, len(partUUIDs))
+	for i := range partitions[:len(partitions)-1] {
+		partitions[i].SizeBytes = 1 << 20
+	}
+	img := newImage(8 << 20)
+	layout, err := planGPTLayout(uint64(len(img)), sectorSize, partitions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, partUUID := range partUUIDs {
+		if layout.entries[i].uniqueGUID, err = parseGUID(partUUID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	guid, err := parseGUID(diskGUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := layout.write(bytesWriterAt(img), guid); err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+type bytesWriterAt []byte
+
+func (b bytesWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return copy(b[off:], p), nil
+}
+
+// mbrImage returns an image of the MBR partition table of the disk signature with a partition of the boot indicator
+func mbrImage(signature uint32, bootIndicator byte) image {
+	img := newImage(1<<20).putUint32(440, binary.LittleEndian, signature).put(510, []byte{0x55, 0xaa})
+	return img.put(446, []byte{bootIndicator, 0x20, 0x21, 0x00, 0x83, 0xfe, 0xff, 0xff}).
+		putUint32(446+8, binary.LittleEndian, 2048).putUint32(446+12, binary.LittleEndian, 2046)
+}
+
+func TestProbeReader(t *testing.T) {
+	tests := []struct {
+		name      string
+		image     image
+		expected  ProbeResult
+		partUUIDs map[int]string
+	}{
+		{
+			name:  "blank",
+			image: newImage(1 << 20),
+		},
+		{
+			name:  "too small",
+			image: newImage(512),
+		},
+		{
+			name:     "ext2",
+			image:    extImage(0x0038, 0x0002, 0x0003),
+			expected: ProbeResult{Type: "ext2", UUID: testUUIDString, Label: "longhorn"},
+		},
+		{
+			name:     "ext3",
+			image:    extImage(0x003c, 0x0002, 0x0003),
+			expected: ProbeResult{Type: "ext3", UUID: testUUIDString, Label: "longhorn"},
+		},
+		{
+			// the journal recovery flag of an uncleanly unmounted ext3 is supported by the ext3 driver
+			name:     "ext3 needing recovery",
+			image:    extImage(0x003c, 0x0006, 0x0003),
+			expected: ProbeResult{Type: "ext3", UUID: testUUIDString, Label: "longhorn"},
+		},
+		{
+			// mkfs.ext4 enables the extents, 64bit and flex_bg features and the huge_file and dir_nlink ones
+			name:     "ext4",
+			image:    extImage(0x003c, 0x02c2, 0x007b),
+			expected: ProbeResult{Type: FileSystemExt4, UUID: testUUIDString, Label: "longhorn"},
+		},
+		{
+			name:     "ext4 of ext3 features with metadata_csum",
+			image:    extImage(0x003c, 0x0002, 0x0403),
+			expected: ProbeResult{Type: FileSystemExt4, UUID: testUUIDString, Label: "longhorn"},
+		},
+		{
+			name:     "ext4 without journal",
+			image:    extImage(0x0038, 0x0242, 0x0003),
+			expected: ProbeResult{Type: FileSystemExt4, UUID: testUUIDString, Label: "longhorn"},
+		},
+		{
+			name:     "external ext journal",
+			image:    extImage(0x0000, 0x0008, 0x0000),
+			expected: ProbeResult{Type: SignatureJournal, UUID: testUUIDString, Label: "longhorn"},
+		},
+		{
+			name:     "xfs",
+			image:    newImage(1<<20).put(0, []byte("XFSB")).put(32, testUUID).put(108, []byte("longhorn")),
+			expected: ProbeResult{Type: FileSystemXFS, UUID: testUUIDString, Label: "longhorn"},
+		},
+		{
+			name:     "swap v1",
+			image:    swapImage(4<<10, "SWAP-SPACE"),
+			expected: ProbeResult{Type: SignatureSwap},
+		},
+		{
+			name:     "swap v2 of 4K pages",
+			image:    swapImage(4<<10, "SWAPSPACE2"),
+			expected: ProbeResult{Type: SignatureSwap, UUID: testUUIDString, Label: "longhorn"},
+		},
+		{
+			name:     "swap v2 of 64K pages",
+			image:    swapImage(64<<10, "SWAPSPACE2"),
+			expected: ProbeResult{Type: SignatureSwap, UUID: testUUIDString, Label: "longhorn"},
+		},
+		{
+			name: "GPT",
+			image: gptImage(t, 512, "6a3a2a1e-4f3b-4c1d-9e2f-0a1b2c3d4e5f",
+				"0c7a1e2d-3b4c-4d5e-8f60-718293a4b5c6", "1d8b2f3e-4c5d-4e6f-9071-8293a4b5c6d7"),
+			expected: ProbeResult{PTType: PartitionTableGPT, PTUUID: "6a3a2a1e-4f3b-4c1d-9e2f-0a1b2c3d4e5f"},
+			partUUIDs: map[int]string{
+				1: "0c7a1e2d-3b4c-4d5e-8f60-718293a4b5c6",
+				2: "1d8b2f3e-4c5d-4e6f-9071-8293a4b5c6d7",
+				3: "",
+			},
+		},
+		{
+			name:      "GPT of 4096-byte sectors",
+			image:     gptImage(t, 4096, "6a3a2a1e-4f3b-4c1d-9e2f-0a1b2c3d4e5f", "0c7a1e2d-3b4c-4d5e-8f60-718293a4b5c6"),
+			expected:  ProbeResult{PTType: PartitionTableGPT, PTUUID: "6a3a2a1e-4f3b-4c1d-9e2f-0a1b2c3d4e5f"},
+			partUUIDs: map[int]string{1: "0c7a1e2d-3b4c-4d5e-8f60-718293a4b5c6"},
+		},
+		{
+			name:      "MBR",
+			image:     mbrImage(0x1a2b3c4d, 0x80),
+			expected:  ProbeResult{PTType: PartitionTableDOS, PTUUID: "1a2b3c4d"},
+			partUUIDs: map[int]string{1: "1a2b3c4d-01", 2: "1a2b3c4d-02"},
+		},
+		{
+			// the protective MBR of a GPT partition table is ignored once the GPT header is gone
+			name:  "protective MBR without GPT",
+			image: mbrImage(0, 0x00).put(446+4, []byte{0xee}),
+		},
+		{
+			name: "btrfs",
+			image: newImage(1<<20).put(64<<10+0x20, testUUID).put(64<<10+0x40, []byte("_BHRfS_M")).
+				put(64<<10+0x12b, []byte("longhorn")),
+			expected: ProbeResult{Type: FileSystemBtrfs, UUID: testUUIDString, Label: "longhorn"},
+		},
+		{
+			name: "LUKS1",
+			image: newImage(4096).put(0, []byte("LUKS\xba\xbe\x00\x01")).put(24, []byte("aes")).
+				put(168, []byte(testUUIDString)),
+			expected: ProbeResult{Type: SignatureLUKS, UUID: testUUIDString},
+		},
+		{
+			name: "LUKS2",
+			image: newImage(4096).put(0, []byte("LUKS\xba\xbe\x00\x02")).put(24, []byte("secret")).
+				put(168, []byte(testUUIDString)),
+			expected: ProbeResult{Type: SignatureLUKS, UUID: testUUIDString, Label: "secret"},
+		},
+		{
+			name: "LVM2 PV",
+			image: newImage(4096).put(512, []byte("LABELONE")).putUint32(512+20, binary.LittleEndian, 32).
+				put(512+24, []byte("LVM2 001")).put(512+32, []byte("f3RXqhQOCCMd7xZY8TdsbPVcJ3qPrY1w")),
+			expected: ProbeResult{Type: SignatureLVM2, UUID: "f3RXqh-QOCC-Md7x-ZY8T-dsbP-VcJ3-qPrY1w"},
+		},
+		{
+			name:     "ZFS",
+			image:    zfsImage(),
+			expected: ProbeResult{Type: SignatureZFS, UUID: "1234567890123456789", Label: "tank"},
+		},
+		{
+			// the boot sector of a filesystem has the MBR signature, but the boot indicators are invalid
+			name:  "boot sector",
+			image: newImage(4096).put(446, []byte{0xeb, 0x58, 0x90}).put(510, []byte{0x55, 0xaa}),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := ProbeReader(bytes.NewReader(test.image))
+			if err != nil {
+				t.Fatalf("failed to probe, error: %s", err.Error())
+			}
+			for number, partUUID := range test.partUUIDs {
+				if got := result.PartUUID(number); got != partUUID {
+					t.Errorf("expected PARTUUID %q of partition %d, got %q", partUUID, number, got)
+				}
+			}
+			result.gptPartUUIDs = nil
+			if !reflect.DeepEqual(*result, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, *result)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package block
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/jaypipes/ghw/pkg/linuxpath"
+)
+
+const (
+	VirtualKindLVM   = "lvm"
+	VirtualKindCrypt = "crypt"
+	VirtualKindMpath = "mpath"
+	VirtualKindDM    = "dm"
+)
+
+// Topology describes the relationships between the device and the virtual devices, e.g. device-mapper, LVM, MD RAID
+// and multipath devices
+type Topology struct {
+	// the devices built on top of the device, e.g. the LVM logical volumes of a physical volume
+	Holders []Holder `json:"holders"`
+	// the kernel names of the devices the virtual device is built on
+	Slaves []string `json:"slaves"`
+	// the kind of the virtual device, see getVirtualKind
+	Kind   string `json:"kind"`
+	DMName string `json:"dm_name"`
+	DMUUID string `json:"dm_uuid"`
+}
+
+// Holder describes a device that holds the device
+type Holder struct {
+	Name   string `json:"name"`
+	DMName string `json:"dm_name"`
+	Kind   string `json:"kind"`
+}
+
+// IsMultipathMember returns true if the device is one of the paths of a multipath device, which must only be used
+// through the multipath device, and all of its paths share the identifiers of the LUN, e.g. the WWN
+func (t Topology) IsMultipathMember() bool {
+	for _, holder := range t.Holders {
+		if holder.Kind == VirtualKindMpath {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceTopology reads the holders, slaves, dm and md attributes from the sysfs directory of the disk or partition
+func deviceTopology(paths *linuxpath.Paths, sysPath string) Topology {
+	topology := Topology{
+		Holders: make([]Holder, 0),
+		Slaves:  listDir(filepath.Join(sysPath, "slaves")),
+		DMName:  readSysAttr(filepath.Join(sysPath, "dm", "name")),
+		DMUUID:  readSysAttr(filepath.Join(sysPath, "dm", "uuid")),
+	}
+	topology.Kind = getVirtualKind(topology.DMUUID, readSysAttr(filepath.Join(sysPath, "md", "level")))
+
+	for _, name := range listDir(filepath.Join(sysPath, "holders")) {
+		holderPath := filepath.Join(paths.SysBlock, name)
+		dmUUID := readSysAttr(filepath.Join(holderPath, "dm", "uuid"))
+		topology.Holders = append(topology.Holders, Holder{
+			Name:   name,
+			DMName: readSysAttr(filepath.Join(holderPath, "dm", "name")),
+			Kind:   getVirtualKind(dmUUID, readSysAttr(filepath.Join(holderPath, "md", "level"))),
+		})
+	}
+	return topology
+}
+
+// getVirtualKind returns the kind of the virtual device, which is the RAID level, e.g. "raid1", of an MD device, or
+// the subsystem prefix of the dm uuid, e.g. "LVM-" or "CRYPT-", of a device-mapper device
+func getVirtualKind(dmUUID, mdLevel string) string {
+	if mdLevel != "" {
+		return mdLevel
+	}
+	switch {
+	case dmUUID == "":
+		return ""
+	case strings.HasPrefix(dmUUID, "LVM-"):
+		return VirtualKindLVM
+	case strings.HasPrefix(dmUUID, "CRYPT-"):
+		return VirtualKindCrypt
+	case strings.HasPrefix(dmUUID, "mpath-"):
+		return VirtualKindMpath
+	}
+	return VirtualKindDM
+}
+
+func listDir(path string) []string {
+	names := make([]string, 0)
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return names
+	}
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	return names
+}
+
+func readSysAttr(path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
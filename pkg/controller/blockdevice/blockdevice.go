@@ -2,7 +2,9 @@ package blockdevice
 
 import (
 	"fmt"
+	"strings"
 
+	ghwutil "github.com/jaypipes/ghw/pkg/util"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
@@ -19,13 +21,14 @@ func GetNewBlockDevices(disk *block.Disk, nodeName, namespace string) []*longhor
 	bdList := make([]*longhornv1.BlockDevice, 0)
 	partitioned := len(disk.Partitions) > 0
 	fileSystemInfo := longhornv1.FilesystemStatus{
-		MountPoint: disk.FileSystemInfo.MountPoint,
-		Type:       disk.FileSystemInfo.FsType,
-		IsReadOnly: disk.FileSystemInfo.IsReadOnly,
+		MountPoint:   disk.FileSystemInfo.MountPoint,
+		Type:         disk.FileSystemInfo.FsType,
+		IsReadOnly:   disk.FileSystemInfo.IsReadOnly,
+		MountOptions: disk.FileSystemInfo.MountOptions,
 	}
 	parent := &longhornv1.BlockDevice{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      util.GetBlockDeviceName(disk.Name, nodeName),
+			Name:      util.GetBlockDeviceName(GetDiskIdentifier(disk), nodeName),
 			Namespace: namespace,
 			Labels: map[string]string{
 				v1.LabelHostname: nodeName,
@@ -53,14 +56,19 @@ func GetNewBlockDevices(disk *block.Disk, nodeName, namespace string) []*longhor
 					StorageController: disk.StorageController.String(),
 					UUID:              disk.UUID,
 					PtUUID:            disk.PtUUID,
+					Label:             disk.Label,
 					BusPath:           disk.BusPath,
 					Model:             disk.Model,
 					Vendor:            disk.Vendor,
 					SerialNumber:      disk.SerialNumber,
 					NUMANodeID:        disk.NUMANodeID,
+					PCIAddress:        disk.PCIAddress,
+					PCIeLinkWidth:     disk.PCIeLinkWidth,
+					PCIeLinkSpeed:     disk.PCIeLinkSpeed,
 					WWN:               disk.WWN,
 				},
 				FileSystem: fileSystemInfo,
+				Topology:   getDeviceTopology(disk.Topology),
 			},
 		},
 	}
@@ -73,14 +81,15 @@ func GetPartitionBlockDevices(partitions []*block.Partition, parentDisk *longhor
 	blockDevices := make([]*longhornv1.BlockDevice, 0, len(partitions))
 	for _, part := range partitions {
 		fileSystemInfo := longhornv1.FilesystemStatus{
-			Type:       part.FileSystemInfo.FsType,
-			MountPoint: part.FileSystemInfo.MountPoint,
-			IsReadOnly: part.FileSystemInfo.IsReadOnly,
+			Type:         part.FileSystemInfo.FsType,
+			MountPoint:   part.FileSystemInfo.MountPoint,
+			IsReadOnly:   part.FileSystemInfo.IsReadOnly,
+			MountOptions: part.FileSystemInfo.MountOptions,
 		}
 		diskCpy := parentDisk.DeepCopy()
 		diskCpy.Labels[ParentDeviceLabel] = parentDisk.Name
 		diskCpy.Spec.DevPath = getFullDevPath(part.Name)
-		diskCpy.Name = util.GetBlockDeviceName(part.Name, nodeName)
+		diskCpy.Name = util.GetBlockDeviceName(GetPartitionIdentifier(part), nodeName)
 		diskCpy.Spec.FileSystem.MountPoint = part.FileSystemInfo.MountPoint
 		diskCpy.Status.DeviceStatus.Partitioned = false
 		diskCpy.Status.DeviceStatus.ParentDevice = parentDisk.Spec.DevPath
@@ -88,12 +97,80 @@ func GetPartitionBlockDevices(partitions []*block.Partition, parentDisk *longhor
 		diskCpy.Status.DeviceStatus.Capacity.SizeBytes = part.SizeBytes
 		diskCpy.Status.DeviceStatus.Details.Label = part.Label
 		diskCpy.Status.DeviceStatus.Details.PartUUID = part.UUID
+		diskCpy.Status.DeviceStatus.Details.UUID = part.FsUUID
 		diskCpy.Status.DeviceStatus.FileSystem = fileSystemInfo
+		diskCpy.Status.DeviceStatus.Topology = getDeviceTopology(part.Topology)
 		blockDevices = append(blockDevices, diskCpy)
 	}
 	return blockDevices
 }
 
+func getDeviceTopology(topology block.Topology) longhornv1.DeviceTopology {
+	deviceTopology := longhornv1.DeviceTopology{
+		VirtualKind: topology.Kind,
+		DMName:      topology.DMName,
+		DMUUID:      topology.DMUUID,
+	}
+	if len(topology.Slaves) > 0 {
+		deviceTopology.Slaves = topology.Slaves
+	}
+	for _, holder := range topology.Holders {
+		deviceTopology.Holders = append(deviceTopology.Holders, longhornv1.DeviceHolder{
+			Name:   holder.Name,
+			DMName: holder.DMName,
+			Kind:   holder.Kind,
+		})
+	}
+	return deviceTopology
+}
+
+// GetDiskIdentifier returns a stable identifier of the disk which survives reboots and the re-enumeration
+// of the kernel device names. The identifier is picked in the following order:
+//  1. the World Wide Name(WWN)
+//  2. the model and serial number
+//  3. the device-mapper UUID, e.g. "mpath-<wwid>" of a multipath device or "LVM-<uuid>" of a logical volume
+//  4. the bus path, i.e. the physical port the disk is attached to
+//  5. the UUID of the partition table(PTUUID), which is the last resort as it's erased by wiping the disk and
+//     regenerated by partitioning it
+//  6. the kernel device name, which is the only option left for a blank virtual disk
+//
+// The paths of a multipath device share the identifiers of the LUN, so they are not registered as block devices,
+// see block.Topology.IsMultipathMember.
+func GetDiskIdentifier(disk *block.Disk) string {
+	if isKnown(disk.WWN) {
+		return "wwn:" + disk.WWN
+	}
+	if isKnown(disk.SerialNumber) {
+		return fmt.Sprintf("serial:%s/%s", disk.Model, disk.SerialNumber)
+	}
+	if isKnown(disk.Topology.DMUUID) {
+		return "dmuuid:" + disk.Topology.DMUUID
+	}
+	if isKnown(disk.BusPath) {
+		return "buspath:" + disk.BusPath
+	}
+	if isKnown(disk.PtUUID) {
+		return "ptuuid:" + disk.PtUUID
+	}
+	return "name:" + disk.Name
+}
+
+// GetPartitionIdentifier returns a stable identifier of the partition, which is the PARTUUID of the partition,
+// or the identifier of the parent disk suffixed with the partition number, e.g. "1" of sda1 or "p1" of nvme0n1p1
+func GetPartitionIdentifier(part *block.Partition) string {
+	if isKnown(part.UUID) {
+		return "partuuid:" + part.UUID
+	}
+	if part.Disk == nil {
+		return "name:" + part.Name
+	}
+	return fmt.Sprintf("%s/part:%s", GetDiskIdentifier(part.Disk), strings.TrimPrefix(part.Name, part.Disk.Name))
+}
+
+func isKnown(value string) bool {
+	return value != "" && value != ghwutil.UNKNOWN
+}
+
 func getFullDevPath(shortPath string) string {
 	if shortPath == "" {
 		return ""
@@ -2,27 +2,33 @@ package blockdevice
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"reflect"
 	"strings"
 	"time"
 
-	lhutil "github.com/longhorn/longhorn-manager/util"
 	"github.com/sirupsen/logrus"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
 
 	diskv1 "github.com/longhorn/node-disk-manager/pkg/apis/longhorn.io/v1beta1"
 	"github.com/longhorn/node-disk-manager/pkg/block"
+	"github.com/longhorn/node-disk-manager/pkg/filter"
 	ctldiskv1 "github.com/longhorn/node-disk-manager/pkg/generated/controllers/longhorn.io/v1beta1"
 	"github.com/longhorn/node-disk-manager/pkg/option"
+	"github.com/longhorn/node-disk-manager/pkg/persistence"
 	"github.com/longhorn/node-disk-manager/pkg/util"
 )
 
 const (
 	blockDeviceHandlerName = "longhorn-block-device-handler"
+
+	// unmountRetryInterval is the interval to retry unmounting a busy device
+	unmountRetryInterval = 30 * time.Second
+	// evictionWaitInterval is the interval to check whether the Longhorn disk on the mount point is removed
+	evictionWaitInterval = 10 * time.Second
 )
 
 type Controller struct {
@@ -31,45 +37,75 @@ type Controller struct {
 
 	Blockdevices     ctldiskv1.BlockDeviceController
 	BlockdeviceCache ctldiskv1.BlockDeviceCache
+	Host             block.Host
 	BlockInfo        *block.Info
+	Filter           *filter.DeviceFilter
+
+	vanishedDevicePolicy string
+	persister            persistence.Persister
 }
 
-// Register register the block device CRD controller
-func Register(ctx context.Context, blockdevices ctldiskv1.BlockDeviceController, block *block.Info, opt *option.Option) error {
+// NewController returns the block device controller of the node, the devices and mounts are operated through the host
+func NewController(blockdevices ctldiskv1.BlockDeviceController, host block.Host, block *block.Info,
+	filter *filter.DeviceFilter, opt *option.Option) (*Controller, error) {
 	controller := &Controller{
 		namespace:        opt.Namespace,
 		nodeName:         opt.NodeName,
 		Blockdevices:     blockdevices,
 		BlockdeviceCache: blockdevices.Cache(),
+		Host:             host,
 		BlockInfo:        block,
+		Filter:           filter,
+
+		vanishedDevicePolicy: opt.VanishedDevicePolicy,
+	}
+
+	switch controller.vanishedDevicePolicy {
+	case VanishedDevicePolicyInactive, VanishedDevicePolicyDelete:
+	default:
+		return nil, fmt.Errorf("unknown vanished device policy %q", controller.vanishedDevicePolicy)
+	}
+
+	persister, err := persistence.New(opt.MountPersistence, opt.MountPersistencePath)
+	if err != nil {
+		return nil, err
+	}
+	controller.persister = persister
+	return controller, nil
+}
+
+// Register register the block device CRD controller
+func Register(ctx context.Context, blockdevices ctldiskv1.BlockDeviceController, host block.Host, block *block.Info,
+	filter *filter.DeviceFilter, opt *option.Option) error {
+	controller, err := NewController(blockdevices, host, block, filter, opt)
+	if err != nil {
+		return err
+	}
+
+	if err := controller.migrateLegacyBlockDevices(); err != nil {
+		return fmt.Errorf("failed to migrate the legacy block devices, error: %w", err)
 	}
 
 	if err := controller.RegisterNodeBlockDevices(); err != nil {
 		return err
 	}
 
+	if err := controller.reconcilePersistedMounts(); err != nil {
+		return fmt.Errorf("failed to reconcile the persisted mounts, error: %w", err)
+	}
+
+	if opt.RescanInterval > 0 {
+		go controller.runPeriodicRescan(ctx, opt.RescanInterval)
+	}
+
 	blockdevices.OnChange(ctx, blockDeviceHandlerName, controller.OnBlockDeviceChange)
-	blockdevices.OnRemove(ctx, blockDeviceHandlerName, controller.OnBlockDeviceDelete)
 	return nil
 }
 
 // RegisterNodeBlockDevices will scan the block devices on the node, and it will either create or update the block device
 func (c *Controller) RegisterNodeBlockDevices() error {
 	logrus.Infof("Register block devices of node: %s", c.nodeName)
-	bds := make([]*diskv1.BlockDevice, 0)
-
-	// list all the block devices
-	for _, disk := range c.BlockInfo.Disks {
-		// ignore block device that is created by the Longhorn
-		if util.IsLonghornBlockDevice(disk.BusPath) {
-			logrus.Debugf("Skip longhorn disk, %s", disk.Name)
-			continue
-		}
-
-		logrus.Infof("Found a block device %s", disk.Name)
-		blockDevices := GetNewBlockDevices(disk, c.nodeName, c.namespace)
-		bds = append(bds, blockDevices...)
-	}
+	bds := c.scanBlockDevices(c.BlockInfo)
 
 	bdList, err := c.Blockdevices.List(c.namespace, v1.ListOptions{})
 	if err != nil {
@@ -85,39 +121,150 @@ func (c *Controller) RegisterNodeBlockDevices() error {
 	return nil
 }
 
+// scanBlockDevices returns the block devices of the disks and partitions of the node that pass the device filter
+func (c *Controller) scanBlockDevices(info *block.Info) []*diskv1.BlockDevice {
+	bds := make([]*diskv1.BlockDevice, 0)
+	names := make(map[string]string)
+
+	// list all the block devices
+	for _, disk := range info.Disks {
+		// ignore block device that is created by the Longhorn
+		if util.IsLonghornBlockDevice(disk.BusPath) {
+			logrus.Debugf("Skip longhorn disk, %s", disk.Name)
+			continue
+		}
+
+		if !c.Filter.Match(disk) {
+			logrus.Debugf("Skip disk %s that is filtered out", disk.Name)
+			continue
+		}
+
+		if disk.Topology.IsMultipathMember() {
+			logrus.Debugf("Skip disk %s that is a path of a multipath device", disk.Name)
+			continue
+		}
+
+		logrus.Infof("Found a block device %s", disk.Name)
+		for _, bd := range GetNewBlockDevices(disk, c.nodeName, c.namespace) {
+			// the devices sharing an identifier, e.g. the paths of a LUN before multipath assembles them, would
+			// relink the same block device back and forth, only the first one is registered
+			if devPath, ok := names[bd.Name]; ok {
+				logrus.Warnf("Skip device %s, it has the same identifier as %s", bd.Spec.DevPath, devPath)
+				continue
+			}
+			names[bd.Name] = bd.Spec.DevPath
+			bds = append(bds, bd)
+		}
+	}
+	return bds
+}
+
 // OnBlockDeviceChange watch the block device CR on change and performing disk operations
-// like mounting the disks to a desired folder via ext4
+// like formatting and mounting the disks to a desired folder
 func (c *Controller) OnBlockDeviceChange(key string, device *diskv1.BlockDevice) (*diskv1.BlockDevice, error) {
-	if device == nil || device.DeletionTimestamp != nil {
+	// the block devices of the other nodes are handled by their own controllers
+	if device == nil || device.Spec.NodeName != c.nodeName {
 		return device, nil
 	}
 
-	if device.Spec.FileSystem.MountPoint == "" {
-		return device, nil
+	if device.DeletionTimestamp != nil {
+		return c.finalizeBlockDevice(device)
+	}
+
+	device, err := c.ensureFinalizerAndOwner(device)
+	if err != nil {
+		return device, err
+	}
+
+	if device.Spec.PartitionTable != nil {
+		return c.reconcilePartitionTable(device)
 	}
 
 	deviceCpy := device.DeepCopy()
 	fs := deviceCpy.Spec.FileSystem
 	fsStatus := deviceCpy.Status.DeviceStatus.FileSystem
+	mountPoint := getSpecMountPoint(fs)
+
+	// release the current mount point if the specified one is cleared or changed, the device mounted outside of the
+	// controller is left alone
+	if fsStatus.MountPoint != "" && fsStatus.MountPoint != mountPoint && fsStatus.MountPoint == fsStatus.AppliedMountPoint {
+		// the Longhorn disk on the current mount point must be evicted and removed first, the node controller drops
+		// the finalizer once it's removed. The condition is not checked as it isn't reset once the disk is registered
+		// again.
+		if util.HasFinalizer(deviceCpy, LonghornDiskFinalizer) {
+			diskv1.DeviceMounted.SetStatusBool(deviceCpy, true)
+			diskv1.DeviceMounted.Reason(deviceCpy, "WaitingForEviction")
+			diskv1.DeviceMounted.Message(deviceCpy, fmt.Sprintf("waiting for the Longhorn disk on %s to be evicted and removed",
+				fsStatus.MountPoint))
+			c.Blockdevices.EnqueueAfter(c.namespace, device.Name, evictionWaitInterval)
+			return c.updateHandledStatus(device, deviceCpy)
+		}
+		if err := c.releaseMountPoint(deviceCpy, mountPoint); err != nil {
+			reason := "Failed"
+			if block.IsBusy(err) {
+				reason = "Busy"
+				c.Blockdevices.EnqueueAfter(c.namespace, device.Name, unmountRetryInterval)
+			}
+			diskv1.DeviceMounted.SetError(deviceCpy, reason, fmt.Errorf("failed to unmount the device %s from path %s, error: %s",
+				device.Spec.DevPath, fsStatus.MountPoint, err.Error()))
+			return c.updateHandledStatus(device, deviceCpy)
+		}
+		fsStatus = deviceCpy.Status.DeviceStatus.FileSystem
+	}
+
+	if mountPoint == "" {
+		deviceCpy.Status.DeviceStatus.FileSystem.AppliedMountPoint = ""
+		if !reflect.DeepEqual(device, deviceCpy) {
+			if err := c.removePersistedMount(deviceCpy.Status.DeviceStatus.Details.UUID); err != nil {
+				return device, fmt.Errorf("failed to remove the persisted mount of device %s, error: %w", device.Spec.DevPath, err)
+			}
+			diskv1.DeviceMounted.SetError(deviceCpy, "Unmounted", nil)
+			diskv1.DeviceMounted.SetStatusBool(deviceCpy, false)
+			return c.updateHandledStatus(device, deviceCpy)
+		}
+		return device, nil
+	}
 
 	// check whether need to performing disk operation
 	if _, valid := isValidFileSystem(fs, fsStatus); !valid {
 		logrus.Infof("performing disk operation of disk %s, mount path %s", device.Spec.DevPath, fs.MountPoint)
 		if fs.ForceFormatted && fsStatus.LastFormattedAt == nil {
-			//TODO, perform filesystem formatting to ext4
+			if err := c.BlockInfo.CheckDeviceNotInUse(deviceCpy.Spec.DevPath); err != nil {
+				diskv1.DeviceFormatted.SetError(deviceCpy, getRefusalReason(err), fmt.Errorf("refused to format the device %s, error: %s",
+					device.Spec.DevPath, err.Error()))
+				return c.updateHandledStatus(device, deviceCpy)
+			}
+			if err := c.formatDevice(deviceCpy.Spec.DevPath, fs.Type); err != nil {
+				diskv1.DeviceFormatted.SetError(deviceCpy, "", fmt.Errorf("failed to format the device %s, error: %s",
+					device.Spec.DevPath, err.Error()))
+				return c.updateHandledStatus(device, deviceCpy)
+			}
+			diskv1.DeviceFormatted.SetError(deviceCpy, "", nil)
 			deviceCpy.Status.DeviceStatus.FileSystem.LastFormattedAt = &metav1.Time{Time: time.Now()}
 		}
 
-		if err := mountDevice(deviceCpy.Spec.DevPath, fs.MountPoint); err != nil {
-			diskv1.DeviceMounted.SetStatusBool(deviceCpy, false)
-			diskv1.DeviceMounted.SetError(deviceCpy, "", fmt.Errorf("failed to mount the device %s to path %s, error:%s",
-				device.Spec.DevPath, device.Spec.FileSystem.MountPoint, err.Error()))
-			return c.Blockdevices.Update(deviceCpy)
+		if fsStatus.MountPoint == "" {
+			if err := c.mountDevice(deviceCpy.Spec.DevPath, fs); err != nil {
+				diskv1.DeviceMounted.SetStatusBool(deviceCpy, false)
+				diskv1.DeviceMounted.SetError(deviceCpy, "", fmt.Errorf("failed to mount the device %s to path %s, error:%s",
+					device.Spec.DevPath, device.Spec.FileSystem.MountPoint, err.Error()))
+				return c.updateHandledStatus(device, deviceCpy)
+			}
 		}
 
-		disk := c.BlockInfo.GetDiskByName(deviceCpy.Spec.DevPath)
-		deviceCpy.Status.DeviceStatus.FileSystem.Type = disk.FileSystemInfo.FsType
-		deviceCpy.Status.DeviceStatus.FileSystem.MountPoint = disk.FileSystemInfo.MountPoint
+		c.refreshFileSystemStatus(deviceCpy)
+	}
+
+	// remount the device once the mount options are changed
+	fsStatus = deviceCpy.Status.DeviceStatus.FileSystem
+	if _, valid := isValidFileSystem(fs, fsStatus); valid && !block.IsMountOptionsApplied(getMountOptions(fs), fsStatus.MountOptions) {
+		logrus.Infof("Remount device %s to path %s with options %v", device.Spec.DevPath, fsStatus.MountPoint, getMountOptions(fs))
+		if err := c.Host.Remount(deviceCpy.Spec.DevPath, fsStatus.MountPoint, fsStatus.Type, getMountOptions(fs)); err != nil {
+			diskv1.DeviceMounted.SetError(deviceCpy, "RemountFailed", fmt.Errorf("failed to remount the device %s to path %s, error: %s",
+				device.Spec.DevPath, fsStatus.MountPoint, err.Error()))
+			return c.updateHandledStatus(device, deviceCpy)
+		}
+		c.refreshFileSystemStatus(deviceCpy)
 	}
 
 	err, validFs := isValidFileSystem(deviceCpy.Spec.FileSystem, deviceCpy.Status.DeviceStatus.FileSystem)
@@ -128,8 +275,15 @@ func (c *Controller) OnBlockDeviceChange(key string, device *diskv1.BlockDevice)
 		diskv1.DeviceMounted.Message(deviceCpy, err.Error())
 	}
 
+	if mounted {
+		deviceCpy.Status.DeviceStatus.FileSystem.AppliedMountPoint = deviceCpy.Status.DeviceStatus.FileSystem.MountPoint
+		if err := c.persistMount(deviceCpy); err != nil {
+			logrus.Errorf("failed to persist the mount of device %s, error: %s", device.Spec.DevPath, err.Error())
+		}
+	}
+
 	if !reflect.DeepEqual(device, deviceCpy) {
-		if _, err := c.Blockdevices.Update(deviceCpy); err != nil {
+		if _, err := c.updateHandledStatus(device, deviceCpy); err != nil {
 			return device, err
 		}
 	}
@@ -137,99 +291,153 @@ func (c *Controller) OnBlockDeviceChange(key string, device *diskv1.BlockDevice)
 	return nil, nil
 }
 
-func mountDevice(devPath, mountPoint string) error {
-	_, err := os.Stat(mountPoint)
+// releaseMountPoint unmounts the device from its current mount point applied by the controller, or moves the mount
+// to the new mount point if it is specified. The device is remounted if the mount can't be moved, e.g. the parent
+// mount is shared.
+func (c *Controller) releaseMountPoint(device *diskv1.BlockDevice, mountPoint string) error {
+	current := device.Status.DeviceStatus.FileSystem.MountPoint
+	if mountPoint != "" {
+		logrus.Infof("Move the mount of device %s from %s to %s", device.Spec.DevPath, current, mountPoint)
+		err := c.ensureMountPoint(mountPoint)
+		if err == nil {
+			err = c.Host.MoveMount(current, mountPoint)
+		}
+		if err == nil {
+			c.refreshFileSystemStatus(device)
+			device.Status.DeviceStatus.FileSystem.AppliedMountPoint = mountPoint
+			return nil
+		}
+		logrus.Warnf("failed to move the mount of device %s, unmount it instead, error: %s", device.Spec.DevPath, err.Error())
+	}
+
+	logrus.Infof("Unmount the device %s from %s", device.Spec.DevPath, current)
+	if err := c.Host.Unmount(current, block.UnmountOptions{}); err != nil {
+		return err
+	}
+	c.refreshFileSystemStatus(device)
+	device.Status.DeviceStatus.FileSystem.AppliedMountPoint = ""
+	return nil
+}
+
+// refreshFileSystemStatus updates the filesystem type and mount point of the block device from the node
+func (c *Controller) refreshFileSystemStatus(device *diskv1.BlockDevice) {
+	disk := c.BlockInfo.GetDiskByName(device.Spec.DevPath)
+	device.Status.DeviceStatus.FileSystem.Type = disk.FileSystemInfo.FsType
+	device.Status.DeviceStatus.FileSystem.MountPoint = disk.FileSystemInfo.MountPoint
+	device.Status.DeviceStatus.FileSystem.MountOptions = disk.FileSystemInfo.MountOptions
+	device.Status.DeviceStatus.FileSystem.IsReadOnly = disk.FileSystemInfo.IsReadOnly
+	device.Status.DeviceStatus.Details.UUID = disk.UUID
+}
+
+// mountDevice mounts the device with the detected filesystem, it refuses to mount the device if the detected
+// filesystem doesn't match the specified one, which has to be overwritten by force formatting
+func (c *Controller) mountDevice(devPath string, fs diskv1.FilesystemInfo) error {
+	fsType := c.BlockInfo.GetDiskByName(devPath).FileSystemInfo.FsType
+	if fsType == "" {
+		return fmt.Errorf("no filesystem is detected, force formatting is required")
+	}
+	if fs.Type != "" && fs.Type != fsType {
+		return fmt.Errorf("detected filesystem %s does not match the specified type %s, force formatting is required",
+			fsType, fs.Type)
+	}
+
+	if err := c.ensureMountPoint(fs.MountPoint); err != nil {
+		return err
+	}
+	return c.Host.Mount(devPath, fs.MountPoint, fsType, getMountOptions(fs))
+}
+
+// getMountOptions returns the options the device is mounted with
+func getMountOptions(fs diskv1.FilesystemInfo) []string {
+	options := make([]string, 0, len(fs.MountOptions)+1)
+	options = append(options, fs.MountOptions...)
+	if fs.ReadOnly {
+		options = append(options, "ro")
+	}
+	return options
+}
+
+func (c *Controller) ensureMountPoint(mountPoint string) error {
+	_, err := c.Host.Stat(mountPoint)
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
 	if os.IsNotExist(err) {
-		if err := os.Mkdir(mountPoint, os.ModeDir); err != nil {
+		if err := c.Host.Mkdir(mountPoint, os.ModeDir); err != nil {
 			return err
 		}
 	}
+	return nil
+}
+
+// formatDevice wipes the existing signatures of the device and creates a new filesystem of the type on it,
+// ext4 is created if the type is not specified
+func (c *Controller) formatDevice(devPath, fsType string) error {
+	if fsType == "" {
+		fsType = block.DefaultFileSystem
+	}
+	if err := c.Host.WipeFilesystem(devPath); err != nil {
+		return err
+	}
+	return c.Host.MakeFilesystem(devPath, fsType)
+}
 
-	return block.MountExt4(devPath, mountPoint, false)
+// getRefusalReason returns the condition reason of the refused destructive operation
+func getRefusalReason(err error) string {
+	if errors.Is(err, block.ErrDeviceInUse) {
+		return "InUse"
+	}
+	return ""
 }
 
-func isValidFileSystem(fs diskv1.FilesystemInfo, fsStatus diskv1.FilesystemStatus) (error, bool) {
+// getSpecMountPoint returns the specified mount point without the trailing slash
+func getSpecMountPoint(fs diskv1.FilesystemInfo) string {
 	if len(fs.MountPoint) > 1 {
-		fs.MountPoint = strings.TrimSuffix(fs.MountPoint, "/")
+		return strings.TrimSuffix(fs.MountPoint, "/")
 	}
+	return fs.MountPoint
+}
 
+func isValidFileSystem(fs diskv1.FilesystemInfo, fsStatus diskv1.FilesystemStatus) (error, bool) {
+	fs.MountPoint = getSpecMountPoint(fs)
 	if fs.MountPoint != fsStatus.MountPoint {
 		return fmt.Errorf("current mountPoint %s does not match the specified path: %s", fsStatus.MountPoint, fs.MountPoint), false
 	}
 
-	if !lhutil.IsSupportedFileSystem(fsStatus.Type) {
+	if !block.IsSupportedFileSystem(fsStatus.Type) {
 		return fmt.Errorf("unsupported filesystem type %s", fsStatus.Type), false
 	}
 
+	if fs.Type != "" && fs.Type != fsStatus.Type {
+		return fmt.Errorf("current filesystem type %s does not match the specified type: %s", fsStatus.Type, fs.Type), false
+	}
+
 	return nil, true
 }
 
+// SaveBlockDevice creates the discovered block device, or updates the existing one of bds with its device path and
+// discovered status
 func (c *Controller) SaveBlockDevice(blockDevice *diskv1.BlockDevice, bds []*diskv1.BlockDevice) error {
 	for _, existingBD := range bds {
 		if existingBD.Name == blockDevice.Name {
-			if !reflect.DeepEqual(existingBD, blockDevice) {
+			if isDiscoveredBlockDeviceChanged(existingBD, blockDevice) {
 				logrus.Infof("Update existing block device %s with devPath: %s", existingBD.Name, existingBD.Spec.DevPath)
-				toUpdate := existingBD.DeepCopy()
-				toUpdate.Spec = blockDevice.Spec
-				toUpdate.Status.DeviceStatus = blockDevice.Status.DeviceStatus
-				if _, err := c.Blockdevices.Update(toUpdate); err != nil {
-					return err
-				}
+				return c.updateDiscoveredBlockDevice(existingBD, blockDevice)
 			}
 			return nil
 		}
 	}
 
 	logrus.Infof("Add new block device %s with device: %s", blockDevice.Name, blockDevice.Spec.DevPath)
-	if _, err := c.Blockdevices.Create(blockDevice); err != nil {
-		return err
-	}
-	return nil
+	return c.createBlockDevice(blockDevice)
 }
 
+// SaveBlockDeviceByList is SaveBlockDevice of the existing block devices of the list
 func (c *Controller) SaveBlockDeviceByList(blockDevice *diskv1.BlockDevice, bdList *diskv1.BlockDeviceList) error {
-	for _, existingBD := range bdList.Items {
-		if existingBD.Name == blockDevice.Name {
-			if !reflect.DeepEqual(existingBD, blockDevice) {
-				logrus.Infof("Update existing block device %s with device: %s", existingBD.Name, existingBD.Spec.DevPath)
-				toUpdate := existingBD.DeepCopy()
-				toUpdate.Status.DeviceStatus = blockDevice.Status.DeviceStatus
-				if _, err := c.Blockdevices.Update(toUpdate); err != nil {
-					return err
-				}
-			}
-			return nil
-		}
+	bds := make([]*diskv1.BlockDevice, 0, len(bdList.Items))
+	for i := range bdList.Items {
+		bds = append(bds, &bdList.Items[i])
 	}
-
-	logrus.Infof("Add new block device %s with device: %s", blockDevice.Name, blockDevice.Spec.DevPath)
-	if _, err := c.Blockdevices.Create(blockDevice); err != nil {
-		return err
-	}
-	return nil
-}
-
-// OnBlockDeviceDelete will delete the block devices that belongs to the same parent device
-func (c *Controller) OnBlockDeviceDelete(key string, device *diskv1.BlockDevice) (*diskv1.BlockDevice, error) {
-	if device == nil {
-		return nil, nil
-	}
-
-	bds, err := c.BlockdeviceCache.List(c.namespace, labels.SelectorFromSet(map[string]string{
-		ParentDeviceLabel: device.Name,
-	}))
-	if err != nil {
-		return device, err
-	}
-
-	for _, bd := range bds {
-		if err := c.Blockdevices.Delete(c.namespace, bd.Name, &metav1.DeleteOptions{}); err != nil {
-			return device, err
-		}
-	}
-	return nil, nil
+	return c.SaveBlockDevice(blockDevice, bds)
 }
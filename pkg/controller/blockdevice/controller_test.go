@@ -0,0 +1,1063 @@
+package blockdevice
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	diskv1 "github.com/longhorn/node-disk-manager/pkg/apis/longhorn.io/v1beta1"
+	"github.com/longhorn/node-disk-manager/pkg/block"
+	"github.com/longhorn/node-disk-manager/pkg/block/blocktest"
+	"github.com/longhorn/node-disk-manager/pkg/filter"
+	"github.com/longhorn/node-disk-manager/pkg/option"
+	"github.com/longhorn/node-disk-manager/pkg/persistence"
+	"github.com/longhorn/node-disk-manager/pkg/util"
+	"github.com/longhorn/node-disk-manager/pkg/util/fakeclients"
+)
+
+const (
+	testNamespace = "longhorn-system"
+	testNodeName  = "node1"
+)
+
+// newTestController returns the controller of the host of the snapshot, the block devices of the host are registered
+func newTestController(t *testing.T, snapshot, vanishedDevicePolicy string) (*Controller, *blocktest.Host, *fakeclients.BlockDeviceController) {
+	t.Helper()
+	host := blocktest.NewHost(t, snapshot)
+	c, blockdevices := newHostTestController(t, host, vanishedDevicePolicy)
+	return c, host, blockdevices
+}
+
+// newHostTestController returns the controller of the host, which may be changed from its snapshot by the test, the
+// block devices of the host are registered
+func newHostTestController(t *testing.T, host *blocktest.Host, vanishedDevicePolicy string) (*Controller, *fakeclients.BlockDeviceController) {
+	t.Helper()
+	blockdevices := fakeclients.NewBlockDeviceController()
+	c, err := NewController(blockdevices, host, host.Info, filter.NewDefaultDeviceFilter(), &option.Option{
+		Namespace:            testNamespace,
+		NodeName:             testNodeName,
+		VanishedDevicePolicy: vanishedDevicePolicy,
+		MountPersistence:     persistence.ModeNone,
+	})
+	if err != nil {
+		t.Fatalf("failed to create controller, error: %s", err.Error())
+	}
+	if err := c.RegisterNodeBlockDevices(); err != nil {
+		t.Fatalf("failed to register block devices, error: %s", err.Error())
+	}
+	return c, blockdevices
+}
+
+// getBlockDevice returns the stored block device of the device path, or nil if there is none
+func getBlockDevice(t *testing.T, blockdevices *fakeclients.BlockDeviceController, devPath string) *diskv1.BlockDevice {
+	t.Helper()
+	list, err := blockdevices.List(testNamespace, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list block devices, error: %s", err.Error())
+	}
+	for i := range list.Items {
+		if list.Items[i].Spec.DevPath == devPath {
+			return &list.Items[i]
+		}
+	}
+	return nil
+}
+
+// mustGetBlockDevice returns the stored block device of the device path
+func mustGetBlockDevice(t *testing.T, blockdevices *fakeclients.BlockDeviceController, devPath string) *diskv1.BlockDevice {
+	t.Helper()
+	bd := getBlockDevice(t, blockdevices, devPath)
+	if bd == nil {
+		t.Fatalf("block device of %s is not found", devPath)
+	}
+	return bd
+}
+
+// getDevPaths returns the sorted device paths of the stored block devices
+func getDevPaths(t *testing.T, blockdevices *fakeclients.BlockDeviceController) []string {
+	t.Helper()
+	list, err := blockdevices.List(testNamespace, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list block devices, error: %s", err.Error())
+	}
+	devPaths := make([]string, 0, len(list.Items))
+	for _, bd := range list.Items {
+		devPaths = append(devPaths, bd.Spec.DevPath)
+	}
+	sort.Strings(devPaths)
+	return devPaths
+}
+
+// getDiskNames returns the names of the stored block devices of the disks
+func getDiskNames(t *testing.T, blockdevices *fakeclients.BlockDeviceController) []string {
+	t.Helper()
+	list, err := blockdevices.List(testNamespace, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list block devices, error: %s", err.Error())
+	}
+	names := make([]string, 0)
+	for _, bd := range list.Items {
+		if bd.Status.DeviceStatus.Details.DeviceType == diskv1.DeviceTypeDisk {
+			names = append(names, bd.Name)
+		}
+	}
+	return names
+}
+
+// update saves the changes of the block device of the device path, as the user edits it
+func update(t *testing.T, blockdevices *fakeclients.BlockDeviceController, devPath string, mutate func(bd *diskv1.BlockDevice)) *diskv1.BlockDevice {
+	t.Helper()
+	bd := mustGetBlockDevice(t, blockdevices, devPath)
+	mutate(bd)
+	bd, err := blockdevices.Update(bd)
+	if err != nil {
+		t.Fatalf("failed to update block device of %s, error: %s", devPath, err.Error())
+	}
+	return bd
+}
+
+// updateStatus saves the changes of the status of the block device of the device path
+func updateStatus(t *testing.T, blockdevices *fakeclients.BlockDeviceController, devPath string, mutate func(bd *diskv1.BlockDevice)) *diskv1.BlockDevice {
+	t.Helper()
+	bd := mustGetBlockDevice(t, blockdevices, devPath)
+	mutate(bd)
+	bd, err := blockdevices.UpdateStatus(bd)
+	if err != nil {
+		t.Fatalf("failed to update status of block device of %s, error: %s", devPath, err.Error())
+	}
+	return bd
+}
+
+// sync runs the change handler with the stored block device of the device path
+func sync(t *testing.T, c *Controller, blockdevices *fakeclients.BlockDeviceController, devPath string) {
+	t.Helper()
+	bd := mustGetBlockDevice(t, blockdevices, devPath)
+	if _, err := c.OnBlockDeviceChange(bd.Namespace+"/"+bd.Name, bd); err != nil {
+		t.Fatalf("failed to sync block device of %s, error: %s", devPath, err.Error())
+	}
+}
+
+// verifyMounted checks the block device is mounted to the mount point with the filesystem
+func verifyMounted(t *testing.T, bd *diskv1.BlockDevice, mountPoint, fsType string) {
+	t.Helper()
+	if !diskv1.DeviceMounted.IsTrue(bd) {
+		t.Errorf("expected Mounted condition True, got %q: %s", diskv1.DeviceMounted.GetStatus(bd),
+			diskv1.DeviceMounted.GetMessage(bd))
+	}
+	fsStatus := bd.Status.DeviceStatus.FileSystem
+	if fsStatus.MountPoint != mountPoint || fsStatus.Type != fsType {
+		t.Errorf("expected %s mounted to %s, got %s mounted to %q", fsType, mountPoint, fsStatus.Type, fsStatus.MountPoint)
+	}
+}
+
+// verifyNotMounted checks the block device is not mounted
+func verifyNotMounted(t *testing.T, bd *diskv1.BlockDevice) {
+	t.Helper()
+	if !diskv1.DeviceMounted.IsFalse(bd) {
+		t.Errorf("expected Mounted condition False, got %q", diskv1.DeviceMounted.GetStatus(bd))
+	}
+	if mountPoint := bd.Status.DeviceStatus.FileSystem.MountPoint; mountPoint != "" {
+		t.Errorf("expected device not to be mounted, got %q", mountPoint)
+	}
+}
+
+func TestRegisterNodeBlockDevices(t *testing.T) {
+	tests := []struct {
+		snapshot string
+		expected []string
+		// the devices held by another device, which must never be formatted
+		inUse []string
+	}{
+		{
+			snapshot: "nvme.tar.gz",
+			expected: []string{"/dev/nvme0n1", "/dev/nvme0n1p1", "/dev/nvme0n1p2"},
+		},
+		{
+			snapshot: "virtio.tar.gz",
+			expected: []string{"/dev/vdb"},
+		},
+		{
+			snapshot: "sata.tar.gz",
+			expected: []string{"/dev/sda", "/dev/sda1", "/dev/sda2"},
+		},
+		{
+			// the paths sdb and sdc of the LUN share its WWN, so they are skipped rather than registered as the same
+			// block device, the LUN is used through the multipath device dm-0
+			snapshot: "multipath.tar.gz",
+			expected: []string{"/dev/dm-0"},
+			inUse:    []string{"/dev/sdb", "/dev/sdc"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.snapshot, func(t *testing.T) {
+			c, _, blockdevices := newTestController(t, test.snapshot, VanishedDevicePolicyInactive)
+			if devPaths := getDevPaths(t, blockdevices); !reflect.DeepEqual(devPaths, test.expected) {
+				t.Errorf("expected block devices of %v, got %v", test.expected, devPaths)
+			}
+			for _, devPath := range test.inUse {
+				if err := c.BlockInfo.CheckDeviceNotInUse(devPath); getRefusalReason(err) != "InUse" {
+					t.Errorf("expected formatting of %s to be refused as in use, got %v", devPath, err)
+				}
+			}
+
+			// the registration of a restarted agent keeps the existing block devices
+			before, _ := blockdevices.List(testNamespace, metav1.ListOptions{})
+			if err := c.RegisterNodeBlockDevices(); err != nil {
+				t.Fatalf("failed to register block devices again, error: %s", err.Error())
+			}
+			after, _ := blockdevices.List(testNamespace, metav1.ListOptions{})
+			for i := range after.Items {
+				if after.Items[i].UID != before.Items[i].UID {
+					t.Errorf("expected block device %s to be kept, got a new one", after.Items[i].Name)
+				}
+			}
+		})
+	}
+}
+
+func TestOnBlockDeviceChange(t *testing.T) {
+	tests := []struct {
+		name     string
+		snapshot string
+		devPath  string
+		mutate   func(bd *diskv1.BlockDevice)
+		verify   func(t *testing.T, bd *diskv1.BlockDevice, blockdevices *fakeclients.BlockDeviceController)
+	}{
+		{
+			name:     "block device of other node is ignored",
+			snapshot: "nvme.tar.gz",
+			devPath:  "/dev/nvme0n1p2",
+			mutate: func(bd *diskv1.BlockDevice) {
+				bd.Spec.NodeName = "node2"
+			},
+			verify: func(t *testing.T, bd *diskv1.BlockDevice, blockdevices *fakeclients.BlockDeviceController) {
+				if len(bd.Finalizers) != 0 || len(bd.OwnerReferences) != 0 {
+					t.Errorf("expected no finalizers and owners, got %v and %v", bd.Finalizers, bd.OwnerReferences)
+				}
+			},
+		},
+		{
+			name:     "finalizer of disk",
+			snapshot: "nvme.tar.gz",
+			devPath:  "/dev/nvme0n1",
+			verify: func(t *testing.T, bd *diskv1.BlockDevice, blockdevices *fakeclients.BlockDeviceController) {
+				if !util.HasFinalizer(bd, DeviceFinalizer) {
+					t.Errorf("expected finalizer %s, got %v", DeviceFinalizer, bd.Finalizers)
+				}
+				if len(bd.OwnerReferences) != 0 {
+					t.Errorf("expected no owners of disk, got %v", bd.OwnerReferences)
+				}
+			},
+		},
+		{
+			name:     "finalizer and owner of partition",
+			snapshot: "nvme.tar.gz",
+			devPath:  "/dev/nvme0n1p2",
+			verify: func(t *testing.T, bd *diskv1.BlockDevice, blockdevices *fakeclients.BlockDeviceController) {
+				if !util.HasFinalizer(bd, DeviceFinalizer) {
+					t.Errorf("expected finalizer %s, got %v", DeviceFinalizer, bd.Finalizers)
+				}
+				parent := mustGetBlockDevice(t, blockdevices, "/dev/nvme0n1")
+				if len(bd.OwnerReferences) != 1 || bd.OwnerReferences[0].UID != parent.UID {
+					t.Errorf("expected owner %s, got %v", parent.UID, bd.OwnerReferences)
+				}
+			},
+		},
+		{
+			name:     "mounted as specified",
+			snapshot: "nvme.tar.gz",
+			devPath:  "/dev/nvme0n1p1",
+			mutate: func(bd *diskv1.BlockDevice) {
+				bd.Spec.FileSystem.MountPoint = "/var/lib/longhorn/"
+				bd.Spec.FileSystem.MountOptions = []string{"noatime"}
+			},
+			verify: func(t *testing.T, bd *diskv1.BlockDevice, blockdevices *fakeclients.BlockDeviceController) {
+				if !diskv1.DeviceMounted.IsTrue(bd) {
+					t.Errorf("expected Mounted condition True, got %q: %s", diskv1.DeviceMounted.GetStatus(bd),
+						diskv1.DeviceMounted.GetMessage(bd))
+				}
+			},
+		},
+		{
+			name:     "mismatched filesystem type is reported",
+			snapshot: "nvme.tar.gz",
+			devPath:  "/dev/nvme0n1p1",
+			mutate: func(bd *diskv1.BlockDevice) {
+				bd.Spec.FileSystem.MountPoint = "/var/lib/longhorn"
+				bd.Spec.FileSystem.MountOptions = []string{"noatime"}
+				bd.Spec.FileSystem.Type = block.FileSystemXFS
+			},
+			verify: func(t *testing.T, bd *diskv1.BlockDevice, blockdevices *fakeclients.BlockDeviceController) {
+				if !diskv1.DeviceMounted.IsFalse(bd) || diskv1.DeviceMounted.GetMessage(bd) == "" {
+					t.Errorf("expected Mounted condition False with message, got %q: %s", diskv1.DeviceMounted.GetStatus(bd),
+						diskv1.DeviceMounted.GetMessage(bd))
+				}
+			},
+		},
+		{
+			name:     "format of active swap is refused",
+			snapshot: "sata.tar.gz",
+			devPath:  "/dev/sda1",
+			mutate: func(bd *diskv1.BlockDevice) {
+				bd.Spec.FileSystem.MountPoint = "/var/lib/longhorn"
+				bd.Spec.FileSystem.ForceFormatted = true
+			},
+			verify: func(t *testing.T, bd *diskv1.BlockDevice, blockdevices *fakeclients.BlockDeviceController) {
+				if reason := diskv1.DeviceFormatted.GetReason(bd); reason != "InUse" {
+					t.Errorf("expected Formatted condition reason InUse, got %q: %s", reason, diskv1.DeviceFormatted.GetMessage(bd))
+				}
+				if bd.Status.DeviceStatus.FileSystem.LastFormattedAt != nil {
+					t.Errorf("expected device not to be formatted")
+				}
+			},
+		},
+		{
+			name:     "format of disk with mounted partition is refused",
+			snapshot: "nvme.tar.gz",
+			devPath:  "/dev/nvme0n1",
+			mutate: func(bd *diskv1.BlockDevice) {
+				bd.Spec.FileSystem.MountPoint = "/var/lib/longhorn-data"
+				bd.Spec.FileSystem.ForceFormatted = true
+			},
+			verify: func(t *testing.T, bd *diskv1.BlockDevice, blockdevices *fakeclients.BlockDeviceController) {
+				if reason := diskv1.DeviceFormatted.GetReason(bd); reason != "InUse" {
+					t.Errorf("expected Formatted condition reason InUse, got %q: %s", reason, diskv1.DeviceFormatted.GetMessage(bd))
+				}
+			},
+		},
+		{
+			name:     "partition table of partition is refused",
+			snapshot: "nvme.tar.gz",
+			devPath:  "/dev/nvme0n1p2",
+			mutate: func(bd *diskv1.BlockDevice) {
+				bd.Spec.PartitionTable = &diskv1.PartitionTableSpec{}
+			},
+			verify: func(t *testing.T, bd *diskv1.BlockDevice, blockdevices *fakeclients.BlockDeviceController) {
+				if !diskv1.DevicePartitioned.IsFalse(bd) {
+					t.Errorf("expected Partitioned condition False, got %q", diskv1.DevicePartitioned.GetStatus(bd))
+				}
+			},
+		},
+		{
+			name:     "partition table of mounted disk is refused",
+			snapshot: "nvme.tar.gz",
+			devPath:  "/dev/nvme0n1",
+			mutate: func(bd *diskv1.BlockDevice) {
+				bd.Spec.FileSystem.MountPoint = "/var/lib/longhorn-data"
+				bd.Spec.PartitionTable = &diskv1.PartitionTableSpec{}
+			},
+			verify: func(t *testing.T, bd *diskv1.BlockDevice, blockdevices *fakeclients.BlockDeviceController) {
+				if !diskv1.DevicePartitioned.IsFalse(bd) {
+					t.Errorf("expected Partitioned condition False, got %q", diskv1.DevicePartitioned.GetStatus(bd))
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _, blockdevices := newTestController(t, test.snapshot, VanishedDevicePolicyInactive)
+			if test.mutate != nil {
+				update(t, blockdevices, test.devPath, test.mutate)
+			}
+			sync(t, c, blockdevices, test.devPath)
+			test.verify(t, mustGetBlockDevice(t, blockdevices, test.devPath), blockdevices)
+		})
+	}
+}
+
+func TestFinalizeBlockDevice(t *testing.T) {
+	tests := []struct {
+		name       string
+		mutate     func(bd *diskv1.BlockDevice)
+		removed    bool
+		failures   map[string]error
+		calls      []string
+		finalizers []string
+	}{
+		{
+			name: "unmounted device",
+			mutate: func(bd *diskv1.BlockDevice) {
+				bd.Spec.FileSystem.MountPoint = ""
+			},
+		},
+		{
+			name:   "mounted device is unmounted",
+			mutate: func(bd *diskv1.BlockDevice) {},
+			calls:  []string{"Unmount /var/lib/longhorn"},
+		},
+		{
+			name:       "busy device is kept",
+			mutate:     func(bd *diskv1.BlockDevice) {},
+			failures:   map[string]error{"Unmount": os.NewSyscallError("umount", syscall.EBUSY)},
+			calls:      []string{"Unmount /var/lib/longhorn"},
+			finalizers: []string{DeviceFinalizer},
+		},
+		{
+			name: "longhorn disk is not removed",
+			mutate: func(bd *diskv1.BlockDevice) {
+				util.AddFinalizer(bd, LonghornDiskFinalizer)
+			},
+			finalizers: []string{DeviceFinalizer, LonghornDiskFinalizer},
+		},
+		{
+			name:    "mounted device is gone",
+			mutate:  func(bd *diskv1.BlockDevice) {},
+			removed: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, host, blockdevices := newTestController(t, "nvme.tar.gz", VanishedDevicePolicyInactive)
+			for method, err := range test.failures {
+				host.Fail(method, err)
+			}
+			devPath := "/dev/nvme0n1p1"
+			bd := update(t, blockdevices, devPath, func(bd *diskv1.BlockDevice) {
+				util.AddFinalizer(bd, DeviceFinalizer)
+				test.mutate(bd)
+			})
+			if test.removed {
+				host.RemoveDevice(t, "nvme0n1p1")
+			}
+
+			if err := blockdevices.Delete(testNamespace, bd.Name, &metav1.DeleteOptions{}); err != nil {
+				t.Fatalf("failed to delete block device, error: %s", err.Error())
+			}
+			bd = mustGetBlockDevice(t, blockdevices, devPath)
+			_, err := c.OnBlockDeviceChange(bd.Namespace+"/"+bd.Name, bd)
+			if (err != nil) != (len(test.failures) > 0) {
+				t.Errorf("expected failure %v, got error %v", len(test.failures) > 0, err)
+			}
+			if calls := host.Calls(); !reflect.DeepEqual(calls, test.calls) {
+				t.Errorf("expected host calls %v, got %v", test.calls, calls)
+			}
+
+			bd, err = blockdevices.Get(testNamespace, bd.Name, metav1.GetOptions{})
+			if len(test.finalizers) == 0 {
+				if !errors.IsNotFound(err) {
+					t.Errorf("expected block device to be removed, got finalizers %v", bd.Finalizers)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected block device to be kept, error: %s", err.Error())
+			}
+			if !reflect.DeepEqual(bd.Finalizers, test.finalizers) {
+				t.Errorf("expected finalizers %v, got %v", test.finalizers, bd.Finalizers)
+			}
+		})
+	}
+}
+
+func TestMountAndFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		snapshot string
+		devPath  string
+		mutate   func(bd *diskv1.BlockDevice)
+		failures map[string]error
+		calls    []string
+		enqueued bool
+		verify   func(t *testing.T, bd *diskv1.BlockDevice)
+	}{
+		{
+			name:     "mount unmounted filesystem",
+			snapshot: "nvme.tar.gz",
+			devPath:  "/dev/nvme0n1p2",
+			mutate: func(bd *diskv1.BlockDevice) {
+				bd.Spec.FileSystem.MountPoint = "/var/lib/longhorn-data"
+			},
+			calls: []string{"Mkdir /var/lib/longhorn-data", "Mount /dev/nvme0n1p2 /var/lib/longhorn-data ext4"},
+			verify: func(t *testing.T, bd *diskv1.BlockDevice) {
+				verifyMounted(t, bd, "/var/lib/longhorn-data", block.FileSystemExt4)
+			},
+		},
+		{
+			name:     "mount failure",
+			snapshot: "nvme.tar.gz",
+			devPath:  "/dev/nvme0n1p2",
+			mutate: func(bd *diskv1.BlockDevice) {
+				bd.Spec.FileSystem.MountPoint = "/var/lib/longhorn-data"
+			},
+			failures: map[string]error{"Mount": os.NewSyscallError("mount", syscall.EIO)},
+			calls:    []string{"Mkdir /var/lib/longhorn-data", "Mount /dev/nvme0n1p2 /var/lib/longhorn-data ext4"},
+			verify: func(t *testing.T, bd *diskv1.BlockDevice) {
+				verifyNotMounted(t, bd)
+			},
+		},
+		{
+			name:     "mismatched filesystem requires force formatting",
+			snapshot: "nvme.tar.gz",
+			devPath:  "/dev/nvme0n1p2",
+			mutate: func(bd *diskv1.BlockDevice) {
+				bd.Spec.FileSystem.MountPoint = "/var/lib/longhorn-data"
+				bd.Spec.FileSystem.Type = block.FileSystemXFS
+			},
+			verify: func(t *testing.T, bd *diskv1.BlockDevice) {
+				verifyNotMounted(t, bd)
+			},
+		},
+		{
+			name:     "force format and mount",
+			snapshot: "nvme.tar.gz",
+			devPath:  "/dev/nvme0n1p2",
+			mutate: func(bd *diskv1.BlockDevice) {
+				bd.Spec.FileSystem.MountPoint = "/var/lib/longhorn-data"
+				bd.Spec.FileSystem.Type = block.FileSystemXFS
+				bd.Spec.FileSystem.ForceFormatted = true
+			},
+			calls: []string{
+				"WipeFilesystem /dev/nvme0n1p2",
+				"MakeFilesystem /dev/nvme0n1p2 xfs",
+				"Mkdir /var/lib/longhorn-data",
+				"Mount /dev/nvme0n1p2 /var/lib/longhorn-data xfs",
+			},
+			verify: func(t *testing.T, bd *diskv1.BlockDevice) {
+				if !diskv1.DeviceFormatted.IsTrue(bd) || bd.Status.DeviceStatus.FileSystem.LastFormattedAt == nil {
+					t.Errorf("expected device to be formatted, got %q: %s", diskv1.DeviceFormatted.GetStatus(bd),
+						diskv1.DeviceFormatted.GetMessage(bd))
+				}
+				verifyMounted(t, bd, "/var/lib/longhorn-data", block.FileSystemXFS)
+			},
+		},
+		{
+			name:     "format failure",
+			snapshot: "nvme.tar.gz",
+			devPath:  "/dev/nvme0n1p2",
+			mutate: func(bd *diskv1.BlockDevice) {
+				bd.Spec.FileSystem.MountPoint = "/var/lib/longhorn-data"
+				bd.Spec.FileSystem.ForceFormatted = true
+			},
+			failures: map[string]error{"MakeFilesystem": fmt.Errorf("failed to execute mkfs.ext4")},
+			calls:    []string{"WipeFilesystem /dev/nvme0n1p2", "MakeFilesystem /dev/nvme0n1p2 ext4"},
+			verify: func(t *testing.T, bd *diskv1.BlockDevice) {
+				if !diskv1.DeviceFormatted.IsFalse(bd) || bd.Status.DeviceStatus.FileSystem.LastFormattedAt != nil {
+					t.Errorf("expected format failure, got %q: %s", diskv1.DeviceFormatted.GetStatus(bd),
+						diskv1.DeviceFormatted.GetMessage(bd))
+				}
+			},
+		},
+		{
+			name:     "remount with changed options",
+			snapshot: "nvme.tar.gz",
+			devPath:  "/dev/nvme0n1p1",
+			mutate: func(bd *diskv1.BlockDevice) {
+				bd.Spec.FileSystem.MountOptions = []string{"nodev"}
+			},
+			calls: []string{"Remount /dev/nvme0n1p1 /var/lib/longhorn ext4"},
+			verify: func(t *testing.T, bd *diskv1.BlockDevice) {
+				verifyMounted(t, bd, "/var/lib/longhorn", block.FileSystemExt4)
+				options := bd.Status.DeviceStatus.FileSystem.MountOptions
+				if expected := []string{"rw", "relatime", "nodev"}; !reflect.DeepEqual(options, expected) {
+					t.Errorf("expected mount options %v, got %v", expected, options)
+				}
+			},
+		},
+		{
+			name:     "remount failure",
+			snapshot: "nvme.tar.gz",
+			devPath:  "/dev/nvme0n1p1",
+			mutate: func(bd *diskv1.BlockDevice) {
+				bd.Spec.FileSystem.MountOptions = []string{"nodev"}
+			},
+			failures: map[string]error{"Remount": os.NewSyscallError("mount", syscall.EINVAL)},
+			calls:    []string{"Remount /dev/nvme0n1p1 /var/lib/longhorn ext4"},
+			verify: func(t *testing.T, bd *diskv1.BlockDevice) {
+				if reason := diskv1.DeviceMounted.GetReason(bd); reason != "RemountFailed" {
+					t.Errorf("expected Mounted condition reason RemountFailed, got %q", reason)
+				}
+			},
+		},
+		{
+			name:     "move mount",
+			snapshot: "nvme.tar.gz",
+			devPath:  "/dev/nvme0n1p1",
+			mutate: func(bd *diskv1.BlockDevice) {
+				bd.Spec.FileSystem.MountPoint = "/var/lib/longhorn-moved"
+				bd.Spec.FileSystem.MountOptions = []string{"noatime"}
+			},
+			calls: []string{"Mkdir /var/lib/longhorn-moved", "MoveMount /var/lib/longhorn /var/lib/longhorn-moved"},
+			verify: func(t *testing.T, bd *diskv1.BlockDevice) {
+				verifyMounted(t, bd, "/var/lib/longhorn-moved", block.FileSystemExt4)
+			},
+		},
+		{
+			name:     "unmount",
+			snapshot: "nvme.tar.gz",
+			devPath:  "/dev/nvme0n1p1",
+			mutate: func(bd *diskv1.BlockDevice) {
+				bd.Spec.FileSystem.MountPoint = ""
+			},
+			calls: []string{"Unmount /var/lib/longhorn"},
+			verify: func(t *testing.T, bd *diskv1.BlockDevice) {
+				verifyNotMounted(t, bd)
+			},
+		},
+		{
+			name:     "unmount of busy device",
+			snapshot: "nvme.tar.gz",
+			devPath:  "/dev/nvme0n1p1",
+			mutate: func(bd *diskv1.BlockDevice) {
+				bd.Spec.FileSystem.MountPoint = ""
+			},
+			failures: map[string]error{"Unmount": os.NewSyscallError("umount", syscall.EBUSY)},
+			calls:    []string{"Unmount /var/lib/longhorn"},
+			enqueued: true,
+			verify: func(t *testing.T, bd *diskv1.BlockDevice) {
+				if reason := diskv1.DeviceMounted.GetReason(bd); reason != "Busy" {
+					t.Errorf("expected Mounted condition reason Busy, got %q", reason)
+				}
+				if bd.Status.DeviceStatus.FileSystem.MountPoint != "/var/lib/longhorn" {
+					t.Errorf("expected device to be still mounted, got %q", bd.Status.DeviceStatus.FileSystem.MountPoint)
+				}
+			},
+		},
+		{
+			name:     "move mount of registered longhorn disk waits for eviction",
+			snapshot: "nvme.tar.gz",
+			devPath:  "/dev/nvme0n1p1",
+			mutate: func(bd *diskv1.BlockDevice) {
+				util.AddFinalizer(bd, LonghornDiskFinalizer)
+				bd.Spec.FileSystem.MountPoint = "/var/lib/longhorn-moved"
+			},
+			enqueued: true,
+			verify: func(t *testing.T, bd *diskv1.BlockDevice) {
+				if reason := diskv1.DeviceMounted.GetReason(bd); reason != "WaitingForEviction" {
+					t.Errorf("expected Mounted condition reason WaitingForEviction, got %q", reason)
+				}
+				verifyMounted(t, bd, "/var/lib/longhorn", block.FileSystemExt4)
+			},
+		},
+		{
+			name:     "partition table",
+			snapshot: "virtio.tar.gz",
+			devPath:  "/dev/vdb",
+			mutate: func(bd *diskv1.BlockDevice) {
+				bd.Spec.FileSystem.ForceFormatted = true
+				bd.Spec.PartitionTable = &diskv1.PartitionTableSpec{}
+			},
+			calls: []string{"WipeFilesystem /dev/vdb", "WritePartitionTable /dev/vdb"},
+			verify: func(t *testing.T, bd *diskv1.BlockDevice) {
+				if !diskv1.DevicePartitioned.IsTrue(bd) {
+					t.Errorf("expected Partitioned condition True, got %q: %s", diskv1.DevicePartitioned.GetStatus(bd),
+						diskv1.DevicePartitioned.GetMessage(bd))
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, host, blockdevices := newTestController(t, test.snapshot, VanishedDevicePolicyInactive)
+			for method, err := range test.failures {
+				host.Fail(method, err)
+			}
+			update(t, blockdevices, test.devPath, test.mutate)
+			sync(t, c, blockdevices, test.devPath)
+			if calls := host.Calls(); !reflect.DeepEqual(calls, test.calls) {
+				t.Errorf("expected host calls %v, got %v", test.calls, calls)
+			}
+			if len(blockdevices.Enqueued) > 0 != test.enqueued {
+				t.Errorf("expected enqueued %v, got %v", test.enqueued, blockdevices.Enqueued)
+			}
+
+			// the applied spec is not operated again
+			if len(test.failures) == 0 {
+				sync(t, c, blockdevices, test.devPath)
+				if calls := host.Calls(); len(calls) != len(test.calls) {
+					t.Errorf("expected no more host calls, got %v", calls[len(test.calls):])
+				}
+			}
+			test.verify(t, mustGetBlockDevice(t, blockdevices, test.devPath))
+		})
+	}
+}
+
+func TestExternalMountLeftAlone(t *testing.T) {
+	c, host, blockdevices := newTestController(t, "nvme.tar.gz", VanishedDevicePolicyInactive)
+	sync(t, c, blockdevices, "/dev/nvme0n1p2")
+
+	// the administrator mounts the device of the block device without a specified mount point
+	if err := host.Mkdir("/mnt/backup", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := host.Mount("/dev/nvme0n1p2", "/mnt/backup", block.FileSystemExt4, nil); err != nil {
+		t.Fatalf("failed to mount the device, error: %s", err.Error())
+	}
+	info, err := host.Info.Rescan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.BlockInfo = info
+	if err := c.RegisterNodeBlockDevices(); err != nil {
+		t.Fatalf("failed to register block devices, error: %s", err.Error())
+	}
+	calls := host.Calls()
+	sync(t, c, blockdevices, "/dev/nvme0n1p2")
+
+	if got := host.Calls(); len(got) != len(calls) {
+		t.Errorf("expected the external mount to be left alone, got host calls %v", got[len(calls):])
+	}
+	bd := mustGetBlockDevice(t, blockdevices, "/dev/nvme0n1p2")
+	if fsStatus := bd.Status.DeviceStatus.FileSystem; fsStatus.MountPoint != "/mnt/backup" || fsStatus.AppliedMountPoint != "" {
+		t.Errorf("expected device mounted to /mnt/backup outside of the controller, got mount point %q applied %q",
+			fsStatus.MountPoint, fsStatus.AppliedMountPoint)
+	}
+}
+
+func TestPartitionDiskIdentifiedByPTUUID(t *testing.T) {
+	// the data disk has neither a serial number nor a bus path, so it's identified by the PTUUID of its partition table
+	host := blocktest.NewHost(t, "virtio.tar.gz")
+	host.WriteFile(t, "run/udev/data/b252:16", "")
+	if err := host.WritePartitionTable("/dev/vdb", "", nil); err != nil {
+		t.Fatalf("failed to partition the disk, error: %s", err.Error())
+	}
+	info, err := host.Info.Rescan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.Info = info
+	c, blockdevices := newHostTestController(t, host, VanishedDevicePolicyInactive)
+	disk := mustGetBlockDevice(t, blockdevices, "/dev/vdb")
+	ptUUID := disk.Status.DeviceStatus.Details.PtUUID
+	if ptUUID == "" {
+		t.Fatalf("expected PTUUID of the disk, got none")
+	}
+
+	update(t, blockdevices, "/dev/vdb", func(bd *diskv1.BlockDevice) {
+		bd.Spec.FileSystem.ForceFormatted = true
+		bd.Spec.PartitionTable = &diskv1.PartitionTableSpec{
+			Partitions: []diskv1.PartitionSpec{{Name: "data", Size: resource.NewQuantity(10<<30, resource.BinarySI)}, {Name: "log"}},
+		}
+	})
+	sync(t, c, blockdevices, "/dev/vdb")
+	if err := c.ReconcileNodeBlockDevices(); err != nil {
+		t.Fatalf("failed to reconcile block devices, error: %s", err.Error())
+	}
+
+	if disks := getDiskNames(t, blockdevices); !reflect.DeepEqual(disks, []string{disk.Name}) {
+		t.Errorf("expected the only disk block device %s, got %v", disk.Name, disks)
+	}
+	bd := mustGetBlockDevice(t, blockdevices, "/dev/vdb")
+	if !diskv1.DevicePartitioned.IsTrue(bd) || bd.Spec.PartitionTable == nil {
+		t.Errorf("expected the partitioned disk to keep its spec, got %q: %s", diskv1.DevicePartitioned.GetStatus(bd),
+			diskv1.DevicePartitioned.GetMessage(bd))
+	}
+	if bd.Status.DeviceStatus.Details.PtUUID != ptUUID {
+		t.Errorf("expected PTUUID %s to be kept, got %s", ptUUID, bd.Status.DeviceStatus.Details.PtUUID)
+	}
+	// the whole disk partition written before has vanished with its PARTUUID
+	list, err := blockdevices.List(testNamespace, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parents := make(map[string]string)
+	for _, part := range list.Items {
+		if part.Status.State == diskv1.BlockDeviceActive && part.Status.DeviceStatus.Details.DeviceType == diskv1.DeviceTypePart {
+			parents[part.Spec.DevPath] = part.Labels[ParentDeviceLabel]
+		}
+	}
+	expected := map[string]string{"/dev/vdb1": disk.Name, "/dev/vdb2": disk.Name}
+	if !reflect.DeepEqual(parents, expected) {
+		t.Errorf("expected active partitions %v, got %v", expected, parents)
+	}
+}
+
+func TestReconcileNodeBlockDevices(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		expected map[string]diskv1.BlockDeviceState
+	}{
+		{
+			name:   "vanished device is deactivated",
+			policy: VanishedDevicePolicyInactive,
+			expected: map[string]diskv1.BlockDeviceState{
+				"/dev/nvme0n1":   diskv1.BlockDeviceActive,
+				"/dev/nvme0n1p1": diskv1.BlockDeviceActive,
+				"/dev/nvme0n1p2": diskv1.BlockDeviceInactive,
+			},
+		},
+		{
+			name:   "vanished device is deleted",
+			policy: VanishedDevicePolicyDelete,
+			expected: map[string]diskv1.BlockDeviceState{
+				"/dev/nvme0n1":   diskv1.BlockDeviceActive,
+				"/dev/nvme0n1p1": diskv1.BlockDeviceActive,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, host, blockdevices := newTestController(t, "nvme.tar.gz", test.policy)
+
+			// the missed events: the disk is re-created, a partition is deleted and the other one is reactivated
+			disk := mustGetBlockDevice(t, blockdevices, "/dev/nvme0n1")
+			if err := blockdevices.Delete(testNamespace, disk.Name, &metav1.DeleteOptions{}); err != nil {
+				t.Fatalf("failed to delete block device, error: %s", err.Error())
+			}
+			updateStatus(t, blockdevices, "/dev/nvme0n1p1", func(bd *diskv1.BlockDevice) {
+				bd.Status.State = diskv1.BlockDeviceInactive
+			})
+			host.RemoveDevice(t, "nvme0n1p2")
+
+			if err := c.ReconcileNodeBlockDevices(); err != nil {
+				t.Fatalf("failed to reconcile block devices, error: %s", err.Error())
+			}
+
+			devPaths := getDevPaths(t, blockdevices)
+			if len(devPaths) != len(test.expected) {
+				t.Errorf("expected block devices of %d devices, got %v", len(test.expected), devPaths)
+			}
+			for devPath, state := range test.expected {
+				bd := getBlockDevice(t, blockdevices, devPath)
+				if bd == nil {
+					t.Errorf("expected block device of %s, got none", devPath)
+					continue
+				}
+				if bd.Status.State != state {
+					t.Errorf("expected state %s of %s, got %s", state, devPath, bd.Status.State)
+				}
+			}
+		})
+	}
+}
+
+func TestDiscoveryKeepsSpec(t *testing.T) {
+	tests := []struct {
+		name     string
+		discover func(c *Controller) error
+	}{
+		{
+			name:     "register",
+			discover: (*Controller).RegisterNodeBlockDevices,
+		},
+		{
+			name:     "reconcile",
+			discover: (*Controller).ReconcileNodeBlockDevices,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _, blockdevices := newTestController(t, "nvme.tar.gz", VanishedDevicePolicyInactive)
+			devPath := "/dev/nvme0n1p1"
+			bd := mustGetBlockDevice(t, blockdevices, devPath)
+			if bd.Status.State != diskv1.BlockDeviceActive || bd.Status.DeviceStatus.Details.DeviceType != diskv1.DeviceTypePart {
+				t.Fatalf("expected discovered status of %s, got %+v", devPath, bd.Status)
+			}
+
+			spec := update(t, blockdevices, devPath, func(bd *diskv1.BlockDevice) {
+				bd.Spec.FileSystem = diskv1.FilesystemInfo{MountPoint: "/var/lib/longhorn", ForceFormatted: true}
+			}).Spec
+			updateStatus(t, blockdevices, devPath, func(bd *diskv1.BlockDevice) {
+				bd.Status.State = diskv1.BlockDeviceInactive
+				bd.Status.DeviceStatus = diskv1.DeviceStatus{}
+			})
+
+			if err := test.discover(c); err != nil {
+				t.Fatalf("failed to discover block devices, error: %s", err.Error())
+			}
+			bd = mustGetBlockDevice(t, blockdevices, devPath)
+			if !reflect.DeepEqual(bd.Spec, spec) {
+				t.Errorf("expected spec %+v to be kept, got %+v", spec, bd.Spec)
+			}
+			if bd.Status.State != diskv1.BlockDeviceActive || bd.Status.DeviceStatus.Details.DeviceType != diskv1.DeviceTypePart {
+				t.Errorf("expected discovered status of %s, got %+v", devPath, bd.Status)
+			}
+		})
+	}
+}
+
+func TestUpdateBlockDeviceStatusOnConflict(t *testing.T) {
+	c, _, blockdevices := newTestController(t, "nvme.tar.gz", VanishedDevicePolicyInactive)
+	devPath := "/dev/nvme0n1"
+	stale := mustGetBlockDevice(t, blockdevices, devPath)
+	update(t, blockdevices, devPath, func(bd *diskv1.BlockDevice) {
+		bd.Spec.FileSystem = diskv1.FilesystemInfo{MountPoint: "/var/lib/longhorn"}
+	})
+
+	bd, err := c.UpdateBlockDeviceStatus(stale, func(bd *diskv1.BlockDevice) {
+		bd.Status.State = diskv1.BlockDeviceInactive
+	})
+	if err != nil {
+		t.Fatalf("failed to update status of the stale block device, error: %s", err.Error())
+	}
+	if bd.Status.State != diskv1.BlockDeviceInactive {
+		t.Errorf("expected state %s, got %s", diskv1.BlockDeviceInactive, bd.Status.State)
+	}
+	if bd = mustGetBlockDevice(t, blockdevices, devPath); bd.Spec.FileSystem.MountPoint != "/var/lib/longhorn" {
+		t.Errorf("expected the concurrent update of the spec to be kept, got mount point %q", bd.Spec.FileSystem.MountPoint)
+	}
+
+	// nothing is written if the status is up to date
+	if updated, err := c.UpdateBlockDeviceStatus(bd, func(bd *diskv1.BlockDevice) {
+		bd.Status.State = diskv1.BlockDeviceInactive
+	}); err != nil || updated.ResourceVersion != bd.ResourceVersion {
+		t.Errorf("expected block device to be kept at resource version %s, got %s, error: %v",
+			bd.ResourceVersion, updated.ResourceVersion, err)
+	}
+}
+
+func TestCreateBlockDeviceCreatedMeanwhile(t *testing.T) {
+	host := blocktest.NewHost(t, "nvme.tar.gz")
+	discovered := GetNewBlockDevices(host.Info.GetDiskByName("nvme0n1"), testNodeName, testNamespace)[1]
+	blockdevices := fakeclients.NewBlockDeviceController()
+	c, err := NewController(blockdevices, host, host.Info, filter.NewDefaultDeviceFilter(), &option.Option{
+		Namespace:            testNamespace,
+		NodeName:             testNodeName,
+		VanishedDevicePolicy: VanishedDevicePolicyInactive,
+		MountPersistence:     persistence.ModeNone,
+	})
+	if err != nil {
+		t.Fatalf("failed to create controller, error: %s", err.Error())
+	}
+
+	// the block device is created by the other handler, which failed to write its status
+	if _, err := blockdevices.Create(discovered); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.createBlockDevice(discovered); err != nil {
+		t.Fatalf("failed to create the existing block device, error: %s", err.Error())
+	}
+	bd := mustGetBlockDevice(t, blockdevices, discovered.Spec.DevPath)
+	if bd.Status.State != diskv1.BlockDeviceActive || !reflect.DeepEqual(bd.Status.DeviceStatus, discovered.Status.DeviceStatus) {
+		t.Errorf("expected discovered status %+v, got %+v", discovered.Status, bd.Status)
+	}
+
+	// nothing is written if the existing block device is up to date
+	if err := c.createBlockDevice(discovered); err != nil {
+		t.Fatalf("failed to create the existing block device, error: %s", err.Error())
+	}
+	if latest := mustGetBlockDevice(t, blockdevices, discovered.Spec.DevPath); latest.ResourceVersion != bd.ResourceVersion {
+		t.Errorf("expected block device to be kept at resource version %s, got %s", bd.ResourceVersion, latest.ResourceVersion)
+	}
+}
+
+func TestMigrateLegacyBlockDevices(t *testing.T) {
+	host := blocktest.NewHost(t, "nvme.tar.gz")
+	discovered := GetNewBlockDevices(host.Info.GetDiskByName("nvme0n1"), testNodeName, testNamespace)
+	disk, part := discovered[0], discovered[2]
+	legacy := func(bd *diskv1.BlockDevice, devPath string) *diskv1.BlockDevice {
+		legacyBD := bd.DeepCopy()
+		legacyBD.Name = getLegacyBlockDeviceName(devPath, testNodeName)
+		legacyBD.Spec.DevPath = devPath
+		legacyBD.Finalizers = []string{legacyFinalizer}
+		return legacyBD
+	}
+
+	// the partition was sdb2 when its legacy block device was created, the disk is registered already
+	formattedAt := metav1.Now()
+	legacyPart := legacy(part, "/dev/sdb2")
+	legacyPart.Status.DeviceStatus.ParentDevice = "/dev/sdb"
+	legacyPart.Spec.FileSystem = diskv1.FilesystemInfo{MountPoint: "/var/lib/longhorn", ForceFormatted: true}
+	legacyPart.Status.DeviceStatus.FileSystem.LastFormattedAt = &formattedAt
+	registeredDisk := disk.DeepCopy()
+	registeredDisk.Spec.FileSystem.MountPoint = "/mnt/disk"
+	legacyDisk := legacy(disk, "/dev/sdb")
+	legacyDisk.Spec.FileSystem.MountPoint = "/mnt/legacy"
+	legacyGone := legacy(disk, "/dev/sdz")
+	legacyGone.Status.DeviceStatus.Details.WWN = "eui.0000000000000000"
+
+	blockdevices := fakeclients.NewBlockDeviceController(legacyPart, registeredDisk, legacyDisk, legacyGone)
+	c, err := NewController(blockdevices, host, host.Info, filter.NewDefaultDeviceFilter(), &option.Option{
+		Namespace:            testNamespace,
+		NodeName:             testNodeName,
+		VanishedDevicePolicy: VanishedDevicePolicyInactive,
+		MountPersistence:     persistence.ModeNone,
+	})
+	if err != nil {
+		t.Fatalf("failed to create controller, error: %s", err.Error())
+	}
+	if err := c.migrateLegacyBlockDevices(); err != nil {
+		t.Fatalf("failed to migrate legacy block devices, error: %s", err.Error())
+	}
+	if err := c.RegisterNodeBlockDevices(); err != nil {
+		t.Fatalf("failed to register block devices, error: %s", err.Error())
+	}
+
+	for _, legacyBD := range []*diskv1.BlockDevice{legacyPart, legacyDisk, legacyGone} {
+		bd, err := blockdevices.Get(testNamespace, legacyBD.Name, metav1.GetOptions{})
+		if err == nil && bd.DeletionTimestamp == nil {
+			t.Errorf("expected legacy block device %s to be deleted", legacyBD.Name)
+		}
+	}
+
+	bd, err := blockdevices.Get(testNamespace, part.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected block device %s of the legacy partition, error: %s", part.Name, err.Error())
+	}
+	if bd.Spec.DevPath != "/dev/nvme0n1p2" || !reflect.DeepEqual(bd.Spec.FileSystem, legacyPart.Spec.FileSystem) {
+		t.Errorf("expected the spec of the legacy partition linked to /dev/nvme0n1p2, got %+v", bd.Spec)
+	}
+	if lastFormattedAt := bd.Status.DeviceStatus.FileSystem.LastFormattedAt; lastFormattedAt == nil ||
+		!lastFormattedAt.Equal(&formattedAt) {
+		t.Errorf("expected the format timestamp %s to be carried over, got %v", formattedAt, lastFormattedAt)
+	}
+
+	// the registered block device wins over the legacy one
+	if bd = mustGetBlockDevice(t, blockdevices, "/dev/nvme0n1"); bd.Spec.FileSystem.MountPoint != "/mnt/disk" {
+		t.Errorf("expected mount point /mnt/disk of the registered disk to be kept, got %q", bd.Spec.FileSystem.MountPoint)
+	}
+}
+
+func TestGetDiskIdentifier(t *testing.T) {
+	host := blocktest.NewHost(t, "multipath.tar.gz")
+	expected := map[string]string{
+		"dm-0": "dmuuid:mpath-3600a098038303053453f463045727a6b",
+		"sdb":  "wwn:0x600a098038303053453f463045727a6b",
+		"sdc":  "wwn:0x600a098038303053453f463045727a6b",
+	}
+	for name, identifier := range expected {
+		if got := GetDiskIdentifier(host.Info.GetDiskByName(name)); got != identifier {
+			t.Errorf("expected identifier %s of %s, got %s", identifier, name, got)
+		}
+	}
+}
+
+func TestDiskIdentityKeptOnNewPTUUID(t *testing.T) {
+	// the data disk has no serial number, so it's identified by its bus path rather than the PTUUID
+	host := blocktest.NewHost(t, "virtio.tar.gz")
+	host.WriteFile(t, "run/udev/data/b252:16", "E:ID_PATH=pci-0000:00:05.0\n")
+	if err := host.WritePartitionTable("/dev/vdb", "", nil); err != nil {
+		t.Fatalf("failed to partition the disk, error: %s", err.Error())
+	}
+	info, err := host.Info.Rescan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.Info = info
+	c, blockdevices := newHostTestController(t, host, VanishedDevicePolicyInactive)
+	disk := mustGetBlockDevice(t, blockdevices, "/dev/vdb")
+	ptUUID := disk.Status.DeviceStatus.Details.PtUUID
+
+	// the disk is partitioned again out of band, e.g. by sgdisk -G, which regenerates the PTUUID
+	if err := host.WritePartitionTable("/dev/vdb", "", nil); err != nil {
+		t.Fatalf("failed to partition the disk, error: %s", err.Error())
+	}
+	if err := c.ReconcileNodeBlockDevices(); err != nil {
+		t.Fatalf("failed to reconcile block devices, error: %s", err.Error())
+	}
+
+	if disks := getDiskNames(t, blockdevices); !reflect.DeepEqual(disks, []string{disk.Name}) {
+		t.Errorf("expected the only disk block device %s, got %v", disk.Name, disks)
+	}
+	bd := mustGetBlockDevice(t, blockdevices, "/dev/vdb")
+	if bd.UID != disk.UID {
+		t.Errorf("expected block device %s to be kept, got a new one", disk.Name)
+	}
+	if bd.Status.DeviceStatus.Details.PtUUID == ptUUID {
+		t.Errorf("expected the new PTUUID to be discovered, got %s", ptUUID)
+	}
+}
@@ -0,0 +1,125 @@
+package blockdevice
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	diskv1 "github.com/longhorn/node-disk-manager/pkg/apis/longhorn.io/v1beta1"
+	"github.com/longhorn/node-disk-manager/pkg/block"
+	"github.com/longhorn/node-disk-manager/pkg/util"
+)
+
+const (
+	// DeviceFinalizer blocks the deletion of the block device until the device is unmounted by the node it belongs to
+	DeviceFinalizer = "block.longhorn.io/device"
+
+	// LonghornDiskFinalizer blocks the deletion of the block device until its Longhorn disk is evicted and removed
+	LonghornDiskFinalizer = "block.longhorn.io/longhorn-disk"
+
+	// legacyFinalizer was added by the OnRemove handler, which is replaced by the DeviceFinalizer, since the
+	// handler of any node could remove it before the owning node releases the device
+	legacyFinalizer = "wrangler.cattle.io/" + blockDeviceHandlerName
+)
+
+// ensureFinalizerAndOwner adds the DeviceFinalizer to the block device, and the owner reference of the parent
+// disk to the partition, so the partitions are garbage collected by Kubernetes once the disk is deleted
+func (c *Controller) ensureFinalizerAndOwner(device *diskv1.BlockDevice) (*diskv1.BlockDevice, error) {
+	deviceCpy := device.DeepCopy()
+	util.AddFinalizer(deviceCpy, DeviceFinalizer)
+
+	if parentName := device.Labels[ParentDeviceLabel]; parentName != "" {
+		parent, err := c.BlockdeviceCache.Get(c.namespace, parentName)
+		if err != nil {
+			return device, fmt.Errorf("failed to get parent block device %s, error: %w", parentName, err)
+		}
+		setOwnerReference(deviceCpy, parent)
+	}
+
+	if len(deviceCpy.Finalizers) == len(device.Finalizers) &&
+		len(deviceCpy.OwnerReferences) == len(device.OwnerReferences) {
+		return device, nil
+	}
+	return c.Blockdevices.Update(deviceCpy)
+}
+
+// RemoveNodeFinalizers removes the finalizers released by the node the block device belongs to, so the block device of
+// a deleted node isn't left terminating once the agent of the node is gone. It returns false if there is none.
+func RemoveNodeFinalizers(device *diskv1.BlockDevice) bool {
+	removed := false
+	for _, finalizer := range []string{DeviceFinalizer, LonghornDiskFinalizer, legacyFinalizer} {
+		if util.RemoveFinalizer(device, finalizer) {
+			removed = true
+		}
+	}
+	return removed
+}
+
+func setOwnerReference(device, parent *diskv1.BlockDevice) {
+	for _, ref := range device.OwnerReferences {
+		if ref.UID == parent.UID {
+			return
+		}
+	}
+	device.OwnerReferences = append(device.OwnerReferences, metav1.OwnerReference{
+		APIVersion: diskv1.SchemeGroupVersion.String(),
+		Kind:       "BlockDevice",
+		Name:       parent.Name,
+		UID:        parent.UID,
+	})
+}
+
+// finalizeBlockDevice unmounts the device of the deleted block device before removing the DeviceFinalizer. The
+// device is released only after its Longhorn disk is removed, and the unmount is skipped if the device is gone.
+func (c *Controller) finalizeBlockDevice(device *diskv1.BlockDevice) (*diskv1.BlockDevice, error) {
+	if !util.HasFinalizer(device, DeviceFinalizer) && !util.HasFinalizer(device, legacyFinalizer) {
+		return device, nil
+	}
+
+	if util.HasFinalizer(device, LonghornDiskFinalizer) {
+		logrus.Debugf("Wait for the longhorn disk of block device %s to be removed", device.Name)
+		return device, nil
+	}
+
+	if mountPoint := c.getOwnedMountPoint(device); mountPoint != "" {
+		logrus.Infof("Unmount block device %s with device %s from %s", device.Name, device.Spec.DevPath, mountPoint)
+		if err := c.Host.Unmount(mountPoint, block.UnmountOptions{}); err != nil {
+			return device, fmt.Errorf("failed to unmount the device %s from path %s, error: %w",
+				device.Spec.DevPath, mountPoint, err)
+		}
+	}
+
+	if err := c.removePersistedMount(device.Status.DeviceStatus.Details.UUID); err != nil {
+		return device, fmt.Errorf("failed to remove the persisted mount of device %s, error: %w", device.Spec.DevPath, err)
+	}
+
+	deviceCpy := device.DeepCopy()
+	util.RemoveFinalizer(deviceCpy, DeviceFinalizer)
+	util.RemoveFinalizer(deviceCpy, legacyFinalizer)
+	return c.Blockdevices.Update(deviceCpy)
+}
+
+// getOwnedMountPoint returns the path that the device is mounted to by the controller, or "" if the device is not
+// mounted as specified or it is physically gone, e.g. the device path is taken by another disk after re-enumeration
+func (c *Controller) getOwnedMountPoint(device *diskv1.BlockDevice) string {
+	mountPoint := getSpecMountPoint(device.Spec.FileSystem)
+	if mountPoint == "" || !c.BlockInfo.IsDevicePresent(device.Spec.DevPath) {
+		return ""
+	}
+
+	diskName := c.BlockInfo.GetParentDiskName(device.Spec.DevPath)
+	if diskName == "" {
+		diskName = device.Spec.DevPath
+	}
+	for _, bd := range GetNewBlockDevices(c.BlockInfo.GetDiskByName(diskName), c.nodeName, c.namespace) {
+		if bd.Name == device.Name && bd.Spec.DevPath == device.Spec.DevPath {
+			if bd.Status.DeviceStatus.FileSystem.MountPoint == mountPoint {
+				return mountPoint
+			}
+			return ""
+		}
+	}
+	logrus.Infof("Skip unmounting block device %s, the device %s is gone", device.Name, device.Spec.DevPath)
+	return ""
+}
@@ -0,0 +1,116 @@
+package blockdevice
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	diskv1 "github.com/longhorn/node-disk-manager/pkg/apis/longhorn.io/v1beta1"
+	"github.com/longhorn/node-disk-manager/pkg/util"
+)
+
+// migrateLegacyBlockDevices replaces the block devices of the node that are named after the kernel device names,
+// e.g. "sda-node1", which were created before the block devices were named after the stable identifiers. The kernel
+// name of a legacy block device may be taken by another disk by now, so its physical device is found by the
+// identifiers recorded in its status instead. The user-owned spec and the format timestamp are carried over to the
+// block device of the physical device unless it's registered already, then the legacy block device is deleted. Its
+// finalizers don't unmount the device, since the device isn't linked to the legacy name anymore.
+func (c *Controller) migrateLegacyBlockDevices() error {
+	bdList, err := c.Blockdevices.List(c.namespace, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(map[string]string{
+			v1.LabelHostname: c.nodeName,
+		}).String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool, len(bdList.Items))
+	legacyBDs := make([]*diskv1.BlockDevice, 0)
+	for i := range bdList.Items {
+		bd := &bdList.Items[i]
+		existing[bd.Name] = true
+		if bd.Name == getLegacyBlockDeviceName(bd.Spec.DevPath, c.nodeName) {
+			legacyBDs = append(legacyBDs, bd)
+		}
+	}
+	if len(legacyBDs) == 0 {
+		return nil
+	}
+
+	discovered := make(map[string]*diskv1.BlockDevice)
+	for _, bd := range c.scanBlockDevices(c.BlockInfo) {
+		discovered[bd.Name] = bd
+	}
+
+	for _, legacyBD := range legacyBDs {
+		name := getLegacyIdentifiedName(legacyBD, c.nodeName)
+		switch bd, ok := discovered[name]; {
+		case name == "" || !ok:
+			logrus.Infof("Delete legacy block device %s, its device is not found", legacyBD.Name)
+		case existing[name]:
+			logrus.Infof("Delete legacy block device %s, its device is registered as %s", legacyBD.Name, name)
+		default:
+			logrus.Infof("Migrate legacy block device %s to %s with device: %s", legacyBD.Name, name, bd.Spec.DevPath)
+			bd.Spec.FileSystem = legacyBD.Spec.FileSystem
+			bd.Spec.LonghornDisk = legacyBD.Spec.LonghornDisk
+			bd.Spec.PartitionTable = legacyBD.Spec.PartitionTable
+			// the device must not be formatted again once the force formatting is carried over
+			bd.Status.DeviceStatus.FileSystem.LastFormattedAt = legacyBD.Status.DeviceStatus.FileSystem.LastFormattedAt
+			if err := c.createBlockDevice(bd); err != nil {
+				return fmt.Errorf("failed to migrate legacy block device %s, error: %w", legacyBD.Name, err)
+			}
+			existing[name] = true
+		}
+
+		err := c.Blockdevices.Delete(c.namespace, legacyBD.Name, &metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete legacy block device %s, error: %w", legacyBD.Name, err)
+		}
+	}
+	return nil
+}
+
+// getLegacyBlockDeviceName returns the legacy name of the block device of the device path, which is the kernel name
+// of the device suffixed with the node name
+func getLegacyBlockDeviceName(devPath, nodeName string) string {
+	return fmt.Sprintf("%s-%s", strings.TrimPrefix(devPath, "/dev/"), nodeName)
+}
+
+// getLegacyIdentifiedName returns the name of the block device of the physical device of the legacy block device,
+// the identifier is derived from the details in its status in the same order as GetDiskIdentifier and
+// GetPartitionIdentifier. It returns "" if the device can only be identified by its kernel name.
+func getLegacyIdentifiedName(bd *diskv1.BlockDevice, nodeName string) string {
+	details := bd.Status.DeviceStatus.Details
+	var identifier string
+	switch {
+	case details.DeviceType == diskv1.DeviceTypePart && isKnown(details.PartUUID):
+		identifier = "partuuid:" + details.PartUUID
+	case isKnown(details.WWN):
+		identifier = "wwn:" + details.WWN
+	case isKnown(details.SerialNumber):
+		identifier = fmt.Sprintf("serial:%s/%s", details.Model, details.SerialNumber)
+	case isKnown(details.BusPath):
+		identifier = "buspath:" + details.BusPath
+	case isKnown(details.PtUUID):
+		identifier = "ptuuid:" + details.PtUUID
+	default:
+		return ""
+	}
+
+	if details.DeviceType == diskv1.DeviceTypePart && !strings.HasPrefix(identifier, "partuuid:") {
+		// the partition has the details of its disk, it's identified by the disk and the partition number
+		parent := strings.TrimPrefix(bd.Status.DeviceStatus.ParentDevice, "/dev/")
+		part := strings.TrimPrefix(bd.Spec.DevPath, "/dev/")
+		if parent == "" || !strings.HasPrefix(part, parent) {
+			return ""
+		}
+		identifier = fmt.Sprintf("%s/part:%s", identifier, strings.TrimPrefix(part, parent))
+	}
+	return util.GetBlockDeviceName(identifier, nodeName)
+}
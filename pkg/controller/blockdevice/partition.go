@@ -0,0 +1,109 @@
+package blockdevice
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	diskv1 "github.com/longhorn/node-disk-manager/pkg/apis/longhorn.io/v1beta1"
+	"github.com/longhorn/node-disk-manager/pkg/block"
+)
+
+// reconcilePartitionTable creates the GPT partition table specified on the disk. The existing partitions and
+// filesystem of the disk are overwritten only if the device is force formatted, and the disk is not partitioned
+// again once it has the specified partition table. The partitions are registered as the block devices right away.
+func (c *Controller) reconcilePartitionTable(device *diskv1.BlockDevice) (*diskv1.BlockDevice, error) {
+	deviceCpy := device.DeepCopy()
+	devPath := device.Spec.DevPath
+
+	if err := c.partitionDevice(deviceCpy); err != nil {
+		diskv1.DevicePartitioned.SetError(deviceCpy, getRefusalReason(err), fmt.Errorf("failed to partition the device %s, error: %s",
+			devPath, err.Error()))
+	} else {
+		diskv1.DevicePartitioned.SetError(deviceCpy, "", nil)
+	}
+
+	return c.updateHandledStatus(device, deviceCpy)
+}
+
+func (c *Controller) partitionDevice(device *diskv1.BlockDevice) error {
+	if device.Status.DeviceStatus.Details.DeviceType != diskv1.DeviceTypeDisk {
+		return fmt.Errorf("the partition table can only be created on a disk")
+	}
+	if device.Spec.FileSystem.MountPoint != "" {
+		return fmt.Errorf("the disk with a partition table can not be mounted, the mount point must be empty")
+	}
+
+	devPath := device.Spec.DevPath
+	partitions, err := getGPTPartitions(device.Spec.PartitionTable)
+	if err != nil {
+		return err
+	}
+	applied, err := c.Host.IsPartitionTableApplied(devPath, partitions)
+	if err != nil || applied {
+		return err
+	}
+
+	if err := c.BlockInfo.CheckDeviceNotInUse(devPath); err != nil {
+		return err
+	}
+	disk := c.BlockInfo.GetDiskByName(devPath)
+	if (len(disk.Partitions) > 0 || disk.FileSystemInfo.FsType != "") && !device.Spec.FileSystem.ForceFormatted {
+		return fmt.Errorf("the disk contains partitions or a filesystem, force formatting is required to overwrite them")
+	}
+
+	logrus.Infof("Create the partition table of disk %s with %d partitions", devPath, len(partitions))
+	for _, part := range disk.Partitions {
+		if err := c.Host.WipeFilesystem(getFullDevPath(part.Name)); err != nil {
+			return err
+		}
+	}
+	if err := c.Host.WipeFilesystem(devPath); err != nil {
+		return err
+	}
+	// the PTUUID erased by the wiping is written again, so the disk identified by it keeps its block device
+	if err := c.Host.WritePartitionTable(devPath, disk.PtUUID, partitions); err != nil {
+		return err
+	}
+	return c.registerPartitions(device)
+}
+
+// registerPartitions saves the block devices of the new partitions of the disk as the children of the block device
+// of the disk, which is left to the caller so its spec is not overwritten
+func (c *Controller) registerPartitions(device *diskv1.BlockDevice) error {
+	bds := GetNewBlockDevices(c.BlockInfo.GetDiskByName(device.Spec.DevPath), c.nodeName, c.namespace)
+	bdList, err := c.BlockdeviceCache.List(c.namespace, labels.SelectorFromSet(map[string]string{
+		v1.LabelHostname: c.nodeName,
+	}))
+	if err != nil {
+		return err
+	}
+	// the first one is the block device of the disk itself
+	for _, bd := range bds[1:] {
+		bd.Labels[ParentDeviceLabel] = device.Name
+		if err := c.SaveBlockDevice(bd, bdList); err != nil {
+			return fmt.Errorf("failed to save block device %s, error: %w", bd.Name, err)
+		}
+	}
+	return nil
+}
+
+func getGPTPartitions(spec *diskv1.PartitionTableSpec) ([]block.GPTPartition, error) {
+	partitions := make([]block.GPTPartition, 0, len(spec.Partitions))
+	for i, part := range spec.Partitions {
+		partition := block.GPTPartition{
+			Name:     part.Name,
+			TypeGUID: part.TypeGUID,
+		}
+		if part.Size != nil {
+			if part.Size.Sign() <= 0 {
+				return nil, fmt.Errorf("size of partition %d must be positive", i+1)
+			}
+			partition.SizeBytes = uint64(part.Size.Value())
+		}
+		partitions = append(partitions, partition)
+	}
+	return partitions, nil
+}
@@ -0,0 +1,89 @@
+package blockdevice
+
+import (
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	diskv1 "github.com/longhorn/node-disk-manager/pkg/apis/longhorn.io/v1beta1"
+	"github.com/longhorn/node-disk-manager/pkg/persistence"
+)
+
+// persistMount records the mount of the block device on the host if the persistence is enabled
+func (c *Controller) persistMount(device *diskv1.BlockDevice) error {
+	if c.persister == nil {
+		return nil
+	}
+	mount, ok := getPersistentMount(device)
+	if !ok {
+		return nil
+	}
+	return c.persister.Persist(mount)
+}
+
+// removePersistedMount removes the record of the filesystem UUID from the host if the persistence is enabled
+func (c *Controller) removePersistedMount(uuid string) error {
+	if c.persister == nil || uuid == "" {
+		return nil
+	}
+	return c.persister.Remove(uuid)
+}
+
+// reconcilePersistedMounts records the mounts of the block devices of the node, and removes the orphaned records
+// of the filesystems that are not mounted as specified anymore, e.g. the ones unmounted while the agent was down
+func (c *Controller) reconcilePersistedMounts() error {
+	if c.persister == nil {
+		return nil
+	}
+
+	bdList, err := c.Blockdevices.List(c.namespace, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(map[string]string{v1.LabelHostname: c.nodeName}).String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	expected := make(map[string]bool)
+	for i := range bdList.Items {
+		mount, ok := getPersistentMount(&bdList.Items[i])
+		if !ok || bdList.Items[i].DeletionTimestamp != nil {
+			continue
+		}
+		if err := c.persister.Persist(mount); err != nil {
+			return err
+		}
+		expected[mount.UUID] = true
+	}
+
+	persisted, err := c.persister.List()
+	if err != nil {
+		return err
+	}
+	for _, mount := range persisted {
+		if expected[mount.UUID] {
+			continue
+		}
+		logrus.Infof("Remove the orphaned persisted mount of filesystem %s to %s", mount.UUID, mount.MountPoint)
+		if err := c.persister.Remove(mount.UUID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getPersistentMount returns the mount to be persisted, it returns false if the device is not mounted as specified
+func getPersistentMount(device *diskv1.BlockDevice) (persistence.Mount, bool) {
+	fs := device.Spec.FileSystem
+	fsStatus := device.Status.DeviceStatus.FileSystem
+	uuid := device.Status.DeviceStatus.Details.UUID
+	if _, valid := isValidFileSystem(fs, fsStatus); !valid || fsStatus.MountPoint == "" || uuid == "" {
+		return persistence.Mount{}, false
+	}
+	return persistence.Mount{
+		UUID:       uuid,
+		MountPoint: fsStatus.MountPoint,
+		FsType:     fsStatus.Type,
+		Options:    getMountOptions(fs),
+	}, true
+}
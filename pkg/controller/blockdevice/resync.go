@@ -0,0 +1,111 @@
+package blockdevice
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	diskv1 "github.com/longhorn/node-disk-manager/pkg/apis/longhorn.io/v1beta1"
+)
+
+const (
+	// VanishedDevicePolicyInactive marks the block device of a vanished device as Inactive
+	VanishedDevicePolicyInactive = "inactive"
+	// VanishedDevicePolicyDelete deletes the block device of a vanished device
+	VanishedDevicePolicyDelete = "delete"
+)
+
+// runPeriodicRescan reconciles the block devices of the node on every interval, it recovers from the udev events
+// that are missed, e.g. when the netlink buffer overflows or the agent is restarting
+func (c *Controller) runPeriodicRescan(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.ReconcileNodeBlockDevices(); err != nil {
+				logrus.Errorf("failed to reconcile block devices of node %s, error: %s", c.nodeName, err.Error())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ReconcileNodeBlockDevices rescans the node and diffs the inventory against the block devices of the node, the
+// missing block devices are created, the drifted ones are updated and the vanished ones are handled by the policy
+func (c *Controller) ReconcileNodeBlockDevices() error {
+	logrus.Debugf("Reconcile block devices of node: %s", c.nodeName)
+	info, err := c.BlockInfo.Rescan()
+	if err != nil {
+		return err
+	}
+	bds := c.scanBlockDevices(info)
+
+	bdList, err := c.Blockdevices.List(c.namespace, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(map[string]string{
+			v1.LabelHostname: c.nodeName,
+		}).String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	existingBDs := make(map[string]*diskv1.BlockDevice, len(bdList.Items))
+	for i := range bdList.Items {
+		existingBDs[bdList.Items[i].Name] = &bdList.Items[i]
+	}
+
+	for _, bd := range bds {
+		existingBD, ok := existingBDs[bd.Name]
+		if !ok {
+			logrus.Infof("Add missing block device %s with device: %s", bd.Name, bd.Spec.DevPath)
+			if err := c.createBlockDevice(bd); err != nil {
+				return err
+			}
+			continue
+		}
+		delete(existingBDs, bd.Name)
+
+		if isDiscoveredBlockDeviceChanged(existingBD, bd) {
+			logrus.Infof("Update drifted block device %s with device: %s", bd.Name, bd.Spec.DevPath)
+			if err := c.updateDiscoveredBlockDevice(existingBD, bd); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, vanishedBD := range existingBDs {
+		if err := c.handleVanishedBlockDevice(vanishedBD); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Controller) handleVanishedBlockDevice(bd *diskv1.BlockDevice) error {
+	switch c.vanishedDevicePolicy {
+	case VanishedDevicePolicyDelete:
+		logrus.Infof("Delete vanished block device %s with device: %s", bd.Name, bd.Spec.DevPath)
+		if err := c.Blockdevices.Delete(c.namespace, bd.Name, &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	default:
+		if bd.Status.State == diskv1.BlockDeviceInactive {
+			return nil
+		}
+		logrus.Infof("Deactivate vanished block device %s with device: %s", bd.Name, bd.Spec.DevPath)
+		if _, err := c.UpdateBlockDeviceStatus(bd, func(device *diskv1.BlockDevice) {
+			device.Status.State = diskv1.BlockDeviceInactive
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package blockdevice
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	diskv1 "github.com/longhorn/node-disk-manager/pkg/apis/longhorn.io/v1beta1"
+)
+
+// maxConflictRetries is the number of times a write conflicting with a concurrent update is retried
+const maxConflictRetries = 5
+
+// UpdateBlockDeviceStatus applies the mutation to the status of the block device and writes it through the status
+// subresource. The mutation is applied again to the latest block device if the write conflicts, so it must only set
+// the fields owned by the caller. Nothing is written if the mutation doesn't change the block device.
+func (c *Controller) UpdateBlockDeviceStatus(device *diskv1.BlockDevice, mutate func(*diskv1.BlockDevice)) (*diskv1.BlockDevice, error) {
+	return c.retryOnConflict(device, mutate, c.Blockdevices.UpdateStatus)
+}
+
+// updateBlockDevice is UpdateBlockDeviceStatus of the spec and metadata of the block device, the status is ignored
+func (c *Controller) updateBlockDevice(device *diskv1.BlockDevice, mutate func(*diskv1.BlockDevice)) (*diskv1.BlockDevice, error) {
+	return c.retryOnConflict(device, mutate, c.Blockdevices.Update)
+}
+
+func (c *Controller) retryOnConflict(device *diskv1.BlockDevice, mutate func(*diskv1.BlockDevice),
+	update func(*diskv1.BlockDevice) (*diskv1.BlockDevice, error)) (*diskv1.BlockDevice, error) {
+	for retries := 0; ; retries++ {
+		toUpdate := device.DeepCopy()
+		mutate(toUpdate)
+		if reflect.DeepEqual(device, toUpdate) {
+			return device, nil
+		}
+
+		updated, err := update(toUpdate)
+		if !errors.IsConflict(err) || retries >= maxConflictRetries {
+			return updated, err
+		}
+		logrus.Debugf("Retry updating block device %s on the latest version, error: %s", device.Name, err.Error())
+		if device, err = c.Blockdevices.Get(device.Namespace, device.Name, metav1.GetOptions{}); err != nil {
+			return device, err
+		}
+	}
+}
+
+// createBlockDevice creates the discovered block device, its status is written afterwards as the status subresource
+// drops the status of the created object. The block device created meanwhile, e.g. by the udev handler while the
+// node is rescanned, is updated with the discovered device instead. The error of writing the status is returned, so
+// the discovery is retried rather than leaving the created block device without status.
+func (c *Controller) createBlockDevice(bd *diskv1.BlockDevice) error {
+	created, err := c.Blockdevices.Create(bd)
+	if errors.IsAlreadyExists(err) {
+		existing, err := c.Blockdevices.Get(bd.Namespace, bd.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if !isDiscoveredBlockDeviceChanged(existing, bd) {
+			return nil
+		}
+		return c.updateDiscoveredBlockDevice(existing, bd)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the mount point discovered at the registration is specified, so it's released once the user changes it
+	if _, err := c.UpdateBlockDeviceStatus(created, func(device *diskv1.BlockDevice) {
+		bd.Status.DeepCopyInto(&device.Status)
+		device.Status.DeviceStatus.FileSystem.AppliedMountPoint = getSpecMountPoint(bd.Spec.FileSystem)
+	}); err != nil {
+		return fmt.Errorf("failed to write the status of created block device %s, error: %w", bd.Name, err)
+	}
+	return nil
+}
+
+// updateDiscoveredBlockDevice relinks the existing block device to the discovered device path and updates its
+// discovered status. The rest of the spec is owned by the user, so it's never overwritten by the discovery.
+func (c *Controller) updateDiscoveredBlockDevice(existing, discovered *diskv1.BlockDevice) error {
+	if existing.Spec.DevPath != discovered.Spec.DevPath {
+		logrus.Infof("Relink block device %s from %s to %s", existing.Name, existing.Spec.DevPath, discovered.Spec.DevPath)
+		updated, err := c.updateBlockDevice(existing, func(device *diskv1.BlockDevice) {
+			device.Spec.DevPath = discovered.Spec.DevPath
+		})
+		if err != nil {
+			return err
+		}
+		existing = updated
+	}
+
+	_, err := c.UpdateBlockDeviceStatus(existing, func(device *diskv1.BlockDevice) {
+		setDiscoveredStatus(device, discovered)
+	})
+	return err
+}
+
+// isDiscoveredBlockDeviceChanged returns true if the existing block device is not up to date with the discovered one
+func isDiscoveredBlockDeviceChanged(existing, discovered *diskv1.BlockDevice) bool {
+	toUpdate := existing.DeepCopy()
+	toUpdate.Spec.DevPath = discovered.Spec.DevPath
+	setDiscoveredStatus(toUpdate, discovered)
+	return !reflect.DeepEqual(existing, toUpdate)
+}
+
+// setDiscoveredStatus sets the state and device status of the block device of the discovered device, the format
+// timestamp and the applied mount point are owned by the controller as they can't be discovered
+func setDiscoveredStatus(device, discovered *diskv1.BlockDevice) {
+	lastFormattedAt := device.Status.DeviceStatus.FileSystem.LastFormattedAt
+	appliedMountPoint := device.Status.DeviceStatus.FileSystem.AppliedMountPoint
+	device.Status.State = diskv1.BlockDeviceActive
+	discovered.Status.DeviceStatus.DeepCopyInto(&device.Status.DeviceStatus)
+	device.Status.DeviceStatus.FileSystem.LastFormattedAt = lastFormattedAt
+	device.Status.DeviceStatus.FileSystem.AppliedMountPoint = appliedMountPoint
+}
+
+// updateHandledStatus writes the status of the block device handled by OnBlockDeviceChange. The conditions and the
+// filesystem observed by the handler are applied to the latest block device if the write conflicts, the rest of the
+// status is owned by the discovery.
+func (c *Controller) updateHandledStatus(device, handled *diskv1.BlockDevice) (*diskv1.BlockDevice, error) {
+	return c.UpdateBlockDeviceStatus(device, func(latest *diskv1.BlockDevice) {
+		status := handled.Status.DeepCopy()
+		latest.Status.Conditions = status.Conditions
+		latest.Status.DeviceStatus.FileSystem = status.DeviceStatus.FileSystem
+		latest.Status.DeviceStatus.Details.UUID = status.DeviceStatus.Details.UUID
+	})
+}
@@ -0,0 +1,187 @@
+package node
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/longhorn/longhorn-manager/types"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+
+	longhornv1 "github.com/longhorn/node-disk-manager/pkg/apis/longhorn.io/v1beta1"
+	"github.com/longhorn/node-disk-manager/pkg/controller/blockdevice"
+	"github.com/longhorn/node-disk-manager/pkg/util"
+)
+
+const (
+	blockDeviceDiskHandlerName = "longhorn-ndm-node-disk-handler"
+
+	evictionCheckInterval = 10 * time.Second
+)
+
+// OnBlockDeviceChange watch the block device CR on change and registers the mounted block device as a disk of the
+// Longhorn node, the disk is keyed by the block device name which is derived from the stable identifier of the device.
+// The disk is evicted and removed from the Longhorn node when the mount point is changed or the block device is deleted.
+func (c *Controller) OnBlockDeviceChange(key string, bd *longhornv1.BlockDevice) (*longhornv1.BlockDevice, error) {
+	if bd == nil || bd.Spec.NodeName != c.nodeName {
+		return bd, nil
+	}
+
+	node, err := c.Nodes.Cache().Get(c.namespace, c.nodeName)
+	if errors.IsNotFound(err) {
+		logrus.Debugf("Skip syncing disk of block device %s, longhorn node %s is not found", bd.Name, c.nodeName)
+		if bd.DeletionTimestamp != nil {
+			return c.removeFinalizer(bd)
+		}
+		return bd, nil
+	}
+	if err != nil {
+		return bd, err
+	}
+
+	disk, registered := node.Spec.Disks[bd.Name]
+	if bd.DeletionTimestamp != nil || (registered && disk.Path != getSpecMountPoint(bd)) {
+		bd, removed, err := c.removeLonghornDisk(bd, node)
+		if err != nil || !removed {
+			return bd, err
+		}
+		return c.removeFinalizer(bd)
+	}
+
+	if !isMountedAsSpecified(bd) {
+		return bd, nil
+	}
+
+	diskSpec := getLonghornDiskSpec(bd)
+	// the eviction could be requested from Longhorn as well, it's kept as is
+	diskSpec.EvictionRequested = disk.EvictionRequested
+	for name, disk := range node.Spec.Disks {
+		if name != bd.Name && disk.Path == diskSpec.Path {
+			logrus.Warnf("Skip registering block device %s, the path %s is already used by disk %s of node %s",
+				bd.Name, diskSpec.Path, name, c.nodeName)
+			return bd, nil
+		}
+	}
+
+	if registered && reflect.DeepEqual(disk, diskSpec) {
+		return bd, nil
+	}
+
+	if bd, err = c.addFinalizer(bd); err != nil {
+		return bd, err
+	}
+
+	logrus.Infof("Register block device %s as disk of longhorn node %s with path %s", bd.Name, c.nodeName, diskSpec.Path)
+	nodeCpy := node.DeepCopy()
+	if nodeCpy.Spec.Disks == nil {
+		nodeCpy.Spec.Disks = make(map[string]types.DiskSpec)
+	}
+	nodeCpy.Spec.Disks[bd.Name] = diskSpec
+	if _, err := c.Nodes.Update(nodeCpy); err != nil {
+		return bd, err
+	}
+	return bd, nil
+}
+
+// removeLonghornDisk disables the scheduling and requests the eviction of the Longhorn disk of the block device,
+// the disk is dropped from the Longhorn node once its status reports all of its replicas are evicted. It returns true
+// once the disk is removed from the Longhorn node.
+func (c *Controller) removeLonghornDisk(bd *longhornv1.BlockDevice, node *longhornv1.Node) (*longhornv1.BlockDevice, bool, error) {
+	disk, ok := node.Spec.Disks[bd.Name]
+	if !ok {
+		return bd, true, nil
+	}
+
+	removed := false
+	nodeCpy := node.DeepCopy()
+	var setRemoved func(bd *longhornv1.BlockDevice)
+	if disk.AllowScheduling || !disk.EvictionRequested {
+		logrus.Infof("Request eviction of disk %s of longhorn node %s", bd.Name, c.nodeName)
+		disk.AllowScheduling = false
+		disk.EvictionRequested = true
+		nodeCpy.Spec.Disks[bd.Name] = disk
+		message := fmt.Sprintf("waiting for the replicas to be evicted from %s", disk.Path)
+		setRemoved = func(bd *longhornv1.BlockDevice) { setLonghornDiskEvicting(bd, message) }
+	} else if diskStatus, ok := node.Status.DiskStatus[bd.Name]; !ok || diskStatus == nil {
+		// the replicas of the disk are unknown until Longhorn reports its status
+		message := fmt.Sprintf("waiting for the status of the disk on %s to be reported", disk.Path)
+		setRemoved = func(bd *longhornv1.BlockDevice) { setLonghornDiskEvicting(bd, message) }
+	} else if len(diskStatus.ScheduledReplica) > 0 {
+		message := fmt.Sprintf("waiting for %d replicas to be evicted from %s", len(diskStatus.ScheduledReplica), disk.Path)
+		setRemoved = func(bd *longhornv1.BlockDevice) { setLonghornDiskEvicting(bd, message) }
+	} else {
+		logrus.Infof("Remove evicted disk %s from longhorn node %s", bd.Name, c.nodeName)
+		delete(nodeCpy.Spec.Disks, bd.Name)
+		setRemoved = func(bd *longhornv1.BlockDevice) { longhornv1.LonghornDiskRemoved.SetError(bd, "Removed", nil) }
+		removed = true
+	}
+
+	if !reflect.DeepEqual(node, nodeCpy) {
+		if _, err := c.Nodes.Update(nodeCpy); err != nil {
+			return bd, false, err
+		}
+	}
+	if !removed {
+		// the eviction progress is reported by the Longhorn node status, check it again later
+		c.BlockDevices.EnqueueAfter(bd.Namespace, bd.Name, evictionCheckInterval)
+	}
+	updated, err := c.blockDeviceController.UpdateBlockDeviceStatus(bd, setRemoved)
+	return updated, removed, err
+}
+
+func setLonghornDiskEvicting(bd *longhornv1.BlockDevice, message string) {
+	longhornv1.LonghornDiskRemoved.False(bd)
+	longhornv1.LonghornDiskRemoved.Reason(bd, "Evicting")
+	longhornv1.LonghornDiskRemoved.Message(bd, message)
+}
+
+func (c *Controller) addFinalizer(bd *longhornv1.BlockDevice) (*longhornv1.BlockDevice, error) {
+	bdCpy := bd.DeepCopy()
+	if !util.AddFinalizer(bdCpy, blockdevice.LonghornDiskFinalizer) {
+		return bd, nil
+	}
+	return c.BlockDevices.Update(bdCpy)
+}
+
+func (c *Controller) removeFinalizer(bd *longhornv1.BlockDevice) (*longhornv1.BlockDevice, error) {
+	bdCpy := bd.DeepCopy()
+	if !util.RemoveFinalizer(bdCpy, blockdevice.LonghornDiskFinalizer) {
+		return bd, nil
+	}
+	return c.BlockDevices.Update(bdCpy)
+}
+
+// isMountedAsSpecified returns true if the block device is mounted to the mount point of the spec
+func isMountedAsSpecified(bd *longhornv1.BlockDevice) bool {
+	mountPoint := getSpecMountPoint(bd)
+	return mountPoint != "" &&
+		longhornv1.DeviceMounted.IsTrue(bd) &&
+		bd.Status.DeviceStatus.FileSystem.MountPoint == mountPoint
+}
+
+func getLonghornDiskSpec(bd *longhornv1.BlockDevice) types.DiskSpec {
+	allowScheduling := true
+	if bd.Spec.LonghornDisk.AllowScheduling != nil {
+		allowScheduling = *bd.Spec.LonghornDisk.AllowScheduling
+	}
+	tags := bd.Spec.LonghornDisk.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return types.DiskSpec{
+		Path:            getSpecMountPoint(bd),
+		AllowScheduling: allowScheduling,
+		StorageReserved: bd.Spec.LonghornDisk.StorageReserved,
+		Tags:            tags,
+	}
+}
+
+func getSpecMountPoint(bd *longhornv1.BlockDevice) string {
+	mountPoint := bd.Spec.FileSystem.MountPoint
+	if len(mountPoint) > 1 {
+		mountPoint = strings.TrimSuffix(mountPoint, "/")
+	}
+	return mountPoint
+}
@@ -0,0 +1,279 @@
+package node
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/longhorn/longhorn-manager/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	longhornv1 "github.com/longhorn/node-disk-manager/pkg/apis/longhorn.io/v1beta1"
+	"github.com/longhorn/node-disk-manager/pkg/block/blocktest"
+	"github.com/longhorn/node-disk-manager/pkg/controller/blockdevice"
+	"github.com/longhorn/node-disk-manager/pkg/filter"
+	"github.com/longhorn/node-disk-manager/pkg/option"
+	"github.com/longhorn/node-disk-manager/pkg/persistence"
+	"github.com/longhorn/node-disk-manager/pkg/util"
+	"github.com/longhorn/node-disk-manager/pkg/util/fakeclients"
+)
+
+const testDiskPath = "/var/lib/longhorn-disk"
+
+// newTestController returns the controller of the node testNodeName with the host of the snapshot
+func newTestController(t *testing.T, snapshot string, blockdevices *fakeclients.BlockDeviceController,
+	nodes *fakeclients.NodeController) *Controller {
+	t.Helper()
+	host := blocktest.NewHost(t, snapshot)
+	blockDeviceController, err := blockdevice.NewController(blockdevices, host, host.Info, filter.NewDefaultDeviceFilter(),
+		&option.Option{
+			Namespace:            testNamespace,
+			NodeName:             testNodeName,
+			VanishedDevicePolicy: blockdevice.VanishedDevicePolicyInactive,
+			MountPersistence:     persistence.ModeNone,
+		})
+	if err != nil {
+		t.Fatalf("failed to create block device controller, error: %s", err.Error())
+	}
+	return &Controller{
+		namespace:             testNamespace,
+		nodeName:              testNodeName,
+		BlockDevices:          blockdevices,
+		BlockDeviceCache:      blockdevices.Cache(),
+		Nodes:                 nodes,
+		BlockInfo:             host.Info,
+		blockDeviceController: blockDeviceController,
+	}
+}
+
+// newMountedBlockDevice returns the block device mounted to the path as specified
+func newMountedBlockDevice(name, mountPoint string, finalizers ...string) *longhornv1.BlockDevice {
+	bd := newBlockDevice(name, testNodeName, finalizers...)
+	bd.Spec.FileSystem.MountPoint = mountPoint
+	bd.Status.DeviceStatus.FileSystem.MountPoint = mountPoint
+	longhornv1.DeviceMounted.SetStatusBool(bd, true)
+	return bd
+}
+
+func newNode(disks map[string]types.DiskSpec) *longhornv1.Node {
+	return &longhornv1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: testNodeName, Namespace: testNamespace},
+		Spec:       types.NodeSpec{Disks: disks},
+	}
+}
+
+// syncBlockDevice calls the handler with the stored block device, as the controller does once it's changed
+func syncBlockDevice(t *testing.T, c *Controller, blockdevices *fakeclients.BlockDeviceController, name string) {
+	t.Helper()
+	bd, err := blockdevices.Get(testNamespace, name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.OnBlockDeviceChange(testNamespace+"/"+name, bd); err != nil {
+		t.Fatalf("failed to sync block device %s, error: %s", name, err.Error())
+	}
+}
+
+func mustGetNode(t *testing.T, nodes *fakeclients.NodeController) *longhornv1.Node {
+	t.Helper()
+	node, err := nodes.Get(testNamespace, testNodeName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+func TestRegisterLonghornDisk(t *testing.T) {
+	allowScheduling := false
+	tests := []struct {
+		name     string
+		bd       *longhornv1.BlockDevice
+		disks    map[string]types.DiskSpec
+		expected map[string]types.DiskSpec
+	}{
+		{
+			name: "mounted block device is registered",
+			bd:   newMountedBlockDevice("disk", testDiskPath),
+			expected: map[string]types.DiskSpec{
+				"disk": {Path: testDiskPath, AllowScheduling: true, Tags: []string{}},
+			},
+		},
+		{
+			name: "disk spec of the block device",
+			bd: func() *longhornv1.BlockDevice {
+				bd := newMountedBlockDevice("disk", testDiskPath+"/")
+				bd.Status.DeviceStatus.FileSystem.MountPoint = testDiskPath
+				bd.Spec.LonghornDisk.AllowScheduling = &allowScheduling
+				bd.Spec.LonghornDisk.StorageReserved = 1 << 30
+				bd.Spec.LonghornDisk.Tags = []string{"ssd"}
+				return bd
+			}(),
+			expected: map[string]types.DiskSpec{
+				"disk": {Path: testDiskPath, AllowScheduling: false, StorageReserved: 1 << 30, Tags: []string{"ssd"}},
+			},
+		},
+		{
+			name: "block device not mounted as specified is skipped",
+			bd: func() *longhornv1.BlockDevice {
+				bd := newMountedBlockDevice("disk", testDiskPath)
+				bd.Status.DeviceStatus.FileSystem.MountPoint = ""
+				longhornv1.DeviceMounted.SetStatusBool(bd, false)
+				return bd
+			}(),
+			expected: map[string]types.DiskSpec{},
+		},
+		{
+			name:     "path used by another disk is skipped",
+			bd:       newMountedBlockDevice("disk", testDiskPath),
+			disks:    map[string]types.DiskSpec{"default-disk": {Path: testDiskPath, AllowScheduling: true}},
+			expected: map[string]types.DiskSpec{"default-disk": {Path: testDiskPath, AllowScheduling: true}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			disks := test.disks
+			if disks == nil {
+				disks = map[string]types.DiskSpec{}
+			}
+			blockdevices := fakeclients.NewBlockDeviceController(test.bd)
+			nodes := fakeclients.NewNodeController(newNode(disks))
+			c := newTestController(t, "nvme.tar.gz", blockdevices, nodes)
+			syncBlockDevice(t, c, blockdevices, test.bd.Name)
+
+			node := mustGetNode(t, nodes)
+			if !reflect.DeepEqual(node.Spec.Disks, test.expected) {
+				t.Errorf("expected disks %+v, got %+v", test.expected, node.Spec.Disks)
+			}
+			bd, _ := blockdevices.Get(testNamespace, test.bd.Name, metav1.GetOptions{})
+			_, registered := test.expected[test.bd.Name]
+			if util.HasFinalizer(bd, blockdevice.LonghornDiskFinalizer) != registered {
+				t.Errorf("expected finalizer %s of the registered disk, got finalizers %v",
+					blockdevice.LonghornDiskFinalizer, bd.Finalizers)
+			}
+
+			// the registered disk is not updated again
+			syncBlockDevice(t, c, blockdevices, test.bd.Name)
+			if got := mustGetNode(t, nodes); got.ResourceVersion != node.ResourceVersion {
+				t.Errorf("expected longhorn node not to be updated again, got disks %+v", got.Spec.Disks)
+			}
+		})
+	}
+}
+
+func TestRemoveLonghornDisk(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove func(t *testing.T, blockdevices *fakeclients.BlockDeviceController)
+	}{
+		{
+			name: "deleted block device",
+			remove: func(t *testing.T, blockdevices *fakeclients.BlockDeviceController) {
+				if err := blockdevices.Delete(testNamespace, "disk", &metav1.DeleteOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "changed mount point",
+			remove: func(t *testing.T, blockdevices *fakeclients.BlockDeviceController) {
+				bd, _ := blockdevices.Get(testNamespace, "disk", metav1.GetOptions{})
+				bd.Spec.FileSystem.MountPoint = testDiskPath + "-moved"
+				if _, err := blockdevices.Update(bd); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blockdevices := fakeclients.NewBlockDeviceController(newMountedBlockDevice("disk", testDiskPath,
+				blockdevice.DeviceFinalizer, blockdevice.LonghornDiskFinalizer))
+			nodes := fakeclients.NewNodeController(newNode(map[string]types.DiskSpec{
+				"disk": {Path: testDiskPath, AllowScheduling: true, Tags: []string{}},
+			}))
+			c := newTestController(t, "nvme.tar.gz", blockdevices, nodes)
+			test.remove(t, blockdevices)
+
+			// the eviction is requested first
+			syncBlockDevice(t, c, blockdevices, "disk")
+			disk, ok := mustGetNode(t, nodes).Spec.Disks["disk"]
+			if !ok || disk.AllowScheduling || !disk.EvictionRequested {
+				t.Fatalf("expected eviction of the disk to be requested, got %+v", disk)
+			}
+			verifyEvicting(t, blockdevices, "waiting for the replicas")
+
+			// the disk is kept until Longhorn reports its replicas are evicted
+			for _, step := range []struct {
+				diskStatus *types.DiskStatus
+				message    string
+			}{
+				{nil, "waiting for the status"},
+				{&types.DiskStatus{ScheduledReplica: map[string]int64{"replica-1": 1 << 30}}, "waiting for 1 replicas"},
+			} {
+				node := mustGetNode(t, nodes)
+				node.Status.DiskStatus = map[string]*types.DiskStatus{}
+				if step.diskStatus != nil {
+					node.Status.DiskStatus["disk"] = step.diskStatus
+				}
+				if _, err := nodes.Update(node); err != nil {
+					t.Fatal(err)
+				}
+				syncBlockDevice(t, c, blockdevices, "disk")
+				if _, ok := mustGetNode(t, nodes).Spec.Disks["disk"]; !ok {
+					t.Fatalf("expected disk to be kept with status %+v", step.diskStatus)
+				}
+				verifyEvicting(t, blockdevices, step.message)
+			}
+
+			node := mustGetNode(t, nodes)
+			node.Status.DiskStatus = map[string]*types.DiskStatus{"disk": {ScheduledReplica: map[string]int64{}}}
+			if _, err := nodes.Update(node); err != nil {
+				t.Fatal(err)
+			}
+			syncBlockDevice(t, c, blockdevices, "disk")
+			if disks := mustGetNode(t, nodes).Spec.Disks; len(disks) != 0 {
+				t.Errorf("expected evicted disk to be removed, got %+v", disks)
+			}
+			bd, _ := blockdevices.Get(testNamespace, "disk", metav1.GetOptions{})
+			if !longhornv1.LonghornDiskRemoved.IsTrue(bd) || util.HasFinalizer(bd, blockdevice.LonghornDiskFinalizer) {
+				t.Errorf("expected removed disk without finalizer %s, got %q: %s, finalizers %v", blockdevice.LonghornDiskFinalizer,
+					longhornv1.LonghornDiskRemoved.GetStatus(bd), longhornv1.LonghornDiskRemoved.GetMessage(bd), bd.Finalizers)
+			}
+		})
+	}
+}
+
+func TestRemoveFinalizerWithoutNode(t *testing.T) {
+	blockdevices := fakeclients.NewBlockDeviceController(newMountedBlockDevice("disk", testDiskPath,
+		blockdevice.DeviceFinalizer, blockdevice.LonghornDiskFinalizer))
+	c := newTestController(t, "nvme.tar.gz", blockdevices, fakeclients.NewNodeController())
+	if err := blockdevices.Delete(testNamespace, "disk", &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	syncBlockDevice(t, c, blockdevices, "disk")
+	bd, _ := blockdevices.Get(testNamespace, "disk", metav1.GetOptions{})
+	if !reflect.DeepEqual(bd.Finalizers, []string{blockdevice.DeviceFinalizer}) {
+		t.Errorf("expected only finalizer %s to be kept, got %v", blockdevice.DeviceFinalizer, bd.Finalizers)
+	}
+}
+
+// verifyEvicting checks the block device waits for its Longhorn disk to be evicted, and it's checked again later
+func verifyEvicting(t *testing.T, blockdevices *fakeclients.BlockDeviceController, message string) {
+	t.Helper()
+	bd, _ := blockdevices.Get(testNamespace, "disk", metav1.GetOptions{})
+	if reason := longhornv1.LonghornDiskRemoved.GetReason(bd); reason != "Evicting" ||
+		!strings.HasPrefix(longhornv1.LonghornDiskRemoved.GetMessage(bd), message) {
+		t.Errorf("expected disk evicting with message %q, got %q: %s", message, reason,
+			longhornv1.LonghornDiskRemoved.GetMessage(bd))
+	}
+	if !util.HasFinalizer(bd, blockdevice.LonghornDiskFinalizer) {
+		t.Errorf("expected finalizer %s to be kept, got %v", blockdevice.LonghornDiskFinalizer, bd.Finalizers)
+	}
+	if len(blockdevices.Enqueued) == 0 {
+		t.Errorf("expected block device to be checked again")
+	}
+	blockdevices.Enqueued = nil
+}
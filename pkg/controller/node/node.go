@@ -2,13 +2,18 @@ package node
 
 import (
 	"context"
+	"fmt"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 
 	"github.com/longhorn/node-disk-manager/pkg/block"
+	"github.com/longhorn/node-disk-manager/pkg/controller/blockdevice"
+	"github.com/longhorn/node-disk-manager/pkg/filter"
 
 	longhornv1 "github.com/longhorn/node-disk-manager/pkg/apis/longhorn.io/v1beta1"
 	ctllonghornv1 "github.com/longhorn/node-disk-manager/pkg/generated/controllers/longhorn.io/v1beta1"
@@ -23,41 +28,74 @@ type Controller struct {
 	BlockDeviceCache ctllonghornv1.BlockDeviceCache
 	Nodes            ctllonghornv1.NodeController
 	BlockInfo        *block.Info
+
+	blockDeviceController *blockdevice.Controller
 }
 
 const (
 	blockDeviceNodeHandlerName = "longhorn-ndm-node-handler"
+
+	// RescanAnnotation requests a rescan of the block devices of the node when it is set with any value
+	RescanAnnotation = "block.longhorn.io/rescan"
+	// LastRescanTimeAnnotation is the time the last requested rescan finished
+	LastRescanTimeAnnotation = "block.longhorn.io/last-rescan-time"
+	// LastRescanResultAnnotation is the result of the last requested rescan
+	LastRescanResultAnnotation = "block.longhorn.io/last-rescan-result"
+
+	rescanResultSucceeded = "Succeeded"
 )
 
 // Register register the block device CRD controller
 func Register(ctx context.Context, nodes ctllonghornv1.NodeController, bds ctllonghornv1.BlockDeviceController,
-	block *block.Info, opt *option.Option) error {
+	host block.Host, block *block.Info, filter *filter.DeviceFilter, opt *option.Option) error {
+
+	blockDeviceController, err := blockdevice.NewController(bds, host, block, filter, opt)
+	if err != nil {
+		return err
+	}
 
 	c := &Controller{
-		namespace:        opt.Namespace,
-		nodeName:         opt.NodeName,
-		Nodes:            nodes,
-		BlockDevices:     bds,
-		BlockDeviceCache: bds.Cache(),
-		BlockInfo:        block,
+		namespace:             opt.Namespace,
+		nodeName:              opt.NodeName,
+		Nodes:                 nodes,
+		BlockDevices:          bds,
+		BlockDeviceCache:      bds.Cache(),
+		BlockInfo:             block,
+		blockDeviceController: blockDeviceController,
 	}
 
-	//nodes.OnChange(ctx, blockDeviceNodeHandlerName, c.OnNodeChange)
+	nodes.OnChange(ctx, blockDeviceNodeHandlerName, c.OnNodeChange)
 	nodes.OnRemove(ctx, blockDeviceNodeHandlerName, c.OnNodeDelete)
+	bds.OnChange(ctx, blockDeviceDiskHandlerName, c.OnBlockDeviceChange)
 	return nil
 }
 
-// OnNodeChange watch the node CR on change and updates the associated block devices
-//func (c *Controller) OnNodeChange(key string, node *longhornv1.Node) (*longhornv1.Node, error) {
-//	if node == nil || node.DeletionTimestamp != nil {
-//		return node, nil
-//	}
-//
-//
-//	return nil, nil
-//}
-
-// OnNodeDelete watch the node CR on remove and delete node related block devices
+// OnNodeChange watch the node CR on change and rescans the block devices of the node on request
+func (c *Controller) OnNodeChange(key string, node *longhornv1.Node) (*longhornv1.Node, error) {
+	if node == nil || node.DeletionTimestamp != nil || node.Name != c.nodeName {
+		return node, nil
+	}
+
+	if _, ok := node.Annotations[RescanAnnotation]; !ok {
+		return node, nil
+	}
+
+	logrus.Infof("Rescan block devices of node %s on request", c.nodeName)
+	result := rescanResultSucceeded
+	if err := c.blockDeviceController.ReconcileNodeBlockDevices(); err != nil {
+		logrus.Errorf("failed to rescan block devices of node %s, error: %s", c.nodeName, err.Error())
+		result = fmt.Sprintf("Failed: %s", err.Error())
+	}
+
+	nodeCpy := node.DeepCopy()
+	delete(nodeCpy.Annotations, RescanAnnotation)
+	nodeCpy.Annotations[LastRescanTimeAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	nodeCpy.Annotations[LastRescanResultAnnotation] = result
+	return c.Nodes.Update(nodeCpy)
+}
+
+// OnNodeDelete watch the node CR on remove and delete node related block devices. The finalizers of the block devices
+// of another node are removed first, as its agent is usually gone with the node and they would be left terminating.
 func (c *Controller) OnNodeDelete(key string, node *longhornv1.Node) (*longhornv1.Node, error) {
 	if node == nil {
 		return nil, nil
@@ -71,6 +109,11 @@ func (c *Controller) OnNodeDelete(key string, node *longhornv1.Node) (*longhornv
 	}
 
 	for _, bd := range bds {
+		if bdCpy := bd.DeepCopy(); node.Name != c.nodeName && blockdevice.RemoveNodeFinalizers(bdCpy) {
+			if _, err := c.BlockDevices.Update(bdCpy); err != nil {
+				return node, err
+			}
+		}
 		if err := c.BlockDevices.Delete(c.namespace, bd.Name, &metav1.DeleteOptions{}); err != nil {
 			return node, err
 		}
@@ -0,0 +1,155 @@
+package node
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	longhornv1 "github.com/longhorn/node-disk-manager/pkg/apis/longhorn.io/v1beta1"
+	"github.com/longhorn/node-disk-manager/pkg/controller/blockdevice"
+	"github.com/longhorn/node-disk-manager/pkg/util/fakeclients"
+)
+
+const (
+	testNamespace = "longhorn-system"
+	testNodeName  = "node-1"
+)
+
+func newBlockDevice(name, nodeName string, finalizers ...string) *longhornv1.BlockDevice {
+	return &longhornv1.BlockDevice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       name,
+			Namespace:  testNamespace,
+			Labels:     map[string]string{v1.LabelHostname: nodeName},
+			Finalizers: finalizers,
+		},
+		Spec: longhornv1.BlockDeviceSpec{
+			NodeName: nodeName,
+			DevPath:  "/dev/sdb",
+		},
+	}
+}
+
+func TestOnNodeDelete(t *testing.T) {
+	tests := []struct {
+		name     string
+		nodeName string
+		deleted  bool
+	}{
+		{
+			name:     "block devices of a gone node are deleted",
+			nodeName: "node-2",
+			deleted:  true,
+		},
+		{
+			name:     "block devices of the own node are finalized by the agent",
+			nodeName: testNodeName,
+			deleted:  false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blockdevices := fakeclients.NewBlockDeviceController(
+				newBlockDevice("disk", test.nodeName, blockdevice.DeviceFinalizer, blockdevice.LonghornDiskFinalizer),
+				newBlockDevice("other", "node-3", blockdevice.DeviceFinalizer),
+			)
+			c := &Controller{
+				namespace:        testNamespace,
+				nodeName:         testNodeName,
+				BlockDevices:     blockdevices,
+				BlockDeviceCache: blockdevices.Cache(),
+			}
+			node := &longhornv1.Node{ObjectMeta: metav1.ObjectMeta{Name: test.nodeName, Namespace: testNamespace}}
+			if _, err := c.OnNodeDelete(node.Name, node); err != nil {
+				t.Fatalf("failed to handle the deleted node, error: %s", err.Error())
+			}
+
+			bd, err := blockdevices.Get(testNamespace, "disk", metav1.GetOptions{})
+			if test.deleted {
+				if err == nil {
+					t.Errorf("expected block device to be deleted, got finalizers %v", bd.Finalizers)
+				}
+			} else if err != nil || bd.DeletionTimestamp == nil || len(bd.Finalizers) != 2 {
+				t.Errorf("expected block device to be terminating with its finalizers, got %+v, error: %v", bd, err)
+			}
+			if other, err := blockdevices.Get(testNamespace, "other", metav1.GetOptions{}); err != nil || other.DeletionTimestamp != nil {
+				t.Errorf("expected block device of another node to be kept, got %+v, error: %v", other, err)
+			}
+		})
+	}
+}
+
+func TestOnNodeChange(t *testing.T) {
+	tests := []struct {
+		name        string
+		node        *longhornv1.Node
+		rescanned   bool
+		annotations map[string]string
+	}{
+		{
+			name: "rescan on request",
+			node: &longhornv1.Node{ObjectMeta: metav1.ObjectMeta{
+				Name:        testNodeName,
+				Namespace:   testNamespace,
+				Annotations: map[string]string{RescanAnnotation: "", "foo": "bar"},
+			}},
+			rescanned:   true,
+			annotations: map[string]string{LastRescanResultAnnotation: rescanResultSucceeded, "foo": "bar"},
+		},
+		{
+			name: "no rescan without request",
+			node: &longhornv1.Node{ObjectMeta: metav1.ObjectMeta{
+				Name:        testNodeName,
+				Namespace:   testNamespace,
+				Annotations: map[string]string{"foo": "bar"},
+			}},
+			annotations: map[string]string{"foo": "bar"},
+		},
+		{
+			name: "rescan of another node is left to its agent",
+			node: &longhornv1.Node{ObjectMeta: metav1.ObjectMeta{
+				Name:        "node-2",
+				Namespace:   testNamespace,
+				Annotations: map[string]string{RescanAnnotation: "true"},
+			}},
+			annotations: map[string]string{RescanAnnotation: "true"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blockdevices := fakeclients.NewBlockDeviceController()
+			nodes := fakeclients.NewNodeController(test.node)
+			c := newTestController(t, "nvme.tar.gz", blockdevices, nodes)
+			node, err := nodes.Get(testNamespace, test.node.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := time.Now().UTC().Truncate(time.Second)
+			if _, err := c.OnNodeChange(node.Name, node); err != nil {
+				t.Fatalf("failed to handle the node, error: %s", err.Error())
+			}
+
+			list, _ := blockdevices.List(testNamespace, metav1.ListOptions{})
+			if rescanned := len(list.Items) > 0; rescanned != test.rescanned {
+				t.Errorf("expected rescanned %v, got block devices %d", test.rescanned, len(list.Items))
+			}
+			node, _ = nodes.Get(testNamespace, test.node.Name, metav1.GetOptions{})
+			annotations := node.Annotations
+			if test.rescanned {
+				rescanTime, err := time.Parse(time.RFC3339, annotations[LastRescanTimeAnnotation])
+				if err != nil || rescanTime.Before(before) {
+					t.Errorf("expected last rescan time after %s, got %q", before, annotations[LastRescanTimeAnnotation])
+				}
+				delete(annotations, LastRescanTimeAnnotation)
+			}
+			if !reflect.DeepEqual(annotations, test.annotations) {
+				t.Errorf("expected annotations %v, got %v", test.annotations, annotations)
+			}
+		})
+	}
+}
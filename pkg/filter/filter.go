@@ -0,0 +1,218 @@
+package filter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/longhorn/node-disk-manager/pkg/block"
+)
+
+const (
+	// ConfigMapKey is the key of the device filter configuration in the ConfigMap
+	ConfigMapKey = "device-filter.yaml"
+)
+
+// DeviceFilter decides which disks of the node are managed as block devices. A disk is accepted when it
+// matches any of the include rules, or there is no include rule at all, and it matches none of the exclude rules.
+type DeviceFilter struct {
+	Include []Rule `json:"include,omitempty"`
+	Exclude []Rule `json:"exclude,omitempty"`
+}
+
+// Rule matches a disk when all of its non-empty criteria are satisfied, each criterion is satisfied when any of
+// its values matches. Names, vendors, models, bus paths, kinds and mount points are shell file name patterns, e.g.
+// "nvme*".
+type Rule struct {
+	// the kernel device names of the disk, e.g. "sda", "nvme*"
+	Names []string `json:"names,omitempty"`
+
+	// the vendors of the disk
+	Vendors []string `json:"vendors,omitempty"`
+
+	// the vendor-assigned model names of the disk
+	Models []string `json:"models,omitempty"`
+
+	// the bus paths of the disk, e.g. "pci-0000:00:1f.2-ata-*"
+	BusPaths []string `json:"busPaths,omitempty"`
+
+	// the drive types of the disk, options are "HDD", "FDD", "ODD", "SSD" or "Unknown"
+	DriveTypes []string `json:"driveTypes,omitempty"`
+
+	// the kinds of the virtual disk, options are "lvm", "crypt", "mpath", "dm" of the other device-mapper devices, or
+	// the RAID level of an MD device, e.g. "raid*"
+	Kinds []string `json:"kinds,omitempty"`
+
+	// the mount points of the disk or any of its partitions, e.g. "/" matches the OS disk
+	MountPoints []string `json:"mountPoints,omitempty"`
+
+	// the minimum size of the disk, e.g. "10Gi"
+	MinSize *resource.Quantity `json:"minSize,omitempty"`
+
+	// the maximum size of the disk, e.g. "16Ti"
+	MaxSize *resource.Quantity `json:"maxSize,omitempty"`
+}
+
+// NewDefaultDeviceFilter returns the filter that is used when no configuration is provided, it excludes the
+// virtual and optical devices as well as the OS disk. The multipath devices are kept, as they are the only way to use
+// the LUNs whose paths are skipped.
+func NewDefaultDeviceFilter() *DeviceFilter {
+	return &DeviceFilter{
+		Exclude: []Rule{
+			{Names: []string{"loop*", "ram*", "zram*", "sr*", "md*", "nbd*"}},
+			{Kinds: []string{block.VirtualKindLVM, block.VirtualKindCrypt, block.VirtualKindDM}},
+			{MountPoints: []string{"/"}},
+		},
+	}
+}
+
+// LoadFromFile loads the device filter from a YAML or JSON file
+func LoadFromFile(filePath string) (*DeviceFilter, error) {
+	stream, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return parse(stream)
+}
+
+// LoadFromConfigMap loads the device filter from the ConfigMap key device-filter.yaml
+func LoadFromConfigMap(client kubernetes.Interface, namespace, name string) (*DeviceFilter, error) {
+	cm, err := client.CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	data, ok := cm.Data[ConfigMapKey]
+	if !ok {
+		return nil, fmt.Errorf("key %s not found in configmap %s/%s", ConfigMapKey, namespace, name)
+	}
+	return parse([]byte(data))
+}
+
+func parse(stream []byte) (*DeviceFilter, error) {
+	filter := &DeviceFilter{}
+	if err := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(stream), len(stream)).Decode(filter); err != nil {
+		return nil, fmt.Errorf("wrong device filter syntax, err: %w", err)
+	}
+	if err := filter.validate(); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func (f *DeviceFilter) validate() error {
+	for _, rule := range append(f.Include, f.Exclude...) {
+		for _, pattern := range rule.patterns() {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q, err: %w", pattern, err)
+			}
+		}
+		if rule.MinSize != nil && rule.MaxSize != nil && rule.MinSize.Cmp(*rule.MaxSize) > 0 {
+			return fmt.Errorf("minSize %s is larger than maxSize %s", rule.MinSize.String(), rule.MaxSize.String())
+		}
+	}
+	return nil
+}
+
+// Match returns true if the disk should be managed as a block device
+func (f *DeviceFilter) Match(disk *block.Disk) bool {
+	if f == nil || disk == nil {
+		return true
+	}
+
+	for _, rule := range f.Exclude {
+		if rule.match(disk) {
+			return false
+		}
+	}
+
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, rule := range f.Include {
+		if rule.match(disk) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) patterns() []string {
+	patterns := make([]string, 0)
+	for _, values := range [][]string{r.Names, r.Vendors, r.Models, r.BusPaths, r.Kinds, r.MountPoints} {
+		patterns = append(patterns, values...)
+	}
+	return patterns
+}
+
+func (r *Rule) match(disk *block.Disk) bool {
+	if len(r.Names) > 0 && !matchAny(r.Names, disk.Name) {
+		return false
+	}
+	if len(r.Vendors) > 0 && !matchAny(r.Vendors, disk.Vendor) {
+		return false
+	}
+	if len(r.Models) > 0 && !matchAny(r.Models, disk.Model) {
+		return false
+	}
+	if len(r.BusPaths) > 0 && !matchAny(r.BusPaths, disk.BusPath) {
+		return false
+	}
+	if len(r.DriveTypes) > 0 && !containsFold(r.DriveTypes, disk.DriveType.String()) {
+		return false
+	}
+	// the physical disk has no kind, so it's never matched by the kinds, e.g. "*" of any virtual disk
+	if len(r.Kinds) > 0 && (disk.Topology.Kind == "" || !matchAny(r.Kinds, disk.Topology.Kind)) {
+		return false
+	}
+	if len(r.MountPoints) > 0 && !matchAny(r.MountPoints, getMountPoints(disk)...) {
+		return false
+	}
+	if r.MinSize != nil && disk.SizeBytes < uint64(r.MinSize.Value()) {
+		return false
+	}
+	if r.MaxSize != nil && disk.SizeBytes > uint64(r.MaxSize.Value()) {
+		return false
+	}
+	return true
+}
+
+func getMountPoints(disk *block.Disk) []string {
+	mountPoints := make([]string, 0, len(disk.Partitions)+1)
+	if disk.FileSystemInfo.MountPoint != "" {
+		mountPoints = append(mountPoints, disk.FileSystemInfo.MountPoint)
+	}
+	for _, part := range disk.Partitions {
+		if part.FileSystemInfo.MountPoint != "" {
+			mountPoints = append(mountPoints, part.FileSystemInfo.MountPoint)
+		}
+	}
+	return mountPoints
+}
+
+func matchAny(patterns []string, values ...string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if matched, _ := filepath.Match(pattern, value); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
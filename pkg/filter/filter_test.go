@@ -0,0 +1,343 @@
+package filter
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	ghwblock "github.com/jaypipes/ghw/pkg/block"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"github.com/longhorn/node-disk-manager/pkg/block"
+)
+
+const testFilter = `
+include:
+- names: ["sd*", "nvme*"]
+exclude:
+- vendors: ["QEMU"]
+  minSize: 1Gi
+`
+
+func newDisk() *block.Disk {
+	return &block.Disk{
+		Name:      "sdb",
+		SizeBytes: 100 << 30,
+		DriveType: ghwblock.DRIVE_TYPE_SSD,
+		Vendor:    "ATA",
+		Model:     "Samsung SSD 870",
+		BusPath:   "pci-0000:00:1f.2-ata-2",
+		Partitions: []*block.Partition{
+			{Name: "sdb1", FileSystemInfo: block.FileSystemInfo{MountPoint: "/var/lib/longhorn"}},
+		},
+	}
+}
+
+func quantity(value string) *resource.Quantity {
+	q := resource.MustParse(value)
+	return &q
+}
+
+func TestRuleMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     Rule
+		mutate   func(disk *block.Disk)
+		expected bool
+	}{
+		{
+			name:     "empty rule",
+			expected: true,
+		},
+		{
+			name:     "name",
+			rule:     Rule{Names: []string{"nvme*", "sd?"}},
+			expected: true,
+		},
+		{
+			name:     "mismatched name",
+			rule:     Rule{Names: []string{"nvme*"}},
+			expected: false,
+		},
+		{
+			name:     "vendor",
+			rule:     Rule{Vendors: []string{"ATA"}},
+			expected: true,
+		},
+		{
+			name:     "mismatched vendor",
+			rule:     Rule{Vendors: []string{"QEMU"}},
+			expected: false,
+		},
+		{
+			name:     "model",
+			rule:     Rule{Models: []string{"Samsung*"}},
+			expected: true,
+		},
+		{
+			name:     "mismatched model",
+			rule:     Rule{Models: []string{"INTEL*"}},
+			expected: false,
+		},
+		{
+			name:     "bus path",
+			rule:     Rule{BusPaths: []string{"pci-0000:00:1f.2-ata-*"}},
+			expected: true,
+		},
+		{
+			name:     "mismatched bus path",
+			rule:     Rule{BusPaths: []string{"pci-0000:00:1f.2-ata-1"}},
+			expected: false,
+		},
+		{
+			name:     "drive type is case insensitive",
+			rule:     Rule{DriveTypes: []string{"ssd"}},
+			expected: true,
+		},
+		{
+			name:     "mount point of a partition",
+			rule:     Rule{MountPoints: []string{"/var/lib/*"}},
+			expected: true,
+		},
+		{
+			name: "mount point of the disk",
+			rule: Rule{MountPoints: []string{"/"}},
+			mutate: func(disk *block.Disk) {
+				disk.Partitions = nil
+				disk.FileSystemInfo.MountPoint = "/"
+			},
+			expected: true,
+		},
+		{
+			name:     "mismatched mount point",
+			rule:     Rule{MountPoints: []string{"/"}},
+			expected: false,
+		},
+		{
+			name: "kind",
+			rule: Rule{Kinds: []string{block.VirtualKindMpath}},
+			mutate: func(disk *block.Disk) {
+				disk.Topology.Kind = block.VirtualKindMpath
+			},
+			expected: true,
+		},
+		{
+			name:     "kind of physical disk",
+			rule:     Rule{Kinds: []string{"*"}},
+			expected: false,
+		},
+		{
+			name:     "size in range",
+			rule:     Rule{MinSize: quantity("10Gi"), MaxSize: quantity("1Ti")},
+			expected: true,
+		},
+		{
+			name:     "size out of range",
+			rule:     Rule{MaxSize: quantity("10Gi")},
+			expected: false,
+		},
+		{
+			name:     "all criteria must match",
+			rule:     Rule{Names: []string{"sdb"}, Vendors: []string{"QEMU"}},
+			expected: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			disk := newDisk()
+			if test.mutate != nil {
+				test.mutate(disk)
+			}
+			if matched := test.rule.match(disk); matched != test.expected {
+				t.Errorf("expected match %v, got %v", test.expected, matched)
+			}
+		})
+	}
+}
+
+func TestDefaultDeviceFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		mutate   func(disk *block.Disk)
+		expected bool
+	}{
+		{
+			name:     "physical disk",
+			expected: true,
+		},
+		{
+			name: "OS disk",
+			mutate: func(disk *block.Disk) {
+				disk.Partitions[0].FileSystemInfo.MountPoint = "/"
+			},
+			expected: false,
+		},
+		{
+			name: "loop device",
+			mutate: func(disk *block.Disk) {
+				disk.Name = "loop0"
+			},
+			expected: false,
+		},
+		{
+			name: "multipath device",
+			mutate: func(disk *block.Disk) {
+				disk.Name = "dm-0"
+				disk.Topology = block.Topology{Kind: block.VirtualKindMpath, DMUUID: "mpath-3600a098038303053"}
+			},
+			expected: true,
+		},
+		{
+			name: "LVM logical volume",
+			mutate: func(disk *block.Disk) {
+				disk.Name = "dm-1"
+				disk.Topology = block.Topology{Kind: block.VirtualKindLVM, DMUUID: "LVM-f3A1"}
+			},
+			expected: false,
+		},
+		{
+			name: "other device-mapper device",
+			mutate: func(disk *block.Disk) {
+				disk.Name = "dm-2"
+				disk.Topology = block.Topology{Kind: block.VirtualKindDM, DMUUID: "CUSTOM-1"}
+			},
+			expected: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			disk := newDisk()
+			if test.mutate != nil {
+				test.mutate(disk)
+			}
+			if matched := NewDefaultDeviceFilter().Match(disk); matched != test.expected {
+				t.Errorf("expected match %v, got %v", test.expected, matched)
+			}
+		})
+	}
+}
+
+func TestLoadFromFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		invalid bool
+	}{
+		{
+			name:    "YAML",
+			content: testFilter,
+		},
+		{
+			name:    "JSON",
+			content: `{"include": [{"names": ["sd*", "nvme*"]}], "exclude": [{"vendors": ["QEMU"], "minSize": "1Gi"}]}`,
+		},
+		{
+			name:    "invalid pattern",
+			content: `exclude: [{names: ["sd[a"]}]`,
+			invalid: true,
+		},
+		{
+			name:    "minSize larger than maxSize",
+			content: `include: [{minSize: 2Ti, maxSize: 1Ti}]`,
+			invalid: true,
+		},
+		{
+			name:    "wrong syntax",
+			content: `include: {names: sda}`,
+			invalid: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "device-filter.yaml")
+			if err := ioutil.WriteFile(path, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			filter, err := LoadFromFile(path)
+			if test.invalid {
+				if err == nil {
+					t.Errorf("expected error, got filter %+v", filter)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to load the filter, error: %s", err.Error())
+			}
+			verifyTestFilter(t, filter)
+		})
+	}
+
+	if _, err := LoadFromFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Errorf("expected error of the missing file")
+	}
+}
+
+// configMapClient serves the ConfigMaps of the namespace, the rest of the client is not implemented
+type configMapClient struct {
+	kubernetes.Interface
+	typedcorev1.CoreV1Interface
+	typedcorev1.ConfigMapInterface
+	configMaps map[string]*corev1.ConfigMap
+}
+
+func (c *configMapClient) CoreV1() typedcorev1.CoreV1Interface {
+	return c
+}
+
+func (c *configMapClient) ConfigMaps(namespace string) typedcorev1.ConfigMapInterface {
+	return c
+}
+
+func (c *configMapClient) Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.ConfigMap, error) {
+	if cm, ok := c.configMaps[name]; ok {
+		return cm, nil
+	}
+	return nil, errors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, name)
+}
+
+func TestLoadFromConfigMap(t *testing.T) {
+	client := &configMapClient{configMaps: map[string]*corev1.ConfigMap{
+		"device-filter": {Data: map[string]string{ConfigMapKey: testFilter}},
+		"no-key":        {Data: map[string]string{"filter.yaml": testFilter}},
+	}}
+
+	filter, err := LoadFromConfigMap(client, "longhorn-system", "device-filter")
+	if err != nil {
+		t.Fatalf("failed to load the filter, error: %s", err.Error())
+	}
+	verifyTestFilter(t, filter)
+
+	for _, name := range []string{"no-key", "missing"} {
+		if _, err := LoadFromConfigMap(client, "longhorn-system", name); err == nil {
+			t.Errorf("expected error of configmap %s", name)
+		}
+	}
+}
+
+// verifyTestFilter checks the filter loaded from testFilter includes the SATA disk, and excludes the QEMU disk
+func verifyTestFilter(t *testing.T, filter *DeviceFilter) {
+	t.Helper()
+	disk := newDisk()
+	if !filter.Match(disk) {
+		t.Errorf("expected disk %s to be included", disk.Name)
+	}
+	disk.Vendor = "QEMU"
+	if filter.Match(disk) {
+		t.Errorf("expected disk %s of vendor %s to be excluded", disk.Name, disk.Vendor)
+	}
+	disk.Name = "vda"
+	disk.Vendor = "ATA"
+	if filter.Match(disk) {
+		t.Errorf("expected disk %s not to be included", disk.Name)
+	}
+}
@@ -1,11 +1,25 @@
 package option
 
+import "time"
+
 type Option struct {
 	KubeConfig  string
 	Namespace   string
 	NodeName    string
 	Threadiness int
 
+	SkipLeaderElection bool
+
+	DeviceFilterFile      string
+	DeviceFilterConfigMap string
+	UdevRulesFile         string
+
+	RescanInterval       time.Duration
+	VanishedDevicePolicy string
+
+	MountPersistence     string
+	MountPersistencePath string
+
 	Debug           bool
 	Trace           bool
 	LogFormat       string
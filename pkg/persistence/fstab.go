@@ -0,0 +1,158 @@
+package persistence
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// fstab persists the mounts as the entries of the fstab file, each managed entry is preceded by a marker line
+type fstab struct {
+	lock sync.Mutex
+	path string
+}
+
+// fstabEntry is a managed entry of the fstab file
+type fstabEntry struct {
+	uuid string
+	line string
+}
+
+func (f *fstab) Persist(mount Mount) error {
+	if mount.UUID == "" || mount.MountPoint == "" {
+		return fmt.Errorf("the UUID and mount point are required to persist the mount")
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	lines, entries, err := f.read()
+	if err != nil {
+		return err
+	}
+
+	persisted := fstabEntry{
+		uuid: mount.UUID,
+		line: fmt.Sprintf("UUID=%s %s %s %s 0 2", mount.UUID, escapeFstabField(mount.MountPoint), mount.FsType,
+			getOptions(mount.Options)),
+	}
+	kept := make([]fstabEntry, 0, len(entries))
+	present := false
+	for _, entry := range entries {
+		if entry == persisted {
+			present = true
+		}
+		if entry.uuid == mount.UUID || getFstabMountPoint(entry.line) == escapeFstabField(mount.MountPoint) {
+			continue
+		}
+		kept = append(kept, entry)
+	}
+
+	// the file is left alone if the entry is already there, and it's the only one of the UUID and mount point
+	if present && len(kept) == len(entries)-1 {
+		return nil
+	}
+	return f.write(lines, append(kept, persisted))
+}
+
+func (f *fstab) Remove(uuid string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	lines, entries, err := f.read()
+	if err != nil {
+		return err
+	}
+
+	kept := make([]fstabEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.uuid != uuid {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) == len(entries) {
+		return nil
+	}
+	return f.write(lines, kept)
+}
+
+func (f *fstab) List() ([]Mount, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	_, entries, err := f.read()
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := make([]Mount, 0, len(entries))
+	for _, entry := range entries {
+		fields := strings.Fields(entry.line)
+		mount := Mount{UUID: entry.uuid}
+		if len(fields) >= 4 {
+			mount.MountPoint = unescapeFstabField(fields[1])
+			mount.FsType = fields[2]
+			mount.Options = strings.Split(fields[3], ",")
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+// read returns the unmanaged lines and the managed entries of the fstab file
+func (f *fstab) read() ([]string, []fstabEntry, error) {
+	content, err := ioutil.ReadFile(f.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	lines := make([]string, 0)
+	entries := make([]fstabEntry, 0)
+	all := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	for i := 0; i < len(all); i++ {
+		if !strings.HasPrefix(all[i], marker) {
+			if all[i] != "" || len(lines) > 0 {
+				lines = append(lines, all[i])
+			}
+			continue
+		}
+		// the marker without an entry is dropped
+		if i+1 < len(all) && !strings.HasPrefix(all[i+1], marker) {
+			entries = append(entries, fstabEntry{uuid: strings.TrimPrefix(all[i], marker), line: all[i+1]})
+			i++
+		}
+	}
+	return lines, entries, nil
+}
+
+// write rewrites the fstab file in place, since the file may be bind mounted from the host and can't be replaced
+func (f *fstab) write(lines []string, entries []fstabEntry) error {
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(line + "\n")
+	}
+	for _, entry := range entries {
+		b.WriteString(marker + entry.uuid + "\n")
+		b.WriteString(entry.line + "\n")
+	}
+	return ioutil.WriteFile(f.path, []byte(b.String()), 0644)
+}
+
+func getFstabMountPoint(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return ""
+	}
+	return fields[1]
+}
+
+// escapeFstabField escapes the space and tab characters in the field as the octal sequences
+func escapeFstabField(field string) string {
+	return strings.NewReplacer(" ", `\040`, "\t", `\011`).Replace(field)
+}
+
+func unescapeFstabField(field string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t").Replace(field)
+}
@@ -0,0 +1,77 @@
+package persistence
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// ModeNone disables the persistence, the devices are mounted by the agent only
+	ModeNone = "none"
+
+	// ModeFstab persists the mounts as entries of the fstab file of the host
+	ModeFstab = "fstab"
+
+	// ModeSystemd persists the mounts as systemd mount units of the host
+	ModeSystemd = "systemd"
+
+	defaultFstabPath      = "/etc/fstab"
+	defaultSystemdUnitDir = "/etc/systemd/system"
+
+	// marker identifies the fstab entries and the mount units that are managed by the node-disk-manager
+	marker = "# Managed by node-disk-manager, do not edit, UUID="
+)
+
+// Mount describes a mount of the filesystem that is restored by the host on boot
+type Mount struct {
+	// the UUID of the filesystem, which is stable across reboots unlike the kernel device name
+	UUID       string
+	MountPoint string
+	FsType     string
+	Options    []string
+}
+
+// Persister persists the mounts on the host, so the devices are mounted on boot before the agent comes back.
+// All the operations are idempotent, and only the entries written by the persister are touched.
+type Persister interface {
+	// Persist records the mount, it replaces the existing records of the same UUID or mount point
+	Persist(mount Mount) error
+
+	// Remove removes the record of the filesystem UUID, it's a no-op if there is no such record
+	Remove(uuid string) error
+
+	// List returns the recorded mounts
+	List() ([]Mount, error)
+}
+
+// New returns the persister of the mode, or nil if the persistence is disabled. The path is the fstab file or the
+// directory of the systemd units on the host, the default one of the mode is used if it's empty.
+func New(mode, path string) (Persister, error) {
+	switch mode {
+	case "", ModeNone:
+		return nil, nil
+	case ModeFstab:
+		if path == "" {
+			path = defaultFstabPath
+		}
+		return &fstab{path: path}, nil
+	case ModeSystemd:
+		if path == "" {
+			path = defaultSystemdUnitDir
+		}
+		return &systemdUnits{dir: path}, nil
+	}
+	return nil, fmt.Errorf("unknown mount persistence mode %q", mode)
+}
+
+// getOptions returns the mount options to be persisted, nofail is always added so the boot is not blocked by
+// a missing device
+func getOptions(options []string) string {
+	persisted := make([]string, 0, len(options)+1)
+	for _, option := range options {
+		if option = strings.TrimSpace(option); option != "" && option != "nofail" {
+			persisted = append(persisted, option)
+		}
+	}
+	return strings.Join(append(persisted, "nofail"), ",")
+}
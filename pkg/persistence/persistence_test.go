@@ -0,0 +1,221 @@
+package persistence
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const hostFstab = `# /etc/fstab: static file system information.
+UUID=2f5e2c41-9a33-4b6a-a8a1-2b1c4a4b2e10 / ext4 errors=remount-ro 0 1
+/swap.img none swap sw 0 0
+`
+
+var (
+	dataMount = Mount{
+		UUID:       "6b3b3c5e-1f2d-4f0a-9d0b-31f5c8f3a7e1",
+		MountPoint: "/var/lib/longhorn data",
+		FsType:     "ext4",
+		Options:    []string{"noatime", "nofail"},
+	}
+	logMount = Mount{
+		UUID:       "a0c5e2d3-7b1e-4d6c-8f2a-9e4b5c6d7e8f",
+		MountPoint: "/var/lib/longhorn-log",
+		FsType:     "xfs",
+	}
+)
+
+// newPersister returns the persister of the mode writing to the temporary directory, the fstab file has the
+// entries of the host
+func newPersister(t *testing.T, mode string) (Persister, string) {
+	t.Helper()
+	path := t.TempDir()
+	if mode == ModeFstab {
+		path = filepath.Join(path, "fstab")
+		if err := ioutil.WriteFile(path, []byte(hostFstab), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	persister, err := New(mode, path)
+	if err != nil {
+		t.Fatalf("failed to create the persister, error: %s", err.Error())
+	}
+	return persister, path
+}
+
+// verifyMounts checks the listed mounts, the options are listed with nofail
+func verifyMounts(t *testing.T, persister Persister, expected ...Mount) {
+	t.Helper()
+	mounts, err := persister.List()
+	if err != nil {
+		t.Fatalf("failed to list the mounts, error: %s", err.Error())
+	}
+	if expected == nil {
+		expected = []Mount{}
+	}
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].UUID < mounts[j].UUID })
+	sort.Slice(expected, func(i, j int) bool { return expected[i].UUID < expected[j].UUID })
+	for i := range expected {
+		expected[i].Options = strings.Split(getOptions(expected[i].Options), ",")
+	}
+	if !reflect.DeepEqual(mounts, expected) {
+		t.Errorf("expected mounts %+v, got %+v", expected, mounts)
+	}
+}
+
+func TestPersistenceRoundTrip(t *testing.T) {
+	for _, mode := range []string{ModeFstab, ModeSystemd} {
+		t.Run(mode, func(t *testing.T) {
+			persister, _ := newPersister(t, mode)
+			verifyMounts(t, persister)
+
+			for _, mount := range []Mount{dataMount, logMount, dataMount} {
+				if err := persister.Persist(mount); err != nil {
+					t.Fatalf("failed to persist mount %s, error: %s", mount.MountPoint, err.Error())
+				}
+			}
+			verifyMounts(t, persister, dataMount, logMount)
+
+			// the mount of the same filesystem is replaced
+			moved := dataMount
+			moved.MountPoint = "/var/lib/longhorn-moved"
+			if err := persister.Persist(moved); err != nil {
+				t.Fatal(err)
+			}
+			verifyMounts(t, persister, moved, logMount)
+
+			// the mount of another filesystem to the same mount point is replaced
+			replaced := logMount
+			replaced.UUID = "f1e2d3c4-b5a6-4978-8695-a4b3c2d1e0f9"
+			if err := persister.Persist(replaced); err != nil {
+				t.Fatal(err)
+			}
+			verifyMounts(t, persister, moved, replaced)
+
+			for _, uuid := range []string{moved.UUID, moved.UUID, "unknown"} {
+				if err := persister.Remove(uuid); err != nil {
+					t.Fatalf("failed to remove mount %s, error: %s", uuid, err.Error())
+				}
+			}
+			verifyMounts(t, persister, replaced)
+
+			if err := persister.Persist(Mount{UUID: dataMount.UUID}); err == nil {
+				t.Errorf("expected error of the mount without mount point")
+			}
+		})
+	}
+}
+
+func TestFstab(t *testing.T) {
+	persister, path := newPersister(t, ModeFstab)
+	for _, mount := range []Mount{dataMount, logMount} {
+		if err := persister.Persist(mount); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := hostFstab +
+		marker + dataMount.UUID + "\n" +
+		"UUID=" + dataMount.UUID + ` /var/lib/longhorn\040data ext4 noatime,nofail 0 2` + "\n" +
+		marker + logMount.UUID + "\n" +
+		"UUID=" + logMount.UUID + " /var/lib/longhorn-log xfs nofail 0 2\n"
+	if string(content) != expected {
+		t.Errorf("expected fstab:\n%s\ngot:\n%s", expected, content)
+	}
+
+	// the file is left alone once the entry is persisted, even if it's not the last one
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, past, past); err != nil {
+		t.Fatal(err)
+	}
+	if err := persister.Persist(dataMount); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(past) {
+		t.Errorf("expected fstab not to be written again, got modified at %s", info.ModTime())
+	}
+
+	for _, mount := range []Mount{dataMount, logMount} {
+		if err := persister.Remove(mount.UUID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != hostFstab {
+		t.Errorf("expected the entries of the host to be kept, got:\n%s", content)
+	}
+}
+
+func TestSystemdUnits(t *testing.T) {
+	persister, dir := newPersister(t, ModeSystemd)
+	// the unit of the host is not managed
+	hostUnit := filepath.Join(dir, "boot.mount")
+	if err := ioutil.WriteFile(hostUnit, []byte("[Mount]\nWhere=/boot\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := persister.Persist(dataMount); err != nil {
+		t.Fatal(err)
+	}
+
+	unit := `var-lib-longhorn\x20data.mount`
+	content, err := ioutil.ReadFile(filepath.Join(dir, unit))
+	if err != nil {
+		t.Fatalf("expected mount unit %s, error: %s", unit, err.Error())
+	}
+	for _, line := range []string{
+		"What=/dev/disk/by-uuid/" + dataMount.UUID,
+		"Where=/var/lib/longhorn data",
+		"Type=ext4",
+		"Options=noatime,nofail",
+		"WantedBy=local-fs.target",
+	} {
+		if !strings.Contains(string(content), line+"\n") {
+			t.Errorf("expected line %q in the mount unit, got:\n%s", line, content)
+		}
+	}
+	link := filepath.Join(dir, "local-fs.target.wants", unit)
+	if target, err := os.Readlink(link); err != nil || target != filepath.Join("..", unit) {
+		t.Errorf("expected the mount unit to be enabled, got link to %q, error: %v", target, err)
+	}
+	verifyMounts(t, persister, dataMount)
+
+	if err := persister.Remove(dataMount.UUID); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{link, filepath.Join(dir, unit)} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, error: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(hostUnit); err != nil {
+		t.Errorf("expected the unit of the host to be kept, error: %s", err.Error())
+	}
+}
+
+func TestEscapeMountUnitName(t *testing.T) {
+	tests := map[string]string{
+		"/":                      "-.mount",
+		"/var/lib/longhorn/":     "var-lib-longhorn.mount",
+		"/mnt/disk-1":            `mnt-disk\x2d1.mount`,
+		"/mnt/.hidden":           "mnt-.hidden.mount",
+		"/.hidden":               `\x2ehidden.mount`,
+		"/var/lib/longhorn data": `var-lib-longhorn\x20data.mount`,
+	}
+	for path, expected := range tests {
+		if name := escapeMountUnitName(path); name != expected {
+			t.Errorf("expected unit name %s of %s, got %s", expected, path, name)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	mountUnitSuffix = ".mount"
+	wantedBy        = "local-fs.target"
+)
+
+// systemdUnits persists the mounts as the systemd mount units in the directory, the units are enabled by the
+// symbolic links in the local-fs.target.wants directory, so they are started on boot
+type systemdUnits struct {
+	lock sync.Mutex
+	dir  string
+}
+
+func (s *systemdUnits) Persist(mount Mount) error {
+	if mount.UUID == "" || mount.MountPoint == "" {
+		return fmt.Errorf("the UUID and mount point are required to persist the mount")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	unit := escapeMountUnitName(mount.MountPoint)
+	mounts, err := s.list()
+	if err != nil {
+		return err
+	}
+	for name, m := range mounts {
+		if name != unit && (m.UUID == mount.UUID || m.MountPoint == mount.MountPoint) {
+			if err := s.remove(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	content := []byte(fmt.Sprintf(`%s%s
+[Unit]
+Description=Mount the block device %s managed by node-disk-manager
+
+[Mount]
+What=/dev/disk/by-uuid/%s
+Where=%s
+Type=%s
+Options=%s
+
+[Install]
+WantedBy=%s
+`, marker, mount.UUID, mount.UUID, mount.UUID, mount.MountPoint, mount.FsType, getOptions(mount.Options), wantedBy))
+
+	unitPath := filepath.Join(s.dir, unit)
+	if existing, err := ioutil.ReadFile(unitPath); err != nil || !bytes.Equal(existing, content) {
+		if err := ioutil.WriteFile(unitPath, content, 0644); err != nil {
+			return err
+		}
+	}
+	return s.enable(unit)
+}
+
+func (s *systemdUnits) Remove(uuid string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	mounts, err := s.list()
+	if err != nil {
+		return err
+	}
+	for name, m := range mounts {
+		if m.UUID == uuid {
+			if err := s.remove(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *systemdUnits) List() ([]Mount, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	mounts, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Mount, 0, len(mounts))
+	for _, m := range mounts {
+		list = append(list, m)
+	}
+	return list, nil
+}
+
+// list returns the managed mount units keyed by the unit name
+func (s *systemdUnits) list() (map[string]Mount, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := make(map[string]Mount)
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), mountUnitSuffix) {
+			continue
+		}
+		mount, managed, err := readMountUnit(filepath.Join(s.dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if managed {
+			mounts[file.Name()] = mount
+		}
+	}
+	return mounts, nil
+}
+
+func (s *systemdUnits) enable(unit string) error {
+	wantsDir := filepath.Join(s.dir, wantedBy+".wants")
+	if err := os.MkdirAll(wantsDir, 0755); err != nil {
+		return err
+	}
+	link := filepath.Join(wantsDir, unit)
+	if _, err := os.Lstat(link); err == nil {
+		return nil
+	}
+	// the link is relative since the directory may be mounted to a different path in the container
+	return os.Symlink(filepath.Join("..", unit), link)
+}
+
+func (s *systemdUnits) remove(unit string) error {
+	for _, path := range []string{filepath.Join(s.dir, wantedBy+".wants", unit), filepath.Join(s.dir, unit)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMountUnit parses the mount unit file, it returns false if the unit is not managed by the node-disk-manager
+func readMountUnit(path string) (Mount, bool, error) {
+	mount := Mount{}
+	file, err := os.Open(path)
+	if err != nil {
+		return mount, false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() || !strings.HasPrefix(scanner.Text(), marker) {
+		return mount, false, scanner.Err()
+	}
+	mount.UUID = strings.TrimPrefix(scanner.Text(), marker)
+	for scanner.Scan() {
+		key, value, ok := cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "Where":
+			mount.MountPoint = value
+		case "Type":
+			mount.FsType = value
+		case "Options":
+			mount.Options = strings.Split(value, ",")
+		}
+	}
+	return mount, true, scanner.Err()
+}
+
+// escapeMountUnitName returns the name of the mount unit of the path, the same as `systemd-escape --path --suffix=mount`
+func escapeMountUnitName(path string) string {
+	path = strings.Trim(filepath.Clean(path), "/")
+	if path == "" {
+		return "-" + mountUnitSuffix
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '/':
+			b.WriteByte('-')
+		case c == '.' && i == 0,
+			!(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == ':' || c == '_' || c == '.'):
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String() + mountUnitSuffix
+}
+
+func cut(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,101 @@
+package udev
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pilebones/go-udev/netlink"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	rulesReloadInterval = 10 * time.Second
+)
+
+// ruleMatcher is a netlink.Matcher that loads the rule definitions from a file, and reloads them whenever
+// the file is changed, so the rules can be updated without restarting the monitor
+type ruleMatcher struct {
+	lock     sync.RWMutex
+	filePath string
+	modTime  time.Time
+	matcher  netlink.Matcher
+}
+
+func newRuleMatcher(filePath string) (*ruleMatcher, error) {
+	m := &ruleMatcher{
+		filePath: filePath,
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// load reads and validates the rules file, the current rules are kept if the new ones are invalid
+func (m *ruleMatcher) load() error {
+	info, err := os.Stat(m.filePath)
+	if err != nil {
+		return err
+	}
+
+	matcher, err := getOptionalMatcher(&m.filePath)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.matcher = matcher
+	m.modTime = info.ModTime()
+	return nil
+}
+
+// reload loads the rules file again if it has been modified since the last load
+func (m *ruleMatcher) reload() {
+	info, err := os.Stat(m.filePath)
+	if err != nil {
+		logrus.Errorf("failed to stat udev rules file %s, error: %s", m.filePath, err.Error())
+		return
+	}
+
+	m.lock.RLock()
+	modified := !info.ModTime().Equal(m.modTime)
+	m.lock.RUnlock()
+	if !modified {
+		return
+	}
+
+	if err := m.load(); err != nil {
+		logrus.Errorf("failed to reload udev rules file %s, keep using the previous rules, error: %s", m.filePath, err.Error())
+		return
+	}
+	logrus.Infof("Reloaded udev rules from %s:\n%s", m.filePath, m.String())
+}
+
+func (m *ruleMatcher) get() netlink.Matcher {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.matcher
+}
+
+func (m *ruleMatcher) Evaluate(e netlink.UEvent) bool {
+	return m.get().Evaluate(e)
+}
+
+func (m *ruleMatcher) EvaluateAction(a netlink.KObjAction) bool {
+	return m.get().EvaluateAction(a)
+}
+
+func (m *ruleMatcher) EvaluateEnv(e map[string]string) bool {
+	return m.get().EvaluateEnv(e)
+}
+
+// Compile is a no-op since the rules are compiled and validated on load
+func (m *ruleMatcher) Compile() error {
+	return nil
+}
+
+func (m *ruleMatcher) String() string {
+	return m.get().String()
+}
@@ -0,0 +1,134 @@
+package udev
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pilebones/go-udev/netlink"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	maxEventRetries = 5
+
+	eventRetryBaseDelay = 1 * time.Second
+	eventRetryMaxDelay  = 30 * time.Second
+)
+
+type queuedEvent struct {
+	seq    uint64
+	uevent netlink.UEvent
+	// rescan is set on the event that rescans the disk of a dropped event
+	rescan bool
+}
+
+// rescanFunc returns the key and the event that rescan the disk of the dropped event
+type rescanFunc func(uevent netlink.UEvent) (string, netlink.UEvent)
+
+// eventQueue is a rate-limited work queue of the udev events keyed by device path. The events of the same device
+// are de-duplicated, only the latest one is handled, and a failed event is retried up to maxEventRetries times.
+// A dropped event is followed by a rescan of its disk, so the block devices catch up with the device once the
+// failure is gone. If the rescan is dropped too, the block devices are left to the full rescan of the node.
+type eventQueue struct {
+	queue  workqueue.RateLimitingInterface
+	rescan rescanFunc
+
+	lock   sync.Mutex
+	seq    uint64
+	events map[string]queuedEvent
+
+	dropped uint64
+}
+
+func newEventQueue(rescan rescanFunc) *eventQueue {
+	return &eventQueue{
+		queue: workqueue.NewNamedRateLimitingQueue(
+			workqueue.NewItemExponentialFailureRateLimiter(eventRetryBaseDelay, eventRetryMaxDelay), "udev"),
+		rescan: rescan,
+		events: make(map[string]queuedEvent),
+	}
+}
+
+// add enqueues the event, it replaces the pending event of the same device
+func (q *eventQueue) add(key string, uevent netlink.UEvent) {
+	q.store(key, uevent, false)
+	q.queue.Add(key)
+}
+
+// addRescan enqueues the rescan after the base retry delay, unless an event of the device is pending. The pending
+// event is newer than the dropped one, so it's handled instead.
+func (q *eventQueue) addRescan(key string, uevent netlink.UEvent) {
+	q.lock.Lock()
+	_, pending := q.events[key]
+	q.lock.Unlock()
+	if pending {
+		return
+	}
+	q.store(key, uevent, true)
+	q.queue.AddRateLimited(key)
+}
+
+func (q *eventQueue) store(key string, uevent netlink.UEvent, rescan bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.seq++
+	q.events[key] = queuedEvent{seq: q.seq, uevent: uevent, rescan: rescan}
+}
+
+// process handles the next event in the queue, it returns false when the queue is shut down
+func (q *eventQueue) process(handler func(netlink.UEvent) error) bool {
+	item, quit := q.queue.Get()
+	if quit {
+		return false
+	}
+	defer q.queue.Done(item)
+
+	key := item.(string)
+	q.lock.Lock()
+	event, ok := q.events[key]
+	q.lock.Unlock()
+	if !ok {
+		q.queue.Forget(key)
+		return true
+	}
+
+	err := handler(event.uevent)
+	if err == nil {
+		q.queue.Forget(key)
+		q.remove(key, event.seq)
+		return true
+	}
+
+	if q.queue.NumRequeues(key) < maxEventRetries {
+		logrus.Errorf("failed to handle udev %s event of %s, retry later, error: %s", event.uevent.Action, key, err.Error())
+		q.queue.AddRateLimited(key)
+		return true
+	}
+
+	dropped := atomic.AddUint64(&q.dropped, 1)
+	logrus.Errorf("drop udev %s event of %s after %d retries (%d events dropped in total), error: %s",
+		event.uevent.Action, key, maxEventRetries, dropped, err.Error())
+	q.queue.Forget(key)
+	q.remove(key, event.seq)
+	if event.rescan || q.rescan == nil {
+		logrus.Warnf("leave the block devices of %s to the periodic rescan or the rescan requested on the node", key)
+		return true
+	}
+	q.addRescan(q.rescan(event.uevent))
+	return true
+}
+
+// remove deletes the handled event unless a newer event of the device has been enqueued meanwhile
+func (q *eventQueue) remove(key string, seq uint64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if event, ok := q.events[key]; ok && event.seq == seq {
+		delete(q.events, key)
+	}
+}
+
+func (q *eventQueue) shutDown() {
+	q.queue.ShutDown()
+}
@@ -6,48 +6,68 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
-	"reflect"
 	"sync"
 	"time"
 
 	"github.com/kr/pretty"
 	"github.com/pilebones/go-udev/netlink"
 	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
 
 	diskv1 "github.com/longhorn/node-disk-manager/pkg/apis/longhorn.io/v1beta1"
 	"github.com/longhorn/node-disk-manager/pkg/block"
 	"github.com/longhorn/node-disk-manager/pkg/controller/blockdevice"
+	"github.com/longhorn/node-disk-manager/pkg/filter"
 	ctldiskv1 "github.com/longhorn/node-disk-manager/pkg/generated/controllers/longhorn.io/v1beta1"
 	"github.com/longhorn/node-disk-manager/pkg/option"
 	"github.com/longhorn/node-disk-manager/pkg/util"
 )
 
-const (
-	defaultDuration time.Duration = 1
-)
-
 type Udev struct {
 	namespace  string
 	nodeName   string
 	startOnce  sync.Once
 	controller *blockdevice.Controller
+	matcher    *ruleMatcher
+
+	queue       *eventQueue
+	threadiness int
 }
 
-func NewUdev(block *block.Info, blockdevices ctldiskv1.BlockDeviceController, opt *option.Option) *Udev {
+// NewUdev returns the udev monitor, the rules file of the option is validated if it is specified
+func NewUdev(host block.Host, block *block.Info, blockdevices ctldiskv1.BlockDeviceController, filter *filter.DeviceFilter,
+	opt *option.Option) (*Udev, error) {
 	controller := &blockdevice.Controller{
+		Host:             host,
 		BlockInfo:        block,
 		Blockdevices:     blockdevices,
 		BlockdeviceCache: blockdevices.Cache(),
+		Filter:           filter,
 	}
-	return &Udev{
-		startOnce:  sync.Once{},
-		namespace:  opt.Namespace,
-		nodeName:   opt.NodeName,
-		controller: controller,
+	u := &Udev{
+		startOnce:   sync.Once{},
+		namespace:   opt.Namespace,
+		nodeName:    opt.NodeName,
+		controller:  controller,
+		threadiness: opt.Threadiness,
 	}
+	u.queue = newEventQueue(u.rescanEvent)
+	if u.threadiness < 1 {
+		u.threadiness = 1
+	}
+
+	if opt.UdevRulesFile != "" {
+		matcher, err := newRuleMatcher(opt.UdevRulesFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load udev rules file %s, error: %w", opt.UdevRulesFile, err)
+		}
+		u.matcher = matcher
+	}
+	return u, nil
 }
 
 func (u *Udev) Monitor(ctx context.Context) {
@@ -59,9 +79,11 @@ func (u *Udev) Monitor(ctx context.Context) {
 func (u *Udev) monitor(ctx context.Context) {
 	logrus.Infoln("Start monitoring udev processed events")
 
-	matcher, err := getOptionalMatcher(nil)
-	if err != nil {
-		logrus.Fatalf("failed to get udev config, error: %s", err.Error())
+	var matcher netlink.Matcher
+	if u.matcher != nil {
+		logrus.Infof("Filter udev events with rules:\n%s", u.matcher.String())
+		matcher = u.matcher
+		go wait.Until(u.matcher.reload, rulesReloadInterval, ctx.Done())
 	}
 
 	conn := new(netlink.UEventConn)
@@ -70,6 +92,12 @@ func (u *Udev) monitor(ctx context.Context) {
 	}
 	defer conn.Close()
 
+	// the events are handled by the workers, so a failing device doesn't block the events of the others
+	defer u.queue.shutDown()
+	for i := 0; i < u.threadiness; i++ {
+		go wait.Until(u.runWorker, time.Second, ctx.Done())
+	}
+
 	uqueue := make(chan netlink.UEvent)
 	errors := make(chan error)
 	quit := conn.Monitor(uqueue, errors, matcher)
@@ -78,7 +106,7 @@ func (u *Udev) monitor(ctx context.Context) {
 	for {
 		select {
 		case uevent := <-uqueue:
-			u.ActionHandler(uevent)
+			u.queue.add(InitUdevDevice(uevent.Env).GetPath(), uevent)
 		case err := <-errors:
 			logrus.Errorf("failed to parse udev event, error: %s", err.Error())
 		case <-ctx.Done():
@@ -88,104 +116,233 @@ func (u *Udev) monitor(ctx context.Context) {
 	}
 }
 
-func (u *Udev) ActionHandler(uevent netlink.UEvent) {
+func (u *Udev) runWorker() {
+	for u.queue.process(u.ActionHandler) {
+	}
+}
+
+// ActionHandler handles the udev event of a disk or partition
+func (u *Udev) ActionHandler(uevent netlink.UEvent) error {
 	udevDevice := InitUdevDevice(uevent.Env)
 	if util.IsLonghornBlockDevice(udevDevice.GetIDPath()) {
 		logrus.Tracef("ignore longhorn block device %s, uevent info: %v", udevDevice.GetPath(), pretty.Sprint(uevent))
-		return
-	}
-
-	if udevDevice.IsDisk() || udevDevice.IsPartition() {
-		log.Println("Handle", pretty.Sprint(uevent))
-		switch uevent.Action {
-		case netlink.ADD:
-			u.AddBlockDevice(udevDevice, defaultDuration)
-		case netlink.REMOVE:
-			u.RemoveBlockDevice(udevDevice, defaultDuration)
-		case netlink.ONLINE:
-			u.UpdateBlockDevice(udevDevice, defaultDuration, uevent.Action)
-		case netlink.OFFLINE:
-			u.UpdateBlockDevice(udevDevice, defaultDuration, uevent.Action)
-		}
+		return nil
 	}
-}
-func (u *Udev) UpdateBlockDevice(device UdevDevice, duration time.Duration, action netlink.KObjAction) {
-	if duration > defaultDuration {
-		time.Sleep(duration)
+
+	if !udevDevice.IsDisk() && !udevDevice.IsPartition() {
+		return nil
 	}
+
+	if uevent.Action != netlink.REMOVE && !u.isDeviceAccepted(udevDevice) {
+		logrus.Tracef("ignore filtered block device %s, uevent info: %v", udevDevice.GetPath(), pretty.Sprint(uevent))
+		return nil
+	}
+
+	log.Println("Handle", pretty.Sprint(uevent))
+	switch uevent.Action {
+	case netlink.ADD:
+		return u.AddBlockDevice(udevDevice)
+	case netlink.REMOVE:
+		return u.RemoveBlockDevice(udevDevice)
+	case netlink.CHANGE:
+		return u.ChangeBlockDevice(udevDevice)
+	case netlink.ONLINE, netlink.OFFLINE:
+		return u.UpdateBlockDevice(udevDevice, uevent.Action)
+	}
+	return nil
+}
+
+func (u *Udev) UpdateBlockDevice(device UdevDevice, action netlink.KObjAction) error {
 	logrus.Debugf("uevent update block deivce %s", device.GetPath())
 	devName := device.GetShortName()
-	bdName := util.GetBlockDeviceName(devName, u.nodeName)
 	disk := u.controller.BlockInfo.GetDiskByName(devName)
 
-	bd, err := u.controller.BlockdeviceCache.Get(u.namespace, bdName)
+	bd, err := u.getBlockDevice(device)
+	if errors.IsNotFound(err) {
+		logrus.Debugf("skip updating block device of %s, it is not registered", device.GetPath())
+		return nil
+	}
 	if err != nil {
-		logrus.Errorf("failed to get block device %s, error: %s", bdName, err.Error())
+		return err
 	}
 
-	bdCopy := bd.DeepCopy()
+	var state diskv1.BlockDeviceState
 	switch action {
 	case netlink.ONLINE:
-		bdCopy.Status.State = diskv1.BlockDeviceActive
+		state = diskv1.BlockDeviceActive
 	case netlink.OFFLINE:
-		bdCopy.Status.State = diskv1.BlockDeviceInactive
+		state = diskv1.BlockDeviceInactive
 	default:
-		return
+		return nil
 	}
 
 	mounted := disk.FileSystemInfo.MountPoint != ""
-	diskv1.DeviceMounted.SetStatusBool(bdCopy, mounted)
-
-	if !reflect.DeepEqual(bd.Status, bdCopy.Status) {
-		if _, err := u.controller.Blockdevices.UpdateStatus(bdCopy); err != nil {
-			u.UpdateBlockDevice(device, 2*duration, action)
-		}
-	}
+	_, err = u.controller.UpdateBlockDeviceStatus(bd, func(latest *diskv1.BlockDevice) {
+		latest.Status.State = state
+		diskv1.DeviceMounted.SetStatusBool(latest, mounted)
+	})
+	return err
 }
 
 // AddBlockDevice add new block device and partitions by watching the udev add action
-func (u *Udev) AddBlockDevice(device UdevDevice, duration time.Duration) {
-	if duration > defaultDuration {
-		time.Sleep(duration)
-	}
+func (u *Udev) AddBlockDevice(device UdevDevice) error {
 	logrus.Debugf("uevent add block deivce %s", device.GetPath())
 
-	devName := device.GetShortName()
+	devName := u.getDiskName(device)
+	if devName == "" {
+		return nil
+	}
 	disk := u.controller.BlockInfo.GetDiskByName(devName)
 	bds := blockdevice.GetNewBlockDevices(disk, u.nodeName, u.namespace)
 
-	// block.GetNewBlockDevices()
 	bdList, err := u.controller.BlockdeviceCache.List(u.namespace, labels.Everything())
 	if err != nil {
-		logrus.Errorf("Failed to add block device via udev event, error: %s, retry in %s", err.Error(), duration.String())
-		u.AddBlockDevice(device, 2*duration)
+		return err
 	}
 
 	for _, bd := range bds {
 		if err := u.controller.SaveBlockDevice(bd, bdList); err != nil {
-			logrus.Errorf("failed to save block device %s, error: %s", bd.Name, err.Error())
-			u.AddBlockDevice(device, 2*defaultDuration)
+			return fmt.Errorf("failed to save block device %s, error: %w", bd.Name, err)
 		}
 	}
+	return nil
 }
 
-// RemoveBlockDevice will set the existing block device to detached state
-func (u *Udev) RemoveBlockDevice(device UdevDevice, duration time.Duration) {
-	if duration > defaultDuration {
-		time.Sleep(duration)
+// ChangeBlockDevice re-reads the disk of the device when its filesystem, partition table or size is changed, e.g.
+// by mkfs, sgdisk or growpart, and reconciles the block devices of the disk and all of its partitions
+func (u *Udev) ChangeBlockDevice(device UdevDevice) error {
+	logrus.Debugf("uevent change block deivce %s", device.GetPath())
+
+	devName := u.getDiskName(device)
+	if devName == "" {
+		return nil
+	}
+	disk := u.controller.BlockInfo.GetDiskByName(devName)
+	bds := blockdevice.GetNewBlockDevices(disk, u.nodeName, u.namespace)
+
+	bdList, err := u.controller.BlockdeviceCache.List(u.namespace, labels.SelectorFromSet(map[string]string{
+		v1.LabelHostname: u.nodeName,
+	}))
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]bool, len(bds))
+	for _, bd := range bds {
+		current[bd.Name] = true
+		if err := u.controller.SaveBlockDevice(bd, bdList); err != nil {
+			return fmt.Errorf("failed to save block device %s, error: %w", bd.Name, err)
+		}
 	}
+
+	// remove the partitions that vanished from the partition table
+	parentName := bds[0].Name
+	for _, existingBD := range bdList {
+		if existingBD.Labels[blockdevice.ParentDeviceLabel] != parentName || current[existingBD.Name] {
+			continue
+		}
+		logrus.Infof("Remove vanished partition block device %s with device: %s", existingBD.Name, existingBD.Spec.DevPath)
+		err := u.controller.Blockdevices.Delete(u.namespace, existingBD.Name, &metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete block device %s, error: %w", existingBD.Name, err)
+		}
+	}
+	return nil
+}
+
+// RemoveBlockDevice will delete the existing block device of the removed device
+func (u *Udev) RemoveBlockDevice(device UdevDevice) error {
 	logrus.Debugf("uevent remove block deivce %s", device.GetPath())
 
-	devName := device.GetShortName()
-	bdName := util.GetBlockDeviceName(devName, u.nodeName)
-	err := u.controller.Blockdevices.Delete(u.namespace, bdName, &metav1.DeleteOptions{})
+	var bd *diskv1.BlockDevice
+	var err error
+	if u.controller.BlockInfo.IsDevicePresent(device.GetShortName()) {
+		bd, err = u.getBlockDevice(device)
+	} else {
+		// the removed device can't be identified anymore, the block device is still linked to its device path since
+		// the kernel name is not reused before the removal is handled
+		bd, err = u.getBlockDeviceByDevPath(device.GetPath())
+	}
+	if errors.IsNotFound(err) {
+		return nil
+	}
 	if err != nil {
-		logrus.Errorf("faield to delete the block device %s, error: %s", bdName, err.Error())
+		return err
 	}
+
+	err = u.controller.Blockdevices.Delete(u.namespace, bd.Name, &metav1.DeleteOptions{})
 	if err != nil && !errors.IsNotFound(err) {
-		logrus.Errorf("failed to delete block device %s, error: %s", bdName, err.Error())
-		u.RemoveBlockDevice(device, 2*duration)
+		return fmt.Errorf("failed to delete block device %s, error: %w", bd.Name, err)
+	}
+	return nil
+}
+
+// rescanEvent returns the event that rescans the disk of the dropped event. The change event of the disk reconciles
+// the block devices of the disk and all of its partitions, the remove event is replayed if the device is gone.
+func (u *Udev) rescanEvent(uevent netlink.UEvent) (string, netlink.UEvent) {
+	device := InitUdevDevice(uevent.Env)
+	if !u.controller.BlockInfo.IsDevicePresent(device.GetShortName()) {
+		return device.GetPath(), netlink.UEvent{Action: netlink.REMOVE, Env: uevent.Env}
+	}
+
+	env := make(map[string]string, len(uevent.Env))
+	for k, v := range uevent.Env {
+		env[k] = v
+	}
+	env[UDEV_TYPE] = UDEV_SYSTEM
+	env[UDEV_DEVNAME] = "/dev/" + u.getDiskName(device)
+	return env[UDEV_DEVNAME], netlink.UEvent{Action: netlink.CHANGE, Env: env}
+}
+
+// getDiskName returns the name of the disk that the device belongs to, i.e. the parent disk of a partition
+func (u *Udev) getDiskName(device UdevDevice) string {
+	devName := device.GetShortName()
+	if device.IsPartition() {
+		return u.controller.BlockInfo.GetParentDiskName(devName)
+	}
+	return devName
+}
+
+// isDeviceAccepted checks the device against the device filter, a partition is accepted when its disk is accepted
+func (u *Udev) isDeviceAccepted(device UdevDevice) bool {
+	devName := u.getDiskName(device)
+	if devName == "" {
+		return true
+	}
+	disk := u.controller.BlockInfo.GetDiskByName(devName)
+	return u.controller.Filter.Match(disk) && !disk.Topology.IsMultipathMember()
+}
+
+// getBlockDevice returns the block device of the present device, it's looked up by the name derived from the stable
+// identifier of the device rather than the device path, which may be left by another device after re-enumeration
+func (u *Udev) getBlockDevice(device UdevDevice) (*diskv1.BlockDevice, error) {
+	if devName := u.getDiskName(device); devName != "" {
+		disk := u.controller.BlockInfo.GetDiskByName(devName)
+		for _, bd := range blockdevice.GetNewBlockDevices(disk, u.nodeName, u.namespace) {
+			if bd.Spec.DevPath == device.GetPath() {
+				return u.controller.BlockdeviceCache.Get(u.namespace, bd.Name)
+			}
+		}
+	}
+	return nil, errors.NewNotFound(diskv1.Resource(diskv1.BlockDeviceResourceName), device.GetPath())
+}
+
+// getBlockDeviceByDevPath returns the block device of current node that is linked to the device path, it's only used
+// for the removed device that can't be identified by getBlockDevice anymore
+func (u *Udev) getBlockDeviceByDevPath(devPath string) (*diskv1.BlockDevice, error) {
+	bds, err := u.controller.BlockdeviceCache.List(u.namespace, labels.SelectorFromSet(map[string]string{
+		v1.LabelHostname: u.nodeName,
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, bd := range bds {
+		if bd.Spec.DevPath == devPath {
+			return bd, nil
+		}
 	}
+	return nil, errors.NewNotFound(diskv1.Resource(diskv1.BlockDeviceResourceName), devPath)
 }
 
 // getOptionalMatcher Parse and load config file which contains rules for matching
@@ -208,5 +365,13 @@ func getOptionalMatcher(filePath *string) (matcher netlink.Matcher, err error) {
 		return nil, fmt.Errorf("wrong rule syntax, err: %w", err)
 	}
 
+	if len(rules.Rules) == 0 {
+		return nil, fmt.Errorf("empty, no rules provided in \"%s\"", *filePath)
+	}
+
+	if err := rules.Compile(); err != nil {
+		return nil, fmt.Errorf("wrong rule expression, err: %w", err)
+	}
+
 	return &rules, nil
 }
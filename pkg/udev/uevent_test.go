@@ -0,0 +1,498 @@
+package udev
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pilebones/go-udev/netlink"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+
+	diskv1 "github.com/longhorn/node-disk-manager/pkg/apis/longhorn.io/v1beta1"
+	"github.com/longhorn/node-disk-manager/pkg/block/blocktest"
+	"github.com/longhorn/node-disk-manager/pkg/controller/blockdevice"
+	"github.com/longhorn/node-disk-manager/pkg/filter"
+	"github.com/longhorn/node-disk-manager/pkg/option"
+	"github.com/longhorn/node-disk-manager/pkg/util/fakeclients"
+)
+
+const (
+	testNamespace = "longhorn-system"
+	testNodeName  = "node1"
+
+	nvmeIDPath = "pci-0000:3b:00.0-nvme-1"
+)
+
+// step changes the host, if the mutation is set, and then replays the event
+type step struct {
+	mutate func(t *testing.T, host *blocktest.Host)
+	event  netlink.UEvent
+}
+
+// expectedDevice is the expected block device of a device path
+type expectedDevice struct {
+	state diskv1.BlockDeviceState
+	// parent is the device path of the parent disk of a partition
+	parent string
+	// mounted is the status of the Mounted condition, or "" if the condition isn't set
+	mounted string
+}
+
+func diskEvent(action netlink.KObjAction, devPath, idPath string) netlink.UEvent {
+	return netlink.UEvent{
+		Action: action,
+		Env: map[string]string{
+			UDEV_TYPE:    UDEV_SYSTEM,
+			UDEV_DEVNAME: devPath,
+			UDEV_ID_PATH: idPath,
+		},
+	}
+}
+
+func partitionEvent(action netlink.KObjAction, devPath, idPath string) netlink.UEvent {
+	event := diskEvent(action, devPath, idPath)
+	event.Env[UDEV_TYPE] = UDEV_PARTITION
+	return event
+}
+
+func removeDevice(name string) func(t *testing.T, host *blocktest.Host) {
+	return func(t *testing.T, host *blocktest.Host) {
+		host.RemoveDevice(t, name)
+	}
+}
+
+func newTestUdev(t *testing.T, snapshot string, objects ...*diskv1.BlockDevice) (*Udev, *blocktest.Host, *fakeclients.BlockDeviceController) {
+	t.Helper()
+	host := blocktest.NewHost(t, snapshot)
+	blockdevices := fakeclients.NewBlockDeviceController(objects...)
+	u, err := NewUdev(host, host.Info, blockdevices, filter.NewDefaultDeviceFilter(), &option.Option{
+		Namespace: testNamespace,
+		NodeName:  testNodeName,
+	})
+	if err != nil {
+		t.Fatalf("failed to create udev, error: %s", err.Error())
+	}
+	return u, host, blockdevices
+}
+
+// getNodeBlockDevices returns the block devices of the test node by device path
+func getNodeBlockDevices(t *testing.T, blockdevices *fakeclients.BlockDeviceController) map[string]*diskv1.BlockDevice {
+	t.Helper()
+	list, err := blockdevices.List(testNamespace, metav1.ListOptions{LabelSelector: v1.LabelHostname + "=" + testNodeName})
+	if err != nil {
+		t.Fatalf("failed to list block devices, error: %s", err.Error())
+	}
+
+	bds := make(map[string]*diskv1.BlockDevice, len(list.Items))
+	for i := range list.Items {
+		bd := &list.Items[i]
+		if _, ok := bds[bd.Spec.DevPath]; ok {
+			t.Fatalf("device %s is linked by multiple block devices", bd.Spec.DevPath)
+		}
+		bds[bd.Spec.DevPath] = bd
+	}
+	return bds
+}
+
+func TestActionHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		snapshot string
+		steps    []step
+		expected map[string]expectedDevice
+	}{
+		{
+			name:     "add disk",
+			snapshot: "nvme.tar.gz",
+			steps: []step{
+				{event: diskEvent(netlink.ADD, "/dev/nvme0n1", nvmeIDPath)},
+			},
+			expected: map[string]expectedDevice{
+				"/dev/nvme0n1":   {state: diskv1.BlockDeviceActive},
+				"/dev/nvme0n1p1": {state: diskv1.BlockDeviceActive, parent: "/dev/nvme0n1"},
+				"/dev/nvme0n1p2": {state: diskv1.BlockDeviceActive, parent: "/dev/nvme0n1"},
+			},
+		},
+		{
+			name:     "add partition before its disk",
+			snapshot: "nvme.tar.gz",
+			steps: []step{
+				{event: partitionEvent(netlink.ADD, "/dev/nvme0n1p2", nvmeIDPath+"-part2")},
+				{event: diskEvent(netlink.ADD, "/dev/nvme0n1", nvmeIDPath)},
+				{event: partitionEvent(netlink.ADD, "/dev/nvme0n1p1", nvmeIDPath+"-part1")},
+			},
+			expected: map[string]expectedDevice{
+				"/dev/nvme0n1":   {state: diskv1.BlockDeviceActive},
+				"/dev/nvme0n1p1": {state: diskv1.BlockDeviceActive, parent: "/dev/nvme0n1"},
+				"/dev/nvme0n1p2": {state: diskv1.BlockDeviceActive, parent: "/dev/nvme0n1"},
+			},
+		},
+		{
+			name:     "change of disk removes vanished partition",
+			snapshot: "nvme.tar.gz",
+			steps: []step{
+				{event: diskEvent(netlink.ADD, "/dev/nvme0n1", nvmeIDPath)},
+				{mutate: removeDevice("nvme0n1p2"), event: diskEvent(netlink.CHANGE, "/dev/nvme0n1", nvmeIDPath)},
+			},
+			expected: map[string]expectedDevice{
+				"/dev/nvme0n1":   {state: diskv1.BlockDeviceActive},
+				"/dev/nvme0n1p1": {state: diskv1.BlockDeviceActive, parent: "/dev/nvme0n1"},
+			},
+		},
+		{
+			name:     "change of partition removes vanished sibling",
+			snapshot: "nvme.tar.gz",
+			steps: []step{
+				{event: diskEvent(netlink.ADD, "/dev/nvme0n1", nvmeIDPath)},
+				{mutate: removeDevice("nvme0n1p2"), event: partitionEvent(netlink.CHANGE, "/dev/nvme0n1p1", nvmeIDPath+"-part1")},
+			},
+			expected: map[string]expectedDevice{
+				"/dev/nvme0n1":   {state: diskv1.BlockDeviceActive},
+				"/dev/nvme0n1p1": {state: diskv1.BlockDeviceActive, parent: "/dev/nvme0n1"},
+			},
+		},
+		{
+			name:     "remove partition",
+			snapshot: "nvme.tar.gz",
+			steps: []step{
+				{event: diskEvent(netlink.ADD, "/dev/nvme0n1", nvmeIDPath)},
+				{mutate: removeDevice("nvme0n1p2"), event: partitionEvent(netlink.REMOVE, "/dev/nvme0n1p2", nvmeIDPath+"-part2")},
+			},
+			expected: map[string]expectedDevice{
+				"/dev/nvme0n1":   {state: diskv1.BlockDeviceActive},
+				"/dev/nvme0n1p1": {state: diskv1.BlockDeviceActive, parent: "/dev/nvme0n1"},
+			},
+		},
+		{
+			name:     "unplug disk",
+			snapshot: "nvme.tar.gz",
+			steps: []step{
+				{event: diskEvent(netlink.ADD, "/dev/nvme0n1", nvmeIDPath)},
+				{mutate: removeDevice("nvme0n1"), event: partitionEvent(netlink.REMOVE, "/dev/nvme0n1p1", nvmeIDPath+"-part1")},
+				{event: partitionEvent(netlink.REMOVE, "/dev/nvme0n1p2", nvmeIDPath+"-part2")},
+				{event: diskEvent(netlink.REMOVE, "/dev/nvme0n1", nvmeIDPath)},
+			},
+			expected: map[string]expectedDevice{},
+		},
+		{
+			name:     "remove unregistered device",
+			snapshot: "nvme.tar.gz",
+			steps: []step{
+				{event: diskEvent(netlink.REMOVE, "/dev/nvme0n1", nvmeIDPath)},
+			},
+			expected: map[string]expectedDevice{},
+		},
+		{
+			name:     "offline and online",
+			snapshot: "nvme.tar.gz",
+			steps: []step{
+				{event: diskEvent(netlink.ADD, "/dev/nvme0n1", nvmeIDPath)},
+				{event: diskEvent(netlink.OFFLINE, "/dev/nvme0n1", nvmeIDPath)},
+				{event: partitionEvent(netlink.OFFLINE, "/dev/nvme0n1p1", nvmeIDPath+"-part1")},
+				{event: partitionEvent(netlink.ONLINE, "/dev/nvme0n1p1", nvmeIDPath+"-part1")},
+			},
+			expected: map[string]expectedDevice{
+				"/dev/nvme0n1":   {state: diskv1.BlockDeviceInactive, mounted: "False"},
+				"/dev/nvme0n1p1": {state: diskv1.BlockDeviceActive, parent: "/dev/nvme0n1", mounted: "True"},
+				"/dev/nvme0n1p2": {state: diskv1.BlockDeviceActive, parent: "/dev/nvme0n1"},
+			},
+		},
+		{
+			name:     "offline of unregistered device",
+			snapshot: "nvme.tar.gz",
+			steps: []step{
+				{event: diskEvent(netlink.OFFLINE, "/dev/nvme0n1", nvmeIDPath)},
+			},
+			expected: map[string]expectedDevice{},
+		},
+		{
+			name:     "disk of root filesystem is filtered",
+			snapshot: "virtio.tar.gz",
+			steps: []step{
+				{event: diskEvent(netlink.ADD, "/dev/vda", "pci-0000:00:04.0")},
+				{event: partitionEvent(netlink.ADD, "/dev/vda1", "pci-0000:00:04.0-part1")},
+				{event: diskEvent(netlink.ADD, "/dev/vdb", "pci-0000:00:05.0")},
+				{event: diskEvent(netlink.ADD, "/dev/loop0", "")},
+			},
+			expected: map[string]expectedDevice{
+				"/dev/vdb": {state: diskv1.BlockDeviceActive},
+			},
+		},
+		{
+			name:     "longhorn volume is ignored",
+			snapshot: "virtio.tar.gz",
+			steps: []step{
+				{event: diskEvent(netlink.ADD, "/dev/vdb", "ip-10.42.0.12:3260-iscsi-iqn.2019-10.io.longhorn:pvc-1-lun-1")},
+			},
+			expected: map[string]expectedDevice{},
+		},
+		{
+			name:     "mbr partitions",
+			snapshot: "sata.tar.gz",
+			steps: []step{
+				{event: diskEvent(netlink.ADD, "/dev/sda", "pci-0000:00:17.0-ata-1")},
+				{event: partitionEvent(netlink.ONLINE, "/dev/sda2", "pci-0000:00:17.0-ata-1-part2")},
+			},
+			expected: map[string]expectedDevice{
+				"/dev/sda":  {state: diskv1.BlockDeviceActive},
+				"/dev/sda1": {state: diskv1.BlockDeviceActive, parent: "/dev/sda"},
+				"/dev/sda2": {state: diskv1.BlockDeviceActive, parent: "/dev/sda", mounted: "True"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u, host, blockdevices := newTestUdev(t, test.snapshot)
+			for i, step := range test.steps {
+				if step.mutate != nil {
+					step.mutate(t, host)
+				}
+				if err := u.ActionHandler(step.event); err != nil {
+					t.Fatalf("failed to handle event %d %s of %s, error: %s", i, step.event.Action,
+						step.event.Env[UDEV_DEVNAME], err.Error())
+				}
+			}
+
+			bds := getNodeBlockDevices(t, blockdevices)
+			if len(bds) != len(test.expected) {
+				t.Errorf("expected %d block devices, got %d", len(test.expected), len(bds))
+			}
+			for devPath, expected := range test.expected {
+				bd, ok := bds[devPath]
+				if !ok {
+					t.Errorf("expected block device of %s, got none", devPath)
+					continue
+				}
+				if bd.Spec.NodeName != testNodeName {
+					t.Errorf("expected node %s of %s, got %s", testNodeName, devPath, bd.Spec.NodeName)
+				}
+				if bd.Status.State != expected.state {
+					t.Errorf("expected state %s of %s, got %s", expected.state, devPath, bd.Status.State)
+				}
+				if mounted := diskv1.DeviceMounted.GetStatus(bd); mounted != expected.mounted {
+					t.Errorf("expected Mounted condition %q of %s, got %q", expected.mounted, devPath, mounted)
+				}
+
+				deviceType, parentName := diskv1.DeviceTypeDisk, ""
+				if expected.parent != "" {
+					deviceType = diskv1.DeviceTypePart
+					if parent, ok := bds[expected.parent]; ok {
+						parentName = parent.Name
+					}
+				}
+				if bd.Status.DeviceStatus.Details.DeviceType != deviceType {
+					t.Errorf("expected device type %s of %s, got %s", deviceType, devPath, bd.Status.DeviceStatus.Details.DeviceType)
+				}
+				if label := bd.Labels[blockdevice.ParentDeviceLabel]; label != parentName {
+					t.Errorf("expected parent label %q of %s, got %q", parentName, devPath, label)
+				}
+			}
+		})
+	}
+}
+
+func TestActionHandlerKeepsOtherNodes(t *testing.T) {
+	other := &diskv1.BlockDevice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "other",
+			Namespace: testNamespace,
+			Labels: map[string]string{
+				v1.LabelHostname: "node2",
+			},
+		},
+		Spec: diskv1.BlockDeviceSpec{
+			NodeName: "node2",
+			DevPath:  "/dev/nvme0n1p2",
+		},
+	}
+	u, host, blockdevices := newTestUdev(t, "nvme.tar.gz", other)
+
+	host.RemoveDevice(t, "nvme0n1p2")
+	events := []netlink.UEvent{
+		diskEvent(netlink.ADD, "/dev/nvme0n1", nvmeIDPath),
+		diskEvent(netlink.CHANGE, "/dev/nvme0n1", nvmeIDPath),
+		partitionEvent(netlink.OFFLINE, "/dev/nvme0n1p2", nvmeIDPath+"-part2"),
+		partitionEvent(netlink.REMOVE, "/dev/nvme0n1p2", nvmeIDPath+"-part2"),
+	}
+	for _, event := range events {
+		if err := u.ActionHandler(event); err != nil {
+			t.Fatalf("failed to handle event %s of %s, error: %s", event.Action, event.Env[UDEV_DEVNAME], err.Error())
+		}
+	}
+
+	bd, err := blockdevices.Get(testNamespace, other.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected block device of node2 to be kept, error: %s", err.Error())
+	}
+	if bd.ResourceVersion != "1" {
+		t.Errorf("expected block device of node2 to be untouched, got resource version %s", bd.ResourceVersion)
+	}
+}
+
+func TestActionHandlerIdentifiesDevice(t *testing.T) {
+	// the block device of the disk that was nvme0n1p1 before the re-enumeration, it's listed first by its name
+	stale := &diskv1.BlockDevice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "0-stale",
+			Namespace: testNamespace,
+			Labels: map[string]string{
+				v1.LabelHostname: testNodeName,
+			},
+		},
+		Spec: diskv1.BlockDeviceSpec{
+			NodeName: testNodeName,
+			DevPath:  "/dev/nvme0n1p1",
+		},
+		Status: diskv1.BlockDeviceStatus{
+			State: diskv1.BlockDeviceActive,
+		},
+	}
+	u, _, blockdevices := newTestUdev(t, "nvme.tar.gz", stale)
+
+	events := []netlink.UEvent{
+		diskEvent(netlink.ADD, "/dev/nvme0n1", nvmeIDPath),
+		partitionEvent(netlink.OFFLINE, "/dev/nvme0n1p1", nvmeIDPath+"-part1"),
+		partitionEvent(netlink.REMOVE, "/dev/nvme0n1p2", nvmeIDPath+"-part2"),
+	}
+	for _, event := range events {
+		if err := u.ActionHandler(event); err != nil {
+			t.Fatalf("failed to handle event %s of %s, error: %s", event.Action, event.Env[UDEV_DEVNAME], err.Error())
+		}
+	}
+
+	list, err := blockdevices.List(testNamespace, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list block devices, error: %s", err.Error())
+	}
+	states := make(map[string]diskv1.BlockDeviceState)
+	for _, bd := range list.Items {
+		if bd.Name == stale.Name {
+			if bd.ResourceVersion != "1" {
+				t.Errorf("expected stale block device to be untouched, got resource version %s", bd.ResourceVersion)
+			}
+			continue
+		}
+		states[bd.Spec.DevPath] = bd.Status.State
+	}
+	expected := map[string]diskv1.BlockDeviceState{
+		"/dev/nvme0n1":   diskv1.BlockDeviceActive,
+		"/dev/nvme0n1p1": diskv1.BlockDeviceInactive,
+	}
+	if !reflect.DeepEqual(states, expected) {
+		t.Errorf("expected block devices %v, got %v", expected, states)
+	}
+}
+
+func TestDroppedEventRescansDisk(t *testing.T) {
+	tests := []struct {
+		name string
+		// failures is the number of the failed attempts before the events are handled
+		failures int
+		handled  []string
+		expected []string
+	}{
+		{
+			name:     "rescan of the disk",
+			failures: maxEventRetries + 1,
+			handled:  []string{"/dev/nvme0n1"},
+			expected: []string{"/dev/nvme0n1", "/dev/nvme0n1p1", "/dev/nvme0n1p2"},
+		},
+		{
+			name:     "dropped rescan",
+			failures: 2 * (maxEventRetries + 1),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u, _, blockdevices := newTestUdev(t, "nvme.tar.gz")
+			u.queue.queue = workqueue.NewRateLimitingQueue(
+				workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, time.Millisecond))
+			defer u.queue.shutDown()
+
+			attempts := 0
+			var handled []string
+			handler := func(uevent netlink.UEvent) error {
+				attempts++
+				if attempts <= test.failures {
+					return fmt.Errorf("attempt %d failed", attempts)
+				}
+				handled = append(handled, uevent.Env[UDEV_DEVNAME])
+				return u.ActionHandler(uevent)
+			}
+
+			u.queue.add("/dev/nvme0n1p2", partitionEvent(netlink.ADD, "/dev/nvme0n1p2", nvmeIDPath+"-part2"))
+			deadline := time.Now().Add(10 * time.Second)
+			for u.queue.queue.Len() > 0 || len(u.queue.events) > 0 {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected the events to be handled or dropped, got %d pending", len(u.queue.events))
+				}
+				if u.queue.queue.Len() == 0 {
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				u.queue.process(handler)
+			}
+
+			if !reflect.DeepEqual(handled, test.handled) {
+				t.Errorf("expected handled events of %v, got %v", test.handled, handled)
+			}
+			var devPaths []string
+			for devPath := range getNodeBlockDevices(t, blockdevices) {
+				devPaths = append(devPaths, devPath)
+			}
+			sort.Strings(devPaths)
+			if !reflect.DeepEqual(devPaths, test.expected) {
+				t.Errorf("expected block devices of %v, got %v", test.expected, devPaths)
+			}
+		})
+	}
+}
+
+func TestRescanEvent(t *testing.T) {
+	u, host, _ := newTestUdev(t, "nvme.tar.gz")
+	host.RemoveDevice(t, "nvme0n1p2")
+
+	tests := []struct {
+		name        string
+		event       netlink.UEvent
+		expectedKey string
+		expected    netlink.UEvent
+	}{
+		{
+			name:        "partition",
+			event:       partitionEvent(netlink.ADD, "/dev/nvme0n1p1", nvmeIDPath+"-part1"),
+			expectedKey: "/dev/nvme0n1",
+			expected:    diskEvent(netlink.CHANGE, "/dev/nvme0n1", nvmeIDPath+"-part1"),
+		},
+		{
+			name:        "disk",
+			event:       diskEvent(netlink.OFFLINE, "/dev/nvme0n1", nvmeIDPath),
+			expectedKey: "/dev/nvme0n1",
+			expected:    diskEvent(netlink.CHANGE, "/dev/nvme0n1", nvmeIDPath),
+		},
+		{
+			name:        "removed partition",
+			event:       partitionEvent(netlink.CHANGE, "/dev/nvme0n1p2", nvmeIDPath+"-part2"),
+			expectedKey: "/dev/nvme0n1p2",
+			expected:    partitionEvent(netlink.REMOVE, "/dev/nvme0n1p2", nvmeIDPath+"-part2"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, event := u.rescanEvent(test.event)
+			if key != test.expectedKey {
+				t.Errorf("expected key %s, got %s", test.expectedKey, key)
+			}
+			if !reflect.DeepEqual(event, test.expected) {
+				t.Errorf("expected event %+v, got %+v", test.expected, event)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+// Package fakeclients provides the in-memory fakes of the generated controllers for the tests
+package fakeclients
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rancher/wrangler/pkg/generic"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	diskv1 "github.com/longhorn/node-disk-manager/pkg/apis/longhorn.io/v1beta1"
+	ctldiskv1 "github.com/longhorn/node-disk-manager/pkg/generated/controllers/longhorn.io/v1beta1"
+)
+
+// BlockDeviceController is an in-memory BlockDeviceController that stores the objects the way the API server does:
+// a UID and a resource version are assigned, the update of a stale object conflicts, the status is only written by
+// UpdateStatus as the status subresource is enabled, and a deleted object with finalizers remains with the deletion
+// timestamp until its finalizers are removed. The handlers are not invoked, the tests call them with the objects of
+// the store.
+type BlockDeviceController struct {
+	lock            sync.Mutex
+	objects         map[string]*diskv1.BlockDevice
+	indexers        map[string]ctldiskv1.BlockDeviceIndexer
+	resourceVersion int
+
+	// Enqueued records the keys of the objects enqueued by the handlers
+	Enqueued []string
+}
+
+var _ ctldiskv1.BlockDeviceController = &BlockDeviceController{}
+
+// NewBlockDeviceController returns the fake controller that stores the objects with their status
+func NewBlockDeviceController(objects ...*diskv1.BlockDevice) *BlockDeviceController {
+	c := &BlockDeviceController{
+		objects:  make(map[string]*diskv1.BlockDevice),
+		indexers: make(map[string]ctldiskv1.BlockDeviceIndexer),
+	}
+	for _, obj := range objects {
+		if _, err := c.create(obj); err != nil {
+			panic(err)
+		}
+	}
+	return c
+}
+
+func key(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+func notFound(name string) error {
+	return errors.NewNotFound(diskv1.Resource(diskv1.BlockDeviceResourceName), name)
+}
+
+// store saves a copy of the object with a new resource version, the caller must hold the lock
+func (c *BlockDeviceController) store(obj *diskv1.BlockDevice) *diskv1.BlockDevice {
+	c.resourceVersion++
+	stored := obj.DeepCopy()
+	stored.ResourceVersion = strconv.Itoa(c.resourceVersion)
+	c.objects[key(stored.Namespace, stored.Name)] = stored
+	return stored.DeepCopy()
+}
+
+// getForUpdate returns the stored object of the updated one, it fails if the updated object is stale
+func (c *BlockDeviceController) getForUpdate(obj *diskv1.BlockDevice) (*diskv1.BlockDevice, error) {
+	existing, ok := c.objects[key(obj.Namespace, obj.Name)]
+	if !ok {
+		return nil, notFound(obj.Name)
+	}
+	if obj.ResourceVersion != existing.ResourceVersion {
+		return nil, errors.NewConflict(diskv1.Resource(diskv1.BlockDeviceResourceName), obj.Name,
+			fmt.Errorf("the object has been modified, resource version %q is not the latest %q",
+				obj.ResourceVersion, existing.ResourceVersion))
+	}
+	return existing, nil
+}
+
+func (c *BlockDeviceController) Informer() cache.SharedIndexInformer {
+	return nil
+}
+
+func (c *BlockDeviceController) GroupVersionKind() schema.GroupVersionKind {
+	return diskv1.SchemeGroupVersion.WithKind("BlockDevice")
+}
+
+func (c *BlockDeviceController) AddGenericHandler(ctx context.Context, name string, handler generic.Handler) {
+}
+
+func (c *BlockDeviceController) AddGenericRemoveHandler(ctx context.Context, name string, handler generic.Handler) {
+}
+
+func (c *BlockDeviceController) Updater() generic.Updater {
+	return func(obj runtime.Object) (runtime.Object, error) {
+		return c.Update(obj.(*diskv1.BlockDevice))
+	}
+}
+
+func (c *BlockDeviceController) OnChange(ctx context.Context, name string, sync ctldiskv1.BlockDeviceHandler) {
+}
+
+func (c *BlockDeviceController) OnRemove(ctx context.Context, name string, sync ctldiskv1.BlockDeviceHandler) {
+}
+
+func (c *BlockDeviceController) Enqueue(namespace, name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Enqueued = append(c.Enqueued, key(namespace, name))
+}
+
+func (c *BlockDeviceController) EnqueueAfter(namespace, name string, duration time.Duration) {
+	c.Enqueue(namespace, name)
+}
+
+func (c *BlockDeviceController) Cache() ctldiskv1.BlockDeviceCache {
+	return &blockDeviceCache{controller: c}
+}
+
+// Create stores the object without its status, which is written by UpdateStatus
+func (c *BlockDeviceController) Create(obj *diskv1.BlockDevice) (*diskv1.BlockDevice, error) {
+	created := obj.DeepCopy()
+	created.Status = diskv1.BlockDeviceStatus{}
+	return c.create(created)
+}
+
+func (c *BlockDeviceController) create(obj *diskv1.BlockDevice) (*diskv1.BlockDevice, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.objects[key(obj.Namespace, obj.Name)]; ok {
+		return nil, errors.NewAlreadyExists(diskv1.Resource(diskv1.BlockDeviceResourceName), obj.Name)
+	}
+	created := obj.DeepCopy()
+	created.UID = types.UID(fmt.Sprintf("%s-%d", obj.Name, c.resourceVersion+1))
+	created.CreationTimestamp = metav1.Now()
+	created.DeletionTimestamp = nil
+	return c.store(created), nil
+}
+
+// Update replaces the object except its status, the object is removed if it's deleted and its last finalizer is
+// removed
+func (c *BlockDeviceController) Update(obj *diskv1.BlockDevice) (*diskv1.BlockDevice, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	existing, err := c.getForUpdate(obj)
+	if err != nil {
+		return nil, err
+	}
+	updated := obj.DeepCopy()
+	updated.UID = existing.UID
+	updated.CreationTimestamp = existing.CreationTimestamp
+	updated.DeletionTimestamp = existing.DeletionTimestamp
+	existing.Status.DeepCopyInto(&updated.Status)
+	if updated.DeletionTimestamp != nil && len(updated.Finalizers) == 0 {
+		delete(c.objects, key(obj.Namespace, obj.Name))
+		return updated, nil
+	}
+	return c.store(updated), nil
+}
+
+// UpdateStatus replaces the status of the object, the other fields are kept
+func (c *BlockDeviceController) UpdateStatus(obj *diskv1.BlockDevice) (*diskv1.BlockDevice, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	existing, err := c.getForUpdate(obj)
+	if err != nil {
+		return nil, err
+	}
+	updated := existing.DeepCopy()
+	obj.Status.DeepCopyInto(&updated.Status)
+	return c.store(updated), nil
+}
+
+// Delete removes the object, or sets its deletion timestamp if it has finalizers
+func (c *BlockDeviceController) Delete(namespace, name string, options *metav1.DeleteOptions) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	existing, ok := c.objects[key(namespace, name)]
+	if !ok {
+		return notFound(name)
+	}
+	if len(existing.Finalizers) == 0 {
+		delete(c.objects, key(namespace, name))
+		return nil
+	}
+	if existing.DeletionTimestamp == nil {
+		deleted := existing.DeepCopy()
+		now := metav1.Now()
+		deleted.DeletionTimestamp = &now
+		c.store(deleted)
+	}
+	return nil
+}
+
+func (c *BlockDeviceController) Get(namespace, name string, options metav1.GetOptions) (*diskv1.BlockDevice, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	obj, ok := c.objects[key(namespace, name)]
+	if !ok {
+		return nil, notFound(name)
+	}
+	return obj.DeepCopy(), nil
+}
+
+func (c *BlockDeviceController) List(namespace string, opts metav1.ListOptions) (*diskv1.BlockDeviceList, error) {
+	selector, err := labels.Parse(opts.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &diskv1.BlockDeviceList{}
+	for _, obj := range c.list(namespace, selector) {
+		list.Items = append(list.Items, *obj)
+	}
+	return list, nil
+}
+
+// list returns the copies of the objects of the namespace matching the selector, sorted by name
+func (c *BlockDeviceController) list(namespace string, selector labels.Selector) []*diskv1.BlockDevice {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	objs := make([]*diskv1.BlockDevice, 0, len(c.objects))
+	for _, obj := range c.objects {
+		if (namespace == "" || obj.Namespace == namespace) && selector.Matches(labels.Set(obj.Labels)) {
+			objs = append(objs, obj.DeepCopy())
+		}
+	}
+	sort.Slice(objs, func(i, j int) bool {
+		return objs[i].Name < objs[j].Name
+	})
+	return objs
+}
+
+func (c *BlockDeviceController) Watch(namespace string, opts metav1.ListOptions) (watch.Interface, error) {
+	return nil, fmt.Errorf("watch is not supported by the fake controller")
+}
+
+func (c *BlockDeviceController) Patch(namespace, name string, pt types.PatchType, data []byte, subresources ...string) (*diskv1.BlockDevice, error) {
+	return nil, fmt.Errorf("patch is not supported by the fake controller")
+}
+
+// blockDeviceCache reads the store of the controller, so the cache is never stale
+type blockDeviceCache struct {
+	controller *BlockDeviceController
+}
+
+func (c *blockDeviceCache) Get(namespace, name string) (*diskv1.BlockDevice, error) {
+	return c.controller.Get(namespace, name, metav1.GetOptions{})
+}
+
+func (c *blockDeviceCache) List(namespace string, selector labels.Selector) ([]*diskv1.BlockDevice, error) {
+	return c.controller.list(namespace, selector), nil
+}
+
+func (c *blockDeviceCache) AddIndexer(indexName string, indexer ctldiskv1.BlockDeviceIndexer) {
+	c.controller.lock.Lock()
+	defer c.controller.lock.Unlock()
+	c.controller.indexers[indexName] = indexer
+}
+
+func (c *blockDeviceCache) GetByIndex(indexName, key string) ([]*diskv1.BlockDevice, error) {
+	c.controller.lock.Lock()
+	indexer, ok := c.controller.indexers[indexName]
+	c.controller.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("index %s does not exist", indexName)
+	}
+
+	var objs []*diskv1.BlockDevice
+	for _, obj := range c.controller.list("", labels.Everything()) {
+		keys, err := indexer(obj)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			if k == key {
+				objs = append(objs, obj)
+				break
+			}
+		}
+	}
+	return objs, nil
+}
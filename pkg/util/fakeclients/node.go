@@ -0,0 +1,216 @@
+package fakeclients
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rancher/wrangler/pkg/generic"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+
+	diskv1 "github.com/longhorn/node-disk-manager/pkg/apis/longhorn.io/v1beta1"
+	ctldiskv1 "github.com/longhorn/node-disk-manager/pkg/generated/controllers/longhorn.io/v1beta1"
+)
+
+// NodeController is an in-memory NodeController of the Longhorn nodes, a UID and a resource version are assigned and
+// the update of a stale object conflicts. The status is written by Update, as it's reported by Longhorn rather than
+// the controllers under test. The handlers are not invoked, the tests call them with the objects of the store.
+type NodeController struct {
+	lock            sync.Mutex
+	objects         map[string]*diskv1.Node
+	resourceVersion int
+
+	// Enqueued records the keys of the objects enqueued by the handlers
+	Enqueued []string
+}
+
+var _ ctldiskv1.NodeController = &NodeController{}
+
+// NewNodeController returns the fake controller that stores the Longhorn nodes
+func NewNodeController(objects ...*diskv1.Node) *NodeController {
+	c := &NodeController{
+		objects: make(map[string]*diskv1.Node),
+	}
+	for _, obj := range objects {
+		if _, err := c.Create(obj); err != nil {
+			panic(err)
+		}
+	}
+	return c
+}
+
+func nodeNotFound(name string) error {
+	return errors.NewNotFound(diskv1.Resource(diskv1.NodeResourceName), name)
+}
+
+// store saves a copy of the object with a new resource version, the caller must hold the lock
+func (c *NodeController) store(obj *diskv1.Node) *diskv1.Node {
+	c.resourceVersion++
+	stored := obj.DeepCopy()
+	stored.ResourceVersion = strconv.Itoa(c.resourceVersion)
+	c.objects[key(stored.Namespace, stored.Name)] = stored
+	return stored.DeepCopy()
+}
+
+func (c *NodeController) Informer() cache.SharedIndexInformer {
+	return nil
+}
+
+func (c *NodeController) GroupVersionKind() schema.GroupVersionKind {
+	return diskv1.SchemeGroupVersion.WithKind("Node")
+}
+
+func (c *NodeController) AddGenericHandler(ctx context.Context, name string, handler generic.Handler) {
+}
+
+func (c *NodeController) AddGenericRemoveHandler(ctx context.Context, name string, handler generic.Handler) {
+}
+
+func (c *NodeController) Updater() generic.Updater {
+	return func(obj runtime.Object) (runtime.Object, error) {
+		return c.Update(obj.(*diskv1.Node))
+	}
+}
+
+func (c *NodeController) OnChange(ctx context.Context, name string, sync ctldiskv1.NodeHandler) {
+}
+
+func (c *NodeController) OnRemove(ctx context.Context, name string, sync ctldiskv1.NodeHandler) {
+}
+
+func (c *NodeController) Enqueue(namespace, name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Enqueued = append(c.Enqueued, key(namespace, name))
+}
+
+func (c *NodeController) EnqueueAfter(namespace, name string, duration time.Duration) {
+	c.Enqueue(namespace, name)
+}
+
+func (c *NodeController) Cache() ctldiskv1.NodeCache {
+	return &nodeCache{controller: c}
+}
+
+func (c *NodeController) Create(obj *diskv1.Node) (*diskv1.Node, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.objects[key(obj.Namespace, obj.Name)]; ok {
+		return nil, errors.NewAlreadyExists(diskv1.Resource(diskv1.NodeResourceName), obj.Name)
+	}
+	created := obj.DeepCopy()
+	created.UID = types.UID(fmt.Sprintf("%s-%d", obj.Name, c.resourceVersion+1))
+	created.CreationTimestamp = metav1.Now()
+	return c.store(created), nil
+}
+
+// Update replaces the object with its status, it fails if the object is stale
+func (c *NodeController) Update(obj *diskv1.Node) (*diskv1.Node, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	existing, ok := c.objects[key(obj.Namespace, obj.Name)]
+	if !ok {
+		return nil, nodeNotFound(obj.Name)
+	}
+	if obj.ResourceVersion != existing.ResourceVersion {
+		return nil, errors.NewConflict(diskv1.Resource(diskv1.NodeResourceName), obj.Name,
+			fmt.Errorf("the object has been modified, resource version %q is not the latest %q",
+				obj.ResourceVersion, existing.ResourceVersion))
+	}
+	updated := obj.DeepCopy()
+	updated.UID = existing.UID
+	updated.CreationTimestamp = existing.CreationTimestamp
+	return c.store(updated), nil
+}
+
+func (c *NodeController) Delete(namespace, name string, options *metav1.DeleteOptions) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.objects[key(namespace, name)]; !ok {
+		return nodeNotFound(name)
+	}
+	delete(c.objects, key(namespace, name))
+	return nil
+}
+
+func (c *NodeController) Get(namespace, name string, options metav1.GetOptions) (*diskv1.Node, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	obj, ok := c.objects[key(namespace, name)]
+	if !ok {
+		return nil, nodeNotFound(name)
+	}
+	return obj.DeepCopy(), nil
+}
+
+func (c *NodeController) List(namespace string, opts metav1.ListOptions) (*diskv1.NodeList, error) {
+	selector, err := labels.Parse(opts.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &diskv1.NodeList{}
+	for _, obj := range c.list(namespace, selector) {
+		list.Items = append(list.Items, *obj)
+	}
+	return list, nil
+}
+
+// list returns the copies of the objects of the namespace matching the selector, sorted by name
+func (c *NodeController) list(namespace string, selector labels.Selector) []*diskv1.Node {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	objs := make([]*diskv1.Node, 0, len(c.objects))
+	for _, obj := range c.objects {
+		if (namespace == "" || obj.Namespace == namespace) && selector.Matches(labels.Set(obj.Labels)) {
+			objs = append(objs, obj.DeepCopy())
+		}
+	}
+	sort.Slice(objs, func(i, j int) bool {
+		return objs[i].Name < objs[j].Name
+	})
+	return objs
+}
+
+func (c *NodeController) Watch(namespace string, opts metav1.ListOptions) (watch.Interface, error) {
+	return nil, fmt.Errorf("watch is not supported by the fake controller")
+}
+
+func (c *NodeController) Patch(namespace, name string, pt types.PatchType, data []byte, subresources ...string) (*diskv1.Node, error) {
+	return nil, fmt.Errorf("patch is not supported by the fake controller")
+}
+
+// nodeCache reads the store of the controller, so the cache is never stale
+type nodeCache struct {
+	controller *NodeController
+}
+
+func (c *nodeCache) Get(namespace, name string) (*diskv1.Node, error) {
+	return c.controller.Get(namespace, name, metav1.GetOptions{})
+}
+
+func (c *nodeCache) List(namespace string, selector labels.Selector) ([]*diskv1.Node, error) {
+	return c.controller.list(namespace, selector), nil
+}
+
+func (c *nodeCache) AddIndexer(indexName string, indexer ctldiskv1.NodeIndexer) {
+}
+
+func (c *nodeCache) GetByIndex(indexName, key string) ([]*diskv1.Node, error) {
+	return nil, fmt.Errorf("index %s does not exist", indexName)
+}
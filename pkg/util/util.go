@@ -1,18 +1,59 @@
 package util
 
 import (
-	"fmt"
+	"crypto/md5"
+	"encoding/hex"
 	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 const (
 	LonghornBusPathSubstring = "longhorn"
 )
 
-func GetBlockDeviceName(deviceName, nodeName string) string {
-	return fmt.Sprintf("%s-%s", deviceName, nodeName)
+// GetBlockDeviceName returns the name of the block device CR. The name is a hash of the node name and the
+// stable identifier of the device, so that it keeps pointing to the same physical device after the kernel
+// device name changes, e.g. sdb becomes sda after a reboot.
+func GetBlockDeviceName(identifier, nodeName string) string {
+	hash := md5.Sum([]byte(nodeName + "/" + identifier))
+	return hex.EncodeToString(hash[:])
 }
 
 func IsLonghornBlockDevice(path string) bool {
 	return strings.Contains(path, LonghornBusPathSubstring)
 }
+
+// HasFinalizer returns true if the object has the finalizer
+func HasFinalizer(obj metav1.Object, finalizer string) bool {
+	for _, f := range obj.GetFinalizers() {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// AddFinalizer adds the finalizer to the object, it returns false if the object already has the finalizer
+func AddFinalizer(obj metav1.Object, finalizer string) bool {
+	if HasFinalizer(obj, finalizer) {
+		return false
+	}
+	obj.SetFinalizers(append(obj.GetFinalizers(), finalizer))
+	return true
+}
+
+// RemoveFinalizer removes the finalizer from the object, it returns false if the object doesn't have the finalizer
+func RemoveFinalizer(obj metav1.Object, finalizer string) bool {
+	finalizers := make([]string, 0, len(obj.GetFinalizers()))
+	for _, f := range obj.GetFinalizers() {
+		if f != finalizer {
+			finalizers = append(finalizers, f)
+		}
+	}
+	if len(finalizers) == len(obj.GetFinalizers()) {
+		return false
+	}
+	obj.SetFinalizers(finalizers)
+	return true
+}